@@ -3,19 +3,36 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/julienschmidt/httprouter"
 )
 
 // Analytics endpoint - Shows DM statistics
-// Add this to your main.go routes:
-// http.HandleFunc("/analytics", analyticsHandler)
+// Served at GET /api/accounts/:account_id/analytics, scoped to that account
+// ("env" for the IG_BUSINESS_ID account)
 
 type Analytics struct {
-	TotalSent    int     `json:"total_sent"`
-	TotalFailed  int     `json:"total_failed"`
-	SuccessRate  float64 `json:"success_rate"`
-	Last24Hours  int     `json:"last_24_hours"`
-	TopPosts     []PostStat `json:"top_posts"`
+	TotalSent   int        `json:"total_sent"`
+	TotalFailed int        `json:"total_failed"`
+	SuccessRate float64    `json:"success_rate"`
+	Last24Hours int        `json:"last_24_hours"`
+	TopPosts    []PostStat `json:"top_posts"`
+	// Sent -> clicked conversion from tracked links (see links.go)
+	TemplateConversions []ConversionStat `json:"template_conversions"`
+	PostConversions     []ConversionStat `json:"post_conversions"`
+}
+
+// A DM counts as clicked when its recipient opened any tracked link in it
+type ConversionStat struct {
+	TemplateID     int     `json:"template_id,omitempty"`
+	PostID         string  `json:"post_id,omitempty"`
+	Sent           int     `json:"sent"`
+	Clicked        int     `json:"clicked"`
+	Clicks         int     `json:"clicks"`
+	ConversionRate float64 `json:"conversion_rate"`
+	Downloaded     int     `json:"downloaded"` // recipients who used a signed download link
 }
 
 type PostStat struct {
@@ -23,47 +40,114 @@ type PostStat struct {
 	DMCount int    `json:"dm_count"`
 }
 
-func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+func analyticsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	account := jobAccountArg(p.ByName("account_id"))
 	stats := Analytics{}
-	
+
 	// Total sent
-	db.QueryRow("SELECT COUNT(*) FROM dm_logs WHERE status = 'sent'").Scan(&stats.TotalSent)
-	
+	db.QueryRow(`
+		SELECT COUNT(*) FROM dm_logs
+		WHERE status = 'sent' AND ig_account_id IS NOT DISTINCT FROM $1::integer
+	`, account).Scan(&stats.TotalSent)
+
 	// Total failed
-	db.QueryRow("SELECT COUNT(*) FROM dm_logs WHERE status = 'failed'").Scan(&stats.TotalFailed)
-	
+	db.QueryRow(`
+		SELECT COUNT(*) FROM dm_logs
+		WHERE status = 'failed' AND ig_account_id IS NOT DISTINCT FROM $1::integer
+	`, account).Scan(&stats.TotalFailed)
+
 	// Success rate
 	total := stats.TotalSent + stats.TotalFailed
 	if total > 0 {
 		stats.SuccessRate = float64(stats.TotalSent) / float64(total) * 100
 	}
-	
+
 	// Last 24 hours
 	db.QueryRow(`
 		SELECT COUNT(*) FROM dm_logs 
-		WHERE sent_at > NOW() - INTERVAL '24 hours'
-	`).Scan(&stats.Last24Hours)
-	
+		WHERE sent_at > NOW() - INTERVAL '24 hours' AND ig_account_id IS NOT DISTINCT FROM $1::integer
+		  AND status <> 'simulated'
+	`, account).Scan(&stats.Last24Hours)
+
 	// Top posts
-	rows, _ := db.Query(`
+	rows, err := db.Query(`
 		SELECT post_id, COUNT(*) as count
 		FROM dm_logs
+		WHERE ig_account_id IS NOT DISTINCT FROM $1::integer AND status <> 'simulated'
 		GROUP BY post_id
 		ORDER BY count DESC
 		LIMIT 5
-	`)
-	defer rows.Close()
-	
-	for rows.Next() {
-		var ps PostStat
-		rows.Scan(&ps.PostID, &ps.DMCount)
-		stats.TopPosts = append(stats.TopPosts, ps)
+	`, account)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var ps PostStat
+			rows.Scan(&ps.PostID, &ps.DMCount)
+			stats.TopPosts = append(stats.TopPosts, ps)
+		}
 	}
-	
+
+	// Conversions
+	stats.TemplateConversions = conversionStats("COALESCE(j.template_id, 0)", account)
+	stats.PostConversions = conversionStats("j.post_id", account)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 }
 
+// conversionStats groups the account's sent DM jobs by groupBy (template or
+// post) and counts the ones whose recipient clicked a tracked link. account
+// is a jobAccountArg.
+func conversionStats(groupBy string, account interface{}) []ConversionStat {
+	stats := []ConversionStat{}
+
+	rows, err := db.Query(`
+		SELECT `+groupBy+`::text, COUNT(*),
+		       COUNT(*) FILTER (WHERE clicks > 0),
+		       COALESCE(SUM(clicks), 0),
+		       COUNT(*) FILTER (WHERE downloads > 0)
+		FROM (
+			SELECT j.*, (
+				SELECT COUNT(*) FROM tbl_link_clicks c
+				WHERE c.user_id = j.user_id AND c.post_id = j.post_id
+			) AS clicks, (
+				SELECT COUNT(*) FROM tbl_download_logs d
+				WHERE d.user_id = j.user_id AND d.post_id = j.post_id
+			) AS downloads
+			FROM dm_jobs j
+			WHERE j.status = 'sent' AND j.ig_account_id IS NOT DISTINCT FROM $1::integer
+		) j
+		GROUP BY 1
+		ORDER BY 2 DESC
+		LIMIT 50
+	`, account)
+	if err != nil {
+		return stats
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var cs ConversionStat
+		rows.Scan(&key, &cs.Sent, &cs.Clicked, &cs.Clicks, &cs.Downloaded)
+		if groupBy == "j.post_id" {
+			cs.PostID = key
+		} else {
+			cs.TemplateID, _ = strconv.Atoi(key)
+		}
+		if cs.Sent > 0 {
+			cs.ConversionRate = float64(cs.Clicked) / float64(cs.Sent) * 100
+		}
+		stats = append(stats, cs)
+	}
+
+	return stats
+}
+
 // Simple in-memory rate limiter
 type RateLimiter struct {
 	requests map[string][]time.Time
@@ -79,10 +163,10 @@ func NewRateLimiter() *RateLimiter {
 func (rl *RateLimiter) Allow(key string) bool {
 	now := time.Now()
 	cutoff := now.Add(-1 * time.Minute)
-	
+
 	// Get existing requests
 	requests := rl.requests[key]
-	
+
 	// Filter out old requests
 	var valid []time.Time
 	for _, t := range requests {
@@ -90,24 +174,24 @@ func (rl *RateLimiter) Allow(key string) bool {
 			valid = append(valid, t)
 		}
 	}
-	
+
 	// Check limit (5 per minute)
 	if len(valid) >= 5 {
 		return false
 	}
-	
+
 	// Add new request
 	valid = append(valid, now)
 	rl.requests[key] = valid
-	
+
 	return true
 }
 
 // Usage in main.go:
 // var limiter = NewRateLimiter()
-// 
+//
 // Before sending DM:
 // if !limiter.Allow(userID) {
 //     log.Printf("Rate limited for user: %s", userID)
 //     return
-// }
\ No newline at end of file
+// }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAnalyticsHandler(t *testing.T) {
+	setupTestDB(t)
+	accountID := insertTestAccount(t, modeLive)
+
+	logDM(DMJob{AccountID: accountID, UserID: "u1", PostID: "17900000000000001", CommentID: "c1"}, "sent", "")
+	logDM(DMJob{AccountID: accountID, UserID: "u2", PostID: "17900000000000001", CommentID: "c2"}, "failed", "boom")
+	logDM(DMJob{UserID: "u3", PostID: "17900000000000002", CommentID: "c3"}, "sent", "")
+
+	router := httprouter.New()
+	router.GET("/api/accounts/:account_id/analytics", analyticsHandler)
+	token, _ := generateJWT(1, "owner@example.com")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/accounts/"+accountID+"/analytics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: got %d, want 401", rec.Code)
+	}
+
+	tests := []struct {
+		account      string
+		sent, failed int
+		topPost      string
+	}{
+		{accountID, 1, 1, "17900000000000001"},
+		{envAccountID, 1, 0, "17900000000000002"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/accounts/"+tt.account+"/analytics", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var stats Analytics
+		json.NewDecoder(rec.Body).Decode(&stats)
+		if rec.Code != http.StatusOK || stats.TotalSent != tt.sent || stats.TotalFailed != tt.failed {
+			t.Errorf("account %s: got %d with %d sent / %d failed, want %d / %d",
+				tt.account, rec.Code, stats.TotalSent, stats.TotalFailed, tt.sent, tt.failed)
+		}
+		if len(stats.TopPosts) != 1 || stats.TopPosts[0].PostID != tt.topPost {
+			t.Errorf("account %s: top posts %+v, want only %s", tt.account, stats.TopPosts, tt.topPost)
+		}
+	}
+}
@@ -1,19 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/crypto/bcrypt"
+
+	"instagram-autodm/graph"
 )
 
 // ============================================
@@ -38,6 +38,7 @@ type ConnectIGAccountRequest struct {
 	IGBusinessID   string `json:"ig_business_id"`
 	IGUsername     string `json:"ig_username"`
 	IGBusinessName string `json:"ig_business_name"`
+	ExpiresIn      int64  `json:"expires_in"` // from the token exchange, optional
 }
 
 type CreateProductRequest struct {
@@ -54,8 +55,10 @@ type CreateDMTemplateRequest struct {
 	MessageText         string `json:"message_text"`
 	IncludeDownloadLink bool   `json:"include_download_link"`
 	DownloadLink        string `json:"download_link"`
+	DownloadFile        string `json:"download_file"` // storage key for a signed download
 	IncludeProductInfo  bool   `json:"include_product_info"`
 	IsDefault           bool   `json:"is_default"`
+	ProductIDs          []int  `json:"product_ids"` // extra carousel cards
 }
 
 type PublishPostRequest struct {
@@ -79,10 +82,11 @@ type CommentWebhookPayload struct {
 		Changes []struct {
 			Field string `json:"field"`
 			Value struct {
-				ID      string `json:"id"`
-				MediaID string `json:"media_id"`
-				Text    string `json:"text"`
-				From    struct {
+				ID       string `json:"id"`
+				MediaID  string `json:"media_id"`
+				Text     string `json:"text"`
+				ParentID string `json:"parent_id"`
+				From     struct {
 					ID       string `json:"id"`
 					Username string `json:"username"`
 				} `json:"from"`
@@ -91,22 +95,6 @@ type CommentWebhookPayload struct {
 	} `json:"entry"`
 }
 
-type LiveChatWebhookPayload struct {
-	Entry []struct {
-		ID        string `json:"id"`
-		Messaging []struct {
-			Sender struct {
-				ID string `json:"id"`
-			} `json:"sender"`
-			Message struct {
-				Text string `json:"text"`
-				Mid  string `json:"mid"`
-			} `json:"message"`
-			Timestamp int64 `json:"timestamp"`
-		} `json:"messaging"`
-	} `json:"entry"`
-}
-
 // JWT Claims
 type UserClaims struct {
 	UserID int64  `json:"user_id"`
@@ -236,6 +224,7 @@ func connectIGAccountHandler(w http.ResponseWriter, r *http.Request, p httproute
 		req.IGBusinessID,
 		req.IGUsername,
 		req.IGBusinessName,
+		req.ExpiresIn,
 	)
 	if err != nil {
 		log.Printf("Failed to connect IG account: %v", err)
@@ -301,6 +290,33 @@ func createDMTemplateHandler(w http.ResponseWriter, r *http.Request, p httproute
 		return
 	}
 
+	if err := validateDMTemplate(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, productID := range req.ProductIDs {
+		if err := validatePublishRefs(accountID, productID, 0); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.DownloadFile != "" {
+		if !downloadsEnabled() {
+			http.Error(w, "download_file needs DOWNLOAD_SECRET and PUBLIC_BASE_URL to be configured", http.StatusBadRequest)
+			return
+		}
+		accountNum, _ := strconv.Atoi(accountID)
+		key, err := accountFileKey(accountNum, req.DownloadFile)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, err := fileStorage.Exists(key); err != nil || !ok {
+			http.Error(w, fmt.Sprintf("download_file not found in storage (upload it as %s)", key), http.StatusBadRequest)
+			return
+		}
+	}
+
 	templateID, err := createDMTemplate(
 		accountID,
 		req.ProductID,
@@ -308,12 +324,18 @@ func createDMTemplateHandler(w http.ResponseWriter, r *http.Request, p httproute
 		req.MessageText,
 		req.IncludeDownloadLink,
 		req.DownloadLink,
+		req.DownloadFile,
 		req.IncludeProductInfo,
 	)
 	if err != nil {
 		http.Error(w, "Failed to create template", http.StatusInternalServerError)
 		return
 	}
+	if err := setTemplateProducts(templateID, req.ProductIDs); err != nil {
+		log.Printf("Failed to link template products: %v", err)
+		http.Error(w, "Failed to create template", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -398,6 +420,8 @@ func publishReelHandler(w http.ResponseWriter, r *http.Request, p httprouter.Par
 }
 
 // Comment Webhook
+// Alias for existing per-account subscriptions; new setups should point Meta
+// at /webhook, which routes each entry to its account by entry id.
 func commentWebhookHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	accountID := p.ByName("account_id")
 
@@ -430,7 +454,7 @@ func liveChatWebhookHandler(w http.ResponseWriter, r *http.Request, p httprouter
 	accountID := p.ByName("account_id")
 
 	if r.Method == http.MethodPost {
-		var payload LiveChatWebhookPayload
+		var payload WebhookPayload
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 			log.Printf("Failed to decode live chat webhook: %v", err)
 			w.WriteHeader(http.StatusOK)
@@ -532,36 +556,39 @@ func verifyJWT(authHeader string) (*UserClaims, error) {
 	return nil, fmt.Errorf("invalid token")
 }
 
-func connectInstagramAccount(userID, accessToken, igID, username, businessName string) (string, error) {
+func connectInstagramAccount(userID, accessToken, igID, username, businessName string, expiresIn int64) (string, error) {
 	// Verify token is valid with Instagram API first
-	verifyURL := fmt.Sprintf("https://graph.instagram.com/v18.0/me?access_token=%s", accessToken)
-	resp, err := http.Get(verifyURL)
+	creds := IGCredentials{IGUserID: igID, AccessToken: accessToken}
+	me, err := graphAPI(creds).GetMe()
 	if err != nil {
-		log.Printf("Failed to verify Instagram token: %v", err)
-		return "", fmt.Errorf("invalid access token or network error")
+		log.Printf("Instagram API verification failed: %v", err)
+		return "", fmt.Errorf("access token verification failed: %v", err)
 	}
-	defer resp.Body.Close()
+	log.Printf("Verified Instagram token for @%s", me.Username)
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Instagram API verification failed: %s", string(body))
-		return "", fmt.Errorf("access token verification failed: %d", resp.StatusCode)
+	// Track expiry so the token is refreshed in time. Without expires_in or
+	// debug_token, assume a freshly exchanged long-lived token.
+	expiresAt, ok := tokenExpiry(creds, expiresIn)
+	if !ok {
+		expiresAt = time.Now().Add(longLivedTokenTTL)
 	}
 
-	var verifyResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&verifyResp)
-
 	// Store IG account in database
 	var accountID string
 	insertQuery := `
 		INSERT INTO tbl_ig_accounts (
 			app_user_id, platform_ig_account_id, platform_user_account_id,
-			username, name, access_token, platform
-		) VALUES ($1, $2, $3, $4, $5, $6, $7)
+			username, name, access_token, platform,
+			token_expires_at, token_refreshed_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP)
 		ON CONFLICT (platform_ig_account_id) 
 		DO UPDATE SET 
 			access_token = $6,
 			username = $4,
+			status = 'active',
+			token_expires_at = $8,
+			token_refreshed_at = CURRENT_TIMESTAMP,
+			token_refresh_error = NULL,
 			updated_at = CURRENT_TIMESTAMP
 		RETURNING id
 	`
@@ -575,6 +602,7 @@ func connectInstagramAccount(userID, accessToken, igID, username, businessName s
 		businessName,
 		accessToken,
 		"instagram",
+		expiresAt.UTC(),
 	).Scan(&accountID)
 
 	if err != nil {
@@ -605,14 +633,14 @@ func createProduct(accountID string, name, description string, price float64, im
 	return productID, nil
 }
 
-func createDMTemplate(accountID string, productID int, templateName, messageText string, includeLink bool, downloadLink string, includeProductInfo bool) (int, error) {
+func createDMTemplate(accountID string, productID int, templateName, messageText string, includeLink bool, downloadLink, downloadFile string, includeProductInfo bool) (int, error) {
 	// Insert DM template into tbl_dm_templates
 	var templateID int
 	query := `
 		INSERT INTO tbl_dm_templates (
 			ig_account_id, product_id, template_name, message_text,
-			include_download_link, download_link, include_product_info, is_default
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, true)
+			include_download_link, download_link, include_product_info, is_default, download_file
+		) VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6, $7, true, NULLIF($8, ''))
 		RETURNING id
 	`
 
@@ -625,6 +653,7 @@ func createDMTemplate(accountID string, productID int, templateName, messageText
 		includeLink,
 		downloadLink,
 		includeProductInfo,
+		downloadFile,
 	).Scan(&templateID)
 
 	if err != nil {
@@ -657,76 +686,42 @@ func publishPost(accountID, caption, imageURL string, productID, dmTemplateID in
 		return "", fmt.Errorf("missing account credentials")
 	}
 
+	if err := validatePublishRefs(accountID, productID, dmTemplateID); err != nil {
+		return "", err
+	}
+
 	// Step 1: Validate image URL is accessible
 	if !isValidImageURL(imageURL) {
 		log.Printf("Invalid or unreachable image URL: %s", imageURL)
 		return "", fmt.Errorf("image URL is invalid or unreachable - please check the URL and try again")
 	}
 
+	api := graphAPI(IGCredentials{IGUserID: igUserID, AccessToken: accessToken})
+
 	// Step 2: Create media container for image
-	containerID, err := createImageContainer(igUserID, accessToken, caption, imageURL)
+	containerID, err := api.CreateContainer(graph.Container{ImageURL: imageURL, Caption: caption})
 	if err != nil {
 		log.Printf("Failed to create image container: %v", err)
 		return "", fmt.Errorf("failed to create image container: %v", err)
 	}
 
-	if containerID == "" {
-		return "", fmt.Errorf("no container ID returned from Instagram API")
-	}
-
 	// Step 3: Publish the media
-	publishURL := fmt.Sprintf(
-		"https://graph.instagram.com/v18.0/%s/media_publish?access_token=%s",
-		igUserID,
-		accessToken,
-	)
-
-	payload := map[string]string{
-		"creation_id": containerID,
-	}
-
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal payload: %v", err)
-		return "", fmt.Errorf("payload error: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", publishURL, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		log.Printf("Failed to create HTTP request: %v", err)
-		return "", fmt.Errorf("request error: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	postID, err := api.Publish(containerID)
 	if err != nil {
-		log.Printf("Failed to publish post (network error): %v", err)
-		return "", fmt.Errorf("network error while publishing: %v", err)
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Printf("Instagram API error response: %s (status: %d)", string(body), resp.StatusCode)
-		return "", fmt.Errorf("instagram API error: %d - %s", resp.StatusCode, string(body))
+		log.Printf("Failed to publish post: %v", err)
+		return "", fmt.Errorf("failed to publish post: %v", err)
 	}
+	log.Printf("Post published successfully with ID: %s", postID)
 
-	var publishResp map[string]interface{}
-	if err := json.Unmarshal(body, &publishResp); err != nil {
-		log.Printf("Failed to decode response: %v", err)
-		return "", fmt.Errorf("failed to decode response: %v", err)
-	}
+	// Step 4: Remember which product and DM template this post sells
+	savePostBinding(PostBinding{
+		MediaID:      postID,
+		AccountID:    accountID,
+		MediaType:    "IMAGE",
+		ProductID:    productID,
+		DMTemplateID: dmTemplateID,
+	}, caption)
 
-	postID, ok := publishResp["id"].(string)
-	if !ok {
-		if val, exists := publishResp["id"]; exists {
-			postID = fmt.Sprintf("%v", val)
-		} else {
-			return "", fmt.Errorf("no post ID in response")
-		}
-	}
-	log.Printf("Post published successfully with ID: %s", postID)
 	return postID, nil
 }
 
@@ -746,57 +741,44 @@ func publishReel(accountID, caption, videoURL, thumbnailURL string, productID, d
 		return "", fmt.Errorf("missing account credentials")
 	}
 
+	if err := validatePublishRefs(accountID, productID, dmTemplateID); err != nil {
+		return "", err
+	}
+
+	api := graphAPI(IGCredentials{IGUserID: igUserID, AccessToken: accessToken})
+
 	// Step 1: Create media container for video
-	containerID, err := createVideoContainer(igUserID, accessToken, caption, videoURL, thumbnailURL)
+	containerID, err := api.CreateContainer(graph.Container{
+		VideoURL:     videoURL,
+		ThumbnailURL: thumbnailURL,
+		Caption:      caption,
+		MediaType:    "REELS",
+	})
 	if err != nil {
 		log.Printf("Failed to create video container: %v", err)
 		return "", err
 	}
 
 	// Step 2: Publish the media
-	publishURL := fmt.Sprintf(
-		"https://graph.instagram.com/v18.0/%s/media_publish?access_token=%s",
-		igUserID,
-		accessToken,
-	)
-
-	payload := map[string]string{
-		"creation_id": containerID,
-	}
-
-	payloadBytes, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", publishURL, bytes.NewBuffer(payloadBytes))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	reelID, err := api.Publish(containerID)
 	if err != nil {
 		log.Printf("Failed to publish reel: %v", err)
-		return "", fmt.Errorf("network error: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Instagram API error response: %s (status: %d)", string(body), resp.StatusCode)
-		return "", fmt.Errorf("instagram API error: %d - %s", resp.StatusCode, string(body))
+		return "", fmt.Errorf("failed to publish reel: %v", err)
 	}
+	log.Printf("Reel published successfully with ID: %s", reelID)
 
-	var publishResp map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&publishResp); err != nil {
-		log.Printf("Failed to decode response: %v", err)
-		return "", err
-	}
+	// Step 3: Remember which product and DM template this reel sells
+	savePostBinding(PostBinding{
+		MediaID:      reelID,
+		AccountID:    accountID,
+		MediaType:    "REELS",
+		ProductID:    productID,
+		DMTemplateID: dmTemplateID,
+	}, caption)
 
-	reelID, ok := publishResp["id"].(string)
-	if !ok {
-		reelID = fmt.Sprintf("%v", publishResp["id"])
-	}
-	log.Printf("Reel published successfully with ID: %s", reelID)
 	return reelID, nil
 }
 
-// Helper function to create image media container
 // Helper function to validate image URL
 func isValidImageURL(imageURL string) bool {
 	if imageURL == "" {
@@ -832,115 +814,6 @@ func isValidImageURL(imageURL string) bool {
 	return true
 }
 
-func createImageContainer(igUserID, accessToken, caption, imageURL string) (string, error) {
-	containerURL := fmt.Sprintf(
-		"https://graph.instagram.com/v18.0/%s/media?access_token=%s",
-		igUserID,
-		accessToken,
-	)
-
-	payload := map[string]string{
-		"image_url": imageURL,
-		"caption":   caption,
-	}
-
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal payload: %v", err)
-		return "", fmt.Errorf("payload error: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", containerURL, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		log.Printf("Failed to create request: %v", err)
-		return "", fmt.Errorf("request error: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Failed to reach Instagram API: %v", err)
-		return "", fmt.Errorf("network error reaching Instagram API: %v", err)
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Printf("Failed to create image container: %s (status: %d)", string(body), resp.StatusCode)
-		return "", fmt.Errorf("failed to create container: status %d - %s", resp.StatusCode, string(body))
-	}
-
-	var respData map[string]interface{}
-	err = json.Unmarshal(body, &respData)
-	if err != nil {
-		log.Printf("Failed to parse container response: %v", err)
-		return "", fmt.Errorf("failed to parse response: %v", err)
-	}
-
-	if respData["id"] == nil {
-		return "", fmt.Errorf("no ID in container response")
-	}
-
-	return fmt.Sprintf("%v", respData["id"]), nil
-}
-
-// Helper function to create video media container
-func createVideoContainer(igUserID, accessToken, caption, videoURL, thumbnailURL string) (string, error) {
-	containerURL := fmt.Sprintf(
-		"https://graph.instagram.com/v18.0/%s/media?access_token=%s",
-		igUserID,
-		accessToken,
-	)
-
-	payload := map[string]string{
-		"video_url":     videoURL,
-		"thumbnail_url": thumbnailURL,
-		"caption":       caption,
-		"media_type":    "REELS",
-	}
-
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal payload: %v", err)
-		return "", fmt.Errorf("payload error: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", containerURL, bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		log.Printf("Failed to create request: %v", err)
-		return "", fmt.Errorf("request error: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 20 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Failed to reach Instagram API: %v", err)
-		return "", fmt.Errorf("network error reaching Instagram API: %v", err)
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Printf("Failed to create video container: %s (status: %d)", string(body), resp.StatusCode)
-		return "", fmt.Errorf("failed to create container: status %d - %s", resp.StatusCode, string(body))
-	}
-
-	var respData map[string]interface{}
-	err = json.Unmarshal(body, &respData)
-	if err != nil {
-		log.Printf("Failed to parse video container response: %v", err)
-		return "", fmt.Errorf("failed to parse response: %v", err)
-	}
-
-	if respData["id"] == nil {
-		return "", fmt.Errorf("no ID in container response")
-	}
-
-	return fmt.Sprintf("%v", respData["id"]), nil
-}
-
 func handleWebhookVerification(w http.ResponseWriter, r *http.Request) {
 	mode := r.URL.Query().Get("hub.mode")
 	token := r.URL.Query().Get("hub.verify_token")
@@ -956,39 +829,65 @@ func handleWebhookVerification(w http.ResponseWriter, r *http.Request) {
 }
 
 func processCommentWebhook(accountID string, payload CommentWebhookPayload) {
-	// Parse comments from webhook
-	// Store commenter in tbl_ig_users if not exists
-	// Store comment in tbl_comments
-	// Get DM template for post
-	// Queue DM to be sent
+	// Parse comments from webhook, then for each one:
+	// store commenter in tbl_ig_users and comment in tbl_comments,
+	// match the account's triggers, pick the DM template for the post,
+	// and queue the DM (sent with this account's token)
 
 	log.Printf("Processing %d comment entries for account %s", len(payload.Entry), accountID)
 
+	var exists bool
+	db.QueryRow("SELECT EXISTS(SELECT 1 FROM tbl_ig_accounts WHERE id = $1)", accountID).Scan(&exists)
+	if !exists {
+		log.Printf("Ignoring comment webhook for unknown account %s", accountID)
+		return
+	}
+
 	for _, entry := range payload.Entry {
 		for _, change := range entry.Changes {
 			if change.Field == "comments" {
 				v := change.Value
 				log.Printf("Comment from @%s: %s", v.From.Username, v.Text)
 
-				// TODO: Store commenter and comment data
-				// TODO: Match against DM template
-				// TODO: Queue DM send
+				processAccountComment(accountID, CommentData{
+					ID:       v.ID,
+					MediaID:  v.MediaID,
+					Text:     v.Text,
+					ParentID: v.ParentID,
+					From: User{
+						ID:       v.From.ID,
+						Username: v.From.Username,
+					},
+				})
 			}
 		}
 	}
 }
 
-func processLiveChatWebhook(accountID string, payload LiveChatWebhookPayload) {
-	// Parse live chat messages
-	// Store user in tbl_ig_users
-	// Store message in tbl_live_chat_messages
+// Live comments arrive as live_comments changes, parsed exactly as on
+// /webhook. DMs delivered here are inbound messages, not comments, and go to
+// the messaging pipeline.
+func processLiveChatWebhook(accountID string, payload WebhookPayload) {
+	log.Printf("Processing live chat webhook for account %s", accountID)
 
-	log.Printf("Processing live chat messages for account %s", accountID)
+	var igID string
+	err := db.QueryRow("SELECT platform_ig_account_id FROM tbl_ig_accounts WHERE id = $1", accountID).Scan(&igID)
+	if err != nil {
+		log.Printf("Ignoring live chat webhook for unknown account %s", accountID)
+		return
+	}
 
 	for _, entry := range payload.Entry {
-		for _, msg := range entry.Messaging {
-			log.Printf("Live chat from user %s", msg.Sender.ID)
-			// TODO: Store live chat participant data
+		for _, event := range entry.Messaging {
+			processInboundMessage(igID, accountID, event)
+		}
+
+		for _, change := range entry.Changes {
+			if change.Field != "live_comments" {
+				log.Printf("Ignoring %q change on the live chat webhook for account %s", change.Field, accountID)
+				continue
+			}
+			processChange(igID, accountID, change)
 		}
 	}
 }
@@ -1000,9 +899,9 @@ func processLiveChatWebhook(accountID string, payload LiveChatWebhookPayload) {
 func testPostImageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Println("🧪 Test endpoint called - attempting to post image directly")
 
-	// Use credentials from env
-	igUserID := os.Getenv("IG_BUSINESS_ID")
-	accessToken := os.Getenv("ACCESS_TOKEN")
+	// Use the env account (ACCESS_TOKEN, as refreshed)
+	igUserID := config.IGBusinessID
+	accessToken := envAccessToken()
 
 	if igUserID == "" || accessToken == "" {
 		log.Println("❌ Missing credentials")
@@ -1018,90 +917,26 @@ func testPostImageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	caption := "Test Post from Backend - " + time.Now().Format("2006-01-02 15:04:05")
 	imageURL := "https://upload.wikimedia.org/wikipedia/commons/thumb/a/a7/Camponotus_flavomarginatus_ant.jpg/320px-Camponotus_flavomarginatus_ant.jpg"
 
-	containerURL := fmt.Sprintf(
-		"https://graph.instagram.com/v18.0/%s/media?access_token=%s",
-		igUserID,
-		accessToken,
-	)
-
-	payload := map[string]string{
-		"image_url": imageURL,
-		"caption":   caption,
-	}
-
-	payloadBytes, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", containerURL, bytes.NewBuffer(payloadBytes))
-	req.Header.Set("Content-Type", "application/json")
+	api := graphAPI(IGCredentials{IGUserID: igUserID, AccessToken: accessToken})
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	containerID, err := api.CreateContainer(graph.Container{ImageURL: imageURL, Caption: caption})
 	if err != nil {
 		log.Printf("❌ Failed to create container: %v", err)
 		http.Error(w, fmt.Sprintf("Failed to create container: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("📥 Container Response Status: %d", resp.StatusCode)
-	log.Printf("📥 Container Response Body: %s", string(body))
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Printf("❌ Failed to create container: %s", string(body))
-		http.Error(w, fmt.Sprintf("Failed to create container: %s", string(body)), http.StatusInternalServerError)
-		return
-	}
-
-	var respData map[string]interface{}
-	json.Unmarshal(body, &respData)
-
-	containerID := fmt.Sprintf("%v", respData["id"])
-	if containerID == "" || containerID == "<nil>" {
-		log.Printf("❌ No container ID in response: %v", respData)
-		http.Error(w, "No container ID returned", http.StatusInternalServerError)
-		return
-	}
 
 	log.Printf("✅ Container created with ID: %s", containerID)
 
 	// Step 2: Publish the media
 	log.Println("📤 Step 2: Publishing media...")
-	publishURL := fmt.Sprintf(
-		"https://graph.instagram.com/v18.0/%s/media_publish?access_token=%s",
-		igUserID,
-		accessToken,
-	)
-
-	publishPayload := map[string]string{
-		"creation_id": containerID,
-	}
-
-	publishPayloadBytes, _ := json.Marshal(publishPayload)
-	publishReq, _ := http.NewRequest("POST", publishURL, bytes.NewBuffer(publishPayloadBytes))
-	publishReq.Header.Set("Content-Type", "application/json")
-
-	publishResp, err := client.Do(publishReq)
+	postID, err := api.Publish(containerID)
 	if err != nil {
 		log.Printf("❌ Failed to publish: %v", err)
 		http.Error(w, fmt.Sprintf("Failed to publish: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer publishResp.Body.Close()
-
-	publishBody, _ := io.ReadAll(publishResp.Body)
-	log.Printf("📥 Publish Response Status: %d", publishResp.StatusCode)
-	log.Printf("📥 Publish Response Body: %s", string(publishBody))
-
-	if publishResp.StatusCode != http.StatusOK && publishResp.StatusCode != http.StatusCreated {
-		log.Printf("❌ Failed to publish: %s", string(publishBody))
-		http.Error(w, fmt.Sprintf("Failed to publish: %s", string(publishBody)), http.StatusInternalServerError)
-		return
-	}
-
-	var publishData map[string]interface{}
-	json.Unmarshal(publishBody, &publishData)
 
-	postID := fmt.Sprintf("%v", publishData["id"])
 	log.Printf("✅ Post published successfully with ID: %s", postID)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1116,9 +951,9 @@ func testPostImageHandler(w http.ResponseWriter, r *http.Request, _ httprouter.P
 func testPostReelHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Println("🧪 Test reel endpoint - checking reel infrastructure")
 
-	// Use credentials from env
-	igUserID := os.Getenv("IG_BUSINESS_ID")
-	accessToken := os.Getenv("ACCESS_TOKEN")
+	// Use the env account (ACCESS_TOKEN, as refreshed)
+	igUserID := config.IGBusinessID
+	accessToken := envAccessToken()
 
 	if igUserID == "" || accessToken == "" {
 		log.Println("❌ Missing credentials")
@@ -1142,51 +977,19 @@ func testPostReelHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 	}
 	log.Printf("📌 Using Video URL: %s", videoURL)
 
-	containerURL := fmt.Sprintf(
-		"https://graph.instagram.com/v18.0/%s/media?access_token=%s",
-		igUserID,
-		accessToken,
-	)
+	api := graphAPI(IGCredentials{IGUserID: igUserID, AccessToken: accessToken})
 
 	// Create reel container with just required fields
-	payload := map[string]interface{}{
-		"video_url":  videoURL,
-		"caption":    caption,
-		"media_type": "REELS",
-	}
-
-	payloadBytes, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", containerURL, bytes.NewBuffer(payloadBytes))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	containerID, err := api.CreateContainer(graph.Container{
+		VideoURL:  videoURL,
+		Caption:   caption,
+		MediaType: "REELS",
+	})
 	if err != nil {
 		log.Printf("❌ Failed to create reel container: %v", err)
 		http.Error(w, fmt.Sprintf("Failed to create reel container: %v", err), http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	log.Printf("📥 Container Response Status: %d", resp.StatusCode)
-	log.Printf("📥 Container Response Body: %s", string(body))
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		log.Printf("❌ Failed to create reel container: %s", string(body))
-		http.Error(w, fmt.Sprintf("Failed to create reel container: %s", string(body)), http.StatusInternalServerError)
-		return
-	}
-
-	var respData map[string]interface{}
-	json.Unmarshal(body, &respData)
-
-	containerID := fmt.Sprintf("%v", respData["id"])
-	if containerID == "" || containerID == "<nil>" {
-		log.Printf("❌ No container ID in response: %v", respData)
-		http.Error(w, "No container ID returned", http.StatusInternalServerError)
-		return
-	}
 
 	log.Printf("✅ Reel container created with ID: %s", containerID)
 
@@ -1198,87 +1001,42 @@ func testPostReelHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		time.Sleep(5 * time.Second)
 		log.Printf("   Checking status... (attempt %d/24)", i+1)
 
-		// Query just the status field, not non-existent fields
-		statusURL := fmt.Sprintf(
-			"https://graph.instagram.com/v18.0/%s?fields=status&access_token=%s",
-			containerID,
-			accessToken,
-		)
-
-		statusReq, _ := http.NewRequest("GET", statusURL, nil)
-		statusResp, _ := client.Do(statusReq)
-		statusBody, _ := io.ReadAll(statusResp.Body)
-		statusResp.Body.Close()
-
-		var statusData map[string]interface{}
-		json.Unmarshal(statusBody, &statusData)
-
-		if status, ok := statusData["status"].(string); ok {
-			finalStatus = status
-			log.Printf("   📊 Status: %s", status)
-
-			// Stop waiting if we get a terminal state
-			if status == "FINISHED" || status == "READY" {
-				log.Println("   ✅ Video processing complete!")
-				break
-			} else if status == "ERROR" {
-				log.Println("❌ Video processing returned ERROR status")
-				break
-			}
-		} else {
-			// Check if there's an error in the response
-			if errField, hasErr := statusData["error"]; hasErr {
-				log.Printf("   API Error: %v", errField)
-			} else {
-				log.Printf("   Unexpected response: %s", string(statusBody))
-			}
+		status, err := api.ContainerStatus(containerID)
+		if err != nil {
+			log.Printf("   API Error: %v", err)
+			continue
+		}
+
+		finalStatus = status.StatusCode
+		log.Printf("   📊 Status: %s (%s)", status.StatusCode, status.Status)
+
+		// Stop waiting if we get a terminal state
+		if status.StatusCode == "FINISHED" {
+			log.Println("   ✅ Video processing complete!")
+			break
+		} else if status.StatusCode == "ERROR" || status.StatusCode == "EXPIRED" {
+			log.Println("❌ Video processing returned ERROR status")
+			break
 		}
 	}
 
 	log.Printf("📤 Final video status: %s - attempting to publish...", finalStatus)
 
 	// Try to publish
-	publishURL := fmt.Sprintf(
-		"https://graph.instagram.com/v18.0/%s/media_publish?access_token=%s",
-		igUserID,
-		accessToken,
-	)
+	reelID, err := api.Publish(containerID)
 
-	publishPayload := map[string]string{
-		"creation_id": containerID,
-	}
-
-	publishPayloadBytes, _ := json.Marshal(publishPayload)
-	publishReq, _ := http.NewRequest("POST", publishURL, bytes.NewBuffer(publishPayloadBytes))
-	publishReq.Header.Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", "application/json")
 
-	publishResp, err := client.Do(publishReq)
 	if err != nil {
 		log.Printf("❌ Failed to publish: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to publish: %v", err), http.StatusInternalServerError)
-		return
-	}
-	defer publishResp.Body.Close()
-
-	publishBody, _ := io.ReadAll(publishResp.Body)
-	log.Printf("📥 Publish Response Status: %d", publishResp.StatusCode)
-	log.Printf("📥 Publish Response Body: %s", string(publishBody))
-
-	w.Header().Set("Content-Type", "application/json")
-
-	if publishResp.StatusCode != http.StatusOK && publishResp.StatusCode != http.StatusCreated {
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "error",
-			"error":  string(publishBody),
+			"error":  err.Error(),
 			"hint":   "Video URL must be publicly accessible to Instagram's servers. Try with a different video URL: ?video_url=YOUR_URL",
 		})
 		return
 	}
 
-	var publishData map[string]interface{}
-	json.Unmarshal(publishBody, &publishData)
-
-	reelID := fmt.Sprintf("%v", publishData["id"])
 	log.Printf("✅ Reel published successfully with ID: %s", reelID)
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -1302,15 +1060,53 @@ func setupRoutes(router *httprouter.Router) {
 
 	// DM Template routes
 	router.POST("/api/accounts/:account_id/dm-templates", createDMTemplateHandler)
+	router.POST("/api/accounts/:account_id/dm-templates/:template_id/preview", previewDMTemplateHandler)
 
 	// Content publishing routes
 	router.POST("/api/accounts/:account_id/posts", publishPostHandler)
 	router.POST("/api/accounts/:account_id/reels", publishReelHandler)
 
+	// Trigger routes
+	router.GET("/api/accounts/:account_id/triggers", listTriggersHandler)
+	router.POST("/api/accounts/:account_id/triggers", createTriggerHandler)
+	router.GET("/api/accounts/:account_id/triggers/:trigger_id", getTriggerHandler)
+	router.PUT("/api/accounts/:account_id/triggers/:trigger_id", updateTriggerHandler)
+	router.DELETE("/api/accounts/:account_id/triggers/:trigger_id", deleteTriggerHandler)
+	router.GET("/api/accounts/:account_id/comment-replies", listCommentRepliesHandler)
+
+	// Send mode routes
+	router.GET("/api/accounts/:account_id/mode", accountModeHandler)
+	router.PUT("/api/accounts/:account_id/mode", accountModeHandler)
+	router.GET("/api/accounts/:account_id/simulated-dms", listSimulatedDMsHandler)
+
+	// Conversation flow routes
+	router.GET("/api/accounts/:account_id/flows", listFlowsHandler)
+	router.POST("/api/accounts/:account_id/flows", createFlowHandler)
+	router.GET("/api/accounts/:account_id/flows/:flow_id", getFlowHandler)
+	router.PUT("/api/accounts/:account_id/flows/:flow_id", updateFlowHandler)
+	router.DELETE("/api/accounts/:account_id/flows/:flow_id", deleteFlowHandler)
+
+	// Lead routes
+	router.GET("/api/accounts/:account_id/leads/export", exportLeadsHandler)
+
+	// Live broadcast routes
+	router.GET("/api/accounts/:account_id/live", listBroadcastsHandler)
+	router.GET("/api/accounts/:account_id/live/:broadcast_id/summary", broadcastSummaryHandler)
+
+	// Analytics
+	router.GET("/api/accounts/:account_id/analytics", analyticsHandler)
+
+	// Dead-letter queue routes
+	router.GET("/api/accounts/:account_id/dm-jobs/stats", dmJobStatsHandler)
+	router.GET("/api/accounts/:account_id/dead-jobs", listDeadJobsHandler)
+	router.POST("/api/accounts/:account_id/dead-jobs/requeue", requeueDeadJobsHandler)
+	router.POST("/api/accounts/:account_id/dead-jobs/discard", discardDeadJobsHandler)
+
 	// Webhook routes
 	router.GET("/api/accounts/:account_id/webhook/comments", commentWebhookHandler)
-	router.POST("/api/accounts/:account_id/webhook/comments", commentWebhookHandler)
-	router.POST("/api/accounts/:account_id/webhook/live-chat", liveChatWebhookHandler)
+	router.POST("/api/accounts/:account_id/webhook/comments", verifyWebhookSignature(commentWebhookHandler))
+	router.POST("/api/accounts/:account_id/webhook/live-chat", verifyWebhookSignature(liveChatWebhookHandler))
+	router.POST("/api/accounts/:account_id/webhook/simulate", simulateWebhookHandler)
 
 	// Test endpoint - posts image directly from backend
 	router.GET("/api/test-post-image", testPostImageHandler)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"instagram-autodm/graph/graphtest"
+)
+
+// Fake Graph API server for local end-to-end runs:
+//
+//	go run ./cmd/fakegraph -addr :9090 -script rules.json
+//	GRAPH_API_BASE_URL=http://localhost:9090 go run .
+//
+// rules.json is a list of graphtest.ScriptRule; more can be added while it
+// runs with POST /_fake/script. Every request is logged and can be read back
+// from GET /_fake/requests.
+func main() {
+	addr := flag.String("addr", ":9090", "listen address")
+	script := flag.String("script", "", "JSON file with scripted responses")
+	username := flag.String("username", "fake_account", "username returned by /me")
+	flag.Parse()
+
+	fake := graphtest.New()
+	fake.Username = *username
+
+	if *script != "" {
+		b, err := os.ReadFile(*script)
+		if err != nil {
+			log.Fatal("❌ Reading script: ", err)
+		}
+		var rules []graphtest.ScriptRule
+		if err := json.Unmarshal(b, &rules); err != nil {
+			log.Fatal("❌ Parsing script: ", err)
+		}
+		if err := fake.Script(rules); err != nil {
+			log.Fatal("❌ Script: ", err)
+		}
+		log.Printf("📜 Loaded %d scripted responses from %s", len(rules), *script)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		fake.ServeHTTP(rec, r)
+		log.Printf("📡 %s %s → %d", r.Method, r.URL.Path, rec.status)
+	})
+
+	log.Printf("🧪 Fake Graph API listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+
+	"instagram-autodm/graph"
+)
+
+// ============================================
+// PUBLIC COMMENT REPLIES
+// ============================================
+
+// A trigger with reply_variants also answers the triggering comment publicly
+// (POST /{comment-id}/replies), reply_delay_seconds after the comment. The
+// variants are used in turn so the replies don't all read the same. Replies
+// are queued only when the DM was queued, so a duplicate comment gets neither.
+//
+// tbl_comment_replies is both the queue and the log: one row per comment,
+// pending until sent or failed.
+
+// Reply states
+const (
+	replyPending    = "pending"     // waiting for run_at
+	replyInProgress = "in_progress" // being posted
+	replySent       = "sent"
+	replyFailed     = "failed"    // gave up
+	replySimulated  = "simulated" // account in dry_run, not posted
+)
+
+// Instagram rejects comments longer than this
+const maxCommentLength = 2200
+
+type CommentReply struct {
+	ID              int64     `json:"id"`
+	TriggerID       int       `json:"trigger_id,omitempty"`
+	CommentID       string    `json:"comment_id"`
+	PostID          string    `json:"post_id"`
+	UserID          string    `json:"user_id"`
+	Message         string    `json:"message"`
+	Status          string    `json:"status"`
+	Attempts        int       `json:"attempts"`
+	ErrorMessage    string    `json:"error_message,omitempty"`
+	PlatformReplyID string    `json:"platform_reply_id,omitempty"`
+	RunAt           time.Time `json:"run_at"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+
+	accountID string
+}
+
+// queueCommentReply picks the trigger's next reply variant and queues it for
+// the comment. The trigger's reply_cursor is advanced in the same statement,
+// so concurrent comments get different variants; a webhook redelivery of the
+// same comment is a no-op and doesn't advance it.
+func queueCommentReply(accountID string, t Trigger, c CommentData) {
+	messages := make([]string, len(t.ReplyVariants))
+	for i, variant := range t.ReplyVariants {
+		message, err := renderTemplate(DMTemplate{MessageText: variant}, TemplateData{
+			Username:    c.From.Username,
+			CommentText: c.Text,
+		})
+		if err != nil {
+			log.Printf("❌ Invalid reply variant on trigger %q: %v", t.Name, err)
+			return
+		}
+		messages[i] = message
+	}
+
+	res, err := db.Exec(`
+		WITH cursor AS (
+			UPDATE triggers
+			SET reply_cursor = reply_cursor + 1
+			WHERE id = $2 AND NOT EXISTS (SELECT 1 FROM tbl_comment_replies WHERE comment_id = $3)
+			RETURNING reply_cursor - 1 AS n
+		)
+		INSERT INTO tbl_comment_replies (
+			ig_account_id, trigger_id, comment_id, post_id, user_id, message, status, run_at
+		)
+		SELECT $1::integer, $2, $3, $4, $5, ($6::text[])[n % $9 + 1], $7, NOW() + make_interval(secs => $8)
+		FROM cursor
+		ON CONFLICT (comment_id) DO NOTHING
+	`, accountID, t.ID, c.ID, c.MediaID, c.From.ID, pq.Array(messages), replyPending, t.ReplyDelaySeconds, len(messages))
+	if err != nil {
+		log.Printf("❌ Failed to queue comment reply for @%s: %v", c.From.Username, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+
+	log.Printf("💬 Public reply queued for comment %s (in %ds)", c.ID, t.ReplyDelaySeconds)
+}
+
+// commentReplyScheduler posts replies as they fall due. Replies are few and
+// quick, so one loop is enough.
+func commentReplyScheduler() {
+	for {
+		reply, err := claimCommentReply()
+		if err != nil {
+			log.Println("❌ Comment reply claim error:", err)
+			time.Sleep(dmQueuePollInterval)
+			continue
+		}
+		if reply == nil {
+			time.Sleep(dmQueuePollInterval)
+			continue
+		}
+
+		sendCommentReply(*reply)
+	}
+}
+
+// claimCommentReply locks the oldest due reply, like claimDMJob.
+func claimCommentReply() (*CommentReply, error) {
+	var reply CommentReply
+	err := db.QueryRow(`
+		UPDATE tbl_comment_replies
+		SET status = $1, attempts = attempts + 1, updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM tbl_comment_replies
+			WHERE ((status = $2 AND run_at <= NOW())
+			   OR (status = $1 AND updated_at < NOW() - make_interval(secs => $3)))
+			  AND `+accountModeSQL("tbl_comment_replies", 4)+` <> $5
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, ig_account_id::text, comment_id, user_id, message, attempts
+	`, replyInProgress, replyPending, dmJobLockTimeout.Seconds(), config.SendMode, modePaused).Scan(
+		&reply.ID, &reply.accountID, &reply.CommentID, &reply.UserID, &reply.Message, &reply.Attempts,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &reply, nil
+}
+
+func sendCommentReply(reply CommentReply) {
+	creds, err := credentialsForJob(DMJob{AccountID: reply.accountID})
+	if err == nil && creds.DryRun {
+		log.Printf("🧪 [dry run] Would reply to comment %s: %s", reply.CommentID, reply.Message)
+		finishCommentReply(reply.ID, replySimulated, "", "")
+		return
+	}
+
+	var replyID string
+	if err == nil {
+		replyID, err = graphAPI(creds).ReplyToComment(reply.CommentID, reply.Message)
+	}
+
+	if err == nil {
+		log.Printf("✅ Public reply posted on comment %s", reply.CommentID)
+		finishCommentReply(reply.ID, replySent, "", replyID)
+		return
+	}
+
+	var ge *graph.Error
+	if errors.As(err, &ge) && ge.Kind == graph.ErrAuth {
+		markAccountNeedsReauth(creds.IGUserID, err)
+	}
+
+	if delay, ok := retryDelay(err, reply.Attempts); ok {
+		log.Printf("🔁 Public reply on comment %s failed, retrying in %v: %v", reply.CommentID, delay, err)
+		_, dbErr := db.Exec(`
+			UPDATE tbl_comment_replies
+			SET status = $2, error_message = $3, run_at = NOW() + make_interval(secs => $4), updated_at = NOW()
+			WHERE id = $1
+		`, reply.ID, replyPending, err.Error(), delay.Seconds())
+		if dbErr != nil {
+			log.Println("❌ Comment reply reschedule error:", dbErr)
+		}
+		return
+	}
+
+	log.Printf("❌ Public reply on comment %s failed: %v", reply.CommentID, err)
+	finishCommentReply(reply.ID, replyFailed, err.Error(), "")
+}
+
+func finishCommentReply(id int64, status, errMsg, replyID string) {
+	_, err := db.Exec(`
+		UPDATE tbl_comment_replies
+		SET status = $2, error_message = NULLIF($3, ''), platform_reply_id = NULLIF($4, ''), updated_at = NOW()
+		WHERE id = $1
+	`, id, status, errMsg, replyID)
+
+	if err != nil {
+		log.Println("❌ Comment reply update error:", err)
+	}
+}
+
+// List public comment replies, newest first
+// Filters: status, limit (default 50, max 500)
+func listCommentRepliesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	rows, err := db.Query(`
+		SELECT id, COALESCE(trigger_id, 0), comment_id, post_id, user_id, message, status, attempts,
+		       COALESCE(error_message, ''), COALESCE(platform_reply_id, ''), run_at, created_at, updated_at
+		FROM tbl_comment_replies
+		WHERE ig_account_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3
+	`, accountID, q.Get("status"), limit)
+	if err != nil {
+		log.Printf("Failed to list comment replies: %v", err)
+		http.Error(w, "Failed to list comment replies", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	replies := []CommentReply{}
+	for rows.Next() {
+		var c CommentReply
+		if err := rows.Scan(&c.ID, &c.TriggerID, &c.CommentID, &c.PostID, &c.UserID, &c.Message, &c.Status,
+			&c.Attempts, &c.ErrorMessage, &c.PlatformReplyID, &c.RunAt, &c.CreatedAt, &c.UpdatedAt); err != nil {
+			log.Printf("Failed to scan comment reply: %v", err)
+			http.Error(w, "Failed to list comment replies", http.StatusInternalServerError)
+			return
+		}
+		replies = append(replies, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"replies": replies,
+		"count":   len(replies),
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestQueueCommentReplyRotatesVariants(t *testing.T) {
+	setupTestDB(t)
+	if _, err := db.Exec("INSERT INTO tbl_ig_accounts (platform_ig_account_id, access_token) VALUES ('17841400000000001', 'tok')"); err != nil {
+		t.Fatal(err)
+	}
+
+	trigger := Trigger{
+		MatchMode:     MatchWholeWord,
+		Pattern:       "info",
+		IsActive:      true,
+		ReplyVariants: []string{"Sent you a DM, @{{username}}!", "Check your inbox 📬"},
+	}
+	id, err := createTrigger("1", trigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trigger.ID = id
+
+	comment := func(id string) CommentData {
+		return CommentData{ID: id, MediaID: "17900000000000001", Text: "info", From: User{ID: "42", Username: "jane"}}
+	}
+	queueCommentReply("1", trigger, comment("c1"))
+	queueCommentReply("1", trigger, comment("c2"))
+	queueCommentReply("1", trigger, comment("c2")) // webhook redelivery
+	queueCommentReply("1", trigger, comment("c3"))
+
+	rows, err := db.Query("SELECT message, status FROM tbl_comment_replies ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []string
+	for rows.Next() {
+		var message, status string
+		rows.Scan(&message, &status)
+		if status != replyPending {
+			t.Errorf("reply %q is %s, want %s", message, status, replyPending)
+		}
+		got = append(got, message)
+	}
+
+	want := []string{"Sent you a DM, @jane!", "Check your inbox 📬", "Sent you a DM, @jane!"}
+	if len(got) != len(want) {
+		t.Fatalf("queued %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("reply %d = %q, want %q", i+1, got[i], want[i])
+		}
+	}
+
+	var cursor int
+	db.QueryRow("SELECT reply_cursor FROM triggers WHERE id = $1", id).Scan(&cursor)
+	if cursor != 3 {
+		t.Errorf("reply_cursor = %d, want 3 (redeliveries don't advance it)", cursor)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+)
+
+// ============================================
+// COMMENTER & COMMENT STORAGE
+// ============================================
+
+// storeCommenter upserts a commenter into tbl_ig_users and returns its row ID.
+func storeCommenter(accountID string, u User) (int, error) {
+	var userRowID int
+	err := db.QueryRow(`
+		INSERT INTO tbl_ig_users (ig_account_id, platform_user_id, username)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (ig_account_id, platform_user_id) DO UPDATE SET
+			username = COALESCE(NULLIF(EXCLUDED.username, ''), tbl_ig_users.username),
+			last_seen_at = CURRENT_TIMESTAMP
+		RETURNING id
+	`, accountID, u.ID, u.Username).Scan(&userRowID)
+
+	return userRowID, err
+}
+
+// storeComment records every comment on an account's media, matched or not.
+func storeComment(accountID string, c CommentData) {
+	userRowID, err := storeCommenter(accountID, c.From)
+	if err != nil {
+		log.Printf("❌ Failed to store commenter @%s: %v", c.From.Username, err)
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO tbl_comments (ig_account_id, platform_comment_id, media_id, parent_id, ig_user_id, text)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6)
+		ON CONFLICT (platform_comment_id) DO NOTHING
+	`, accountID, c.ID, c.MediaID, c.ParentID, userRowID, c.Text)
+
+	if err != nil {
+		log.Printf("❌ Failed to store comment %s: %v", c.ID, err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+)
+
+// ============================================
+// DEAD-LETTER QUEUE API
+// ============================================
+
+type DeadJob struct {
+	ID        int64          `json:"id"`
+	UserID    string         `json:"user_id"`
+	Username  string         `json:"username"`
+	PostID    string         `json:"post_id"`
+	CommentID string         `json:"comment_id"`
+	Text      string         `json:"comment_text"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"last_error"`
+	CreatedAt time.Time      `json:"created_at"`
+	DiedAt    time.Time      `json:"died_at"`
+	History   []DMJobAttempt `json:"history"`
+}
+
+type DMJobAttempt struct {
+	Attempt     int       `json:"attempt"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// envAccountID stands in for :account_id to reach the env-configured account
+// (IG_BUSINESS_ID), whose jobs have no ig_account_id.
+const envAccountID = "env"
+
+// jobAccountArg is the query argument matching dm_jobs.ig_account_id with
+// "ig_account_id IS NOT DISTINCT FROM $n::integer".
+func jobAccountArg(accountID string) interface{} {
+	if accountID == envAccountID {
+		return nil
+	}
+	return accountID
+}
+
+type DeadJobsActionRequest struct {
+	JobIDs []int64 `json:"job_ids"`
+	All    bool    `json:"all"`
+}
+
+// DM job counts per state, including jobs parked waiting for the user
+func dmJobStatsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	counts, err := countAccountDMJobs(accountID)
+	if err != nil {
+		log.Printf("Failed to count DM jobs: %v", err)
+		http.Error(w, "Failed to count DM jobs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"counts":           counts,
+		"waiting_for_user": counts[jobWaitingForUser],
+	})
+}
+
+// List dead jobs
+// Filters: user_id, post_id, error (substring), since, until (RFC3339), limit, offset
+func listDeadJobsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	where := []string{"ig_account_id IS NOT DISTINCT FROM $1::integer", "status = $2"}
+	args := []interface{}{jobAccountArg(accountID), jobDead}
+
+	addFilter := func(clause string, value interface{}) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+
+	if v := q.Get("user_id"); v != "" {
+		addFilter("user_id = $%d", v)
+	}
+	if v := q.Get("post_id"); v != "" {
+		addFilter("post_id = $%d", v)
+	}
+	if v := q.Get("error"); v != "" {
+		addFilter("last_error ILIKE '%%' || $%d || '%%'", v)
+	}
+	for _, f := range []struct{ param, clause string }{
+		{"since", "updated_at >= $%d"},
+		{"until", "updated_at < $%d"},
+	} {
+		if v := q.Get(f.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid "+f.param+" (use RFC3339)", http.StatusBadRequest)
+				return
+			}
+			addFilter(f.clause, t)
+		}
+	}
+
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	jobs, err := listDeadJobs(strings.Join(where, " AND "), args, limit, offset)
+	if err != nil {
+		log.Printf("Failed to list dead jobs: %v", err)
+		http.Error(w, "Failed to list dead jobs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jobs":   jobs,
+		"count":  len(jobs),
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// Requeue dead jobs: {"job_ids": [1, 2]} or {"all": true}
+func requeueDeadJobsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	deadJobsAction(w, r, p, "requeued", requeueDeadJobs)
+}
+
+// Discard dead jobs: {"job_ids": [1, 2]} or {"all": true}
+func discardDeadJobsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	deadJobsAction(w, r, p, "discarded", discardDeadJobs)
+}
+
+func deadJobsAction(w http.ResponseWriter, r *http.Request, p httprouter.Params, verb string, action func(accountID string, jobIDs []int64, all bool) (int64, error)) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req DeadJobsActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.JobIDs) == 0 && !req.All {
+		http.Error(w, "job_ids or all is required", http.StatusBadRequest)
+		return
+	}
+
+	n, err := action(accountID, req.JobIDs, req.All)
+	if err != nil {
+		log.Printf("Failed to update dead jobs: %v", err)
+		http.Error(w, "Failed to update dead jobs", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("♻️ %d dead jobs %s for account %s", n, verb, accountID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		verb:      n,
+		"message": fmt.Sprintf("%d jobs %s", n, verb),
+	})
+}
+
+func listDeadJobs(where string, args []interface{}, limit, offset int) ([]DeadJob, error) {
+	query := fmt.Sprintf(`
+		SELECT id, user_id, COALESCE(username, ''), post_id, comment_id, COALESCE(comment_text, ''),
+		       attempts, COALESCE(last_error, ''), created_at, updated_at
+		FROM dm_jobs
+		WHERE %s
+		ORDER BY updated_at DESC
+		LIMIT %d OFFSET %d
+	`, where, limit, offset)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []DeadJob{}
+	byID := map[int64]int{}
+	var ids []int64
+	for rows.Next() {
+		var j DeadJob
+		if err := rows.Scan(&j.ID, &j.UserID, &j.Username, &j.PostID, &j.CommentID, &j.Text,
+			&j.Attempts, &j.LastError, &j.CreatedAt, &j.DiedAt); err != nil {
+			return nil, err
+		}
+		j.History = []DMJobAttempt{}
+		byID[j.ID] = len(jobs)
+		ids = append(ids, j.ID)
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return jobs, nil
+	}
+
+	history, err := db.Query(`
+		SELECT job_id, attempt, status, COALESCE(error_message, ''), attempted_at
+		FROM dm_job_attempts
+		WHERE job_id = ANY($1)
+		ORDER BY attempted_at
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer history.Close()
+
+	for history.Next() {
+		var jobID int64
+		var a DMJobAttempt
+		if err := history.Scan(&jobID, &a.Attempt, &a.Status, &a.Error, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		i := byID[jobID]
+		jobs[i].History = append(jobs[i].History, a)
+	}
+
+	return jobs, history.Err()
+}
+
+// requeueDeadJobs makes dead jobs due immediately with a fresh retry budget.
+// Attempts keep counting so the history stays numbered in order.
+func requeueDeadJobs(accountID string, jobIDs []int64, all bool) (int64, error) {
+	res, err := db.Exec(`
+		UPDATE dm_jobs
+		SET status = $3, retry_base = attempts, run_at = NOW(), locked_at = NULL, updated_at = NOW()
+		WHERE ig_account_id IS NOT DISTINCT FROM $1::integer AND status = $2 AND ($4 OR id = ANY($5))
+	`, jobAccountArg(accountID), jobDead, jobPending, all, pq.Array(jobIDs))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// discardDeadJobs deletes dead jobs along with their attempt history.
+func discardDeadJobs(accountID string, jobIDs []int64, all bool) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM dm_jobs
+		WHERE ig_account_id IS NOT DISTINCT FROM $1::integer AND status = $2 AND ($3 OR id = ANY($4))
+	`, jobAccountArg(accountID), jobDead, all, pq.Array(jobIDs))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ============================================
+// DURABLE DM JOB QUEUE (dm_jobs table)
+// ============================================
+
+// Job states
+const (
+	jobPending        = "pending"          // waiting for run_at
+	jobInProgress     = "in_progress"      // claimed by a worker
+	jobSent           = "sent"             // delivered
+	jobFailed         = "failed"           // last attempt failed, retried at run_at
+	jobDead           = "dead"             // gave up, needs a human
+	jobWaitingForUser = "waiting_for_user" // window closed; sent when the user writes in, dead at expires_at
+	jobSimulated      = "simulated"        // run in dry_run, nothing was sent
+)
+
+const (
+	dmQueuePollInterval = 1 * time.Second
+	// A job stuck in_progress this long belongs to a crashed worker
+	dmJobLockTimeout = 10 * time.Minute
+	// How often the scheduler expires parked jobs
+	parkedJobSweepInterval = 1 * time.Minute
+)
+
+// enqueueDMJob stores a job due delay after job.Timestamp. It returns false
+// if a job for the same user and post already exists, so webhook redeliveries
+// are no-ops.
+func enqueueDMJob(job DMJob, delay time.Duration) (bool, error) {
+	res, err := db.Exec(`
+		INSERT INTO dm_jobs (
+			ig_account_id, trigger_id, template_id, product_id, user_id, post_id,
+			comment_id, username, comment_text, status, run_at, created_at, flow_id
+		) VALUES (
+			NULLIF($1, '')::integer, NULLIF($2, 0), NULLIF($3, 0), NULLIF($4, 0), $5, $6,
+			$7, $8, $9, $10, $11::timestamptz + make_interval(secs => $12), $11::timestamptz, NULLIF($13, 0)
+		)
+		ON CONFLICT (user_id, post_id) DO NOTHING
+	`, job.AccountID, job.TriggerID, job.TemplateID, job.ProductID, job.UserID, job.PostID,
+		job.CommentID, job.Username, job.Text, jobPending, job.Timestamp, delay.Seconds(), job.FlowID)
+	if err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// claimDMJob locks the oldest due job and marks it in_progress. SKIP LOCKED
+// lets any number of workers, in any number of replicas, poll concurrently
+// without handing the same job out twice. Jobs of paused accounts are held.
+// Returns nil when nothing is due.
+func claimDMJob() (*DMJob, error) {
+	var job DMJob
+	err := db.QueryRow(`
+		UPDATE dm_jobs
+		SET status = $1, attempts = attempts + 1, locked_at = NOW(), updated_at = NOW()
+		WHERE id = (
+			SELECT id FROM dm_jobs
+			WHERE ((status IN ($2, $3) AND run_at <= NOW())
+			   OR (status = $1 AND locked_at < NOW() - make_interval(secs => $4)))
+			  AND `+accountModeSQL("dm_jobs", 5)+` <> $6
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, COALESCE(ig_account_id::text, ''), COALESCE(trigger_id, 0),
+		          COALESCE(template_id, 0), COALESCE(product_id, 0), COALESCE(flow_id, 0), user_id, post_id, comment_id,
+		          COALESCE(username, ''), COALESCE(comment_text, ''), attempts, retry_base, created_at,
+		          `+accountModeSQL("dm_jobs", 5)+` = $7
+	`, jobInProgress, jobPending, jobFailed, dmJobLockTimeout.Seconds(), config.SendMode, modePaused, modeDryRun).Scan(
+		&job.ID, &job.AccountID, &job.TriggerID, &job.TemplateID, &job.ProductID, &job.FlowID, &job.UserID, &job.PostID, &job.CommentID,
+		&job.Username, &job.Text, &job.Attempts, &job.RetryBase, &job.Timestamp, &job.DryRun,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// finishDMJob records the outcome of a claimed job.
+func finishDMJob(jobID int64, status, errMsg string) {
+	_, err := db.Exec(`
+		UPDATE dm_jobs
+		SET status = $2, last_error = $3, locked_at = NULL, updated_at = NOW()
+		WHERE id = $1
+	`, jobID, status, errMsg)
+
+	if err != nil {
+		log.Println("❌ DM job update error:", err)
+	}
+}
+
+// retryDMJob marks a claimed job failed and due again after delay.
+func retryDMJob(jobID int64, errMsg string, delay time.Duration) {
+	_, err := db.Exec(`
+		UPDATE dm_jobs
+		SET status = $2, last_error = $3, locked_at = NULL,
+		    run_at = NOW() + make_interval(secs => $4), updated_at = NOW()
+		WHERE id = $1
+	`, jobID, jobFailed, errMsg, delay.Seconds())
+
+	if err != nil {
+		log.Println("❌ DM job reschedule error:", err)
+	}
+}
+
+// recordDMJobAttempt appends to the job's attempt history.
+func recordDMJobAttempt(job DMJob, sendErr error) {
+	status, errMsg := jobSent, ""
+	if job.DryRun {
+		status = jobSimulated
+	}
+	if sendErr != nil {
+		status, errMsg = jobFailed, sendErr.Error()
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO dm_job_attempts (job_id, attempt, status, error_message)
+		VALUES ($1, $2, $3, $4)
+	`, job.ID, job.Attempts, status, errMsg)
+
+	if err != nil {
+		log.Println("❌ DM attempt log error:", err)
+	}
+}
+
+// parkDMJob moves a claimed job to waiting_for_user until the user messages
+// us (see releaseParkedDMJobs) or ttl passes.
+func parkDMJob(jobID int64, errMsg string, ttl time.Duration) {
+	_, err := db.Exec(`
+		UPDATE dm_jobs
+		SET status = $2, last_error = $3, locked_at = NULL,
+		    expires_at = NOW() + make_interval(secs => $4), updated_at = NOW()
+		WHERE id = $1
+	`, jobID, jobWaitingForUser, errMsg, ttl.Seconds())
+
+	if err != nil {
+		log.Println("❌ DM job park error:", err)
+	}
+}
+
+// releaseParkedDMJobs makes the account's parked jobs for userID due now,
+// with a fresh retry budget. accountID is "" for the env-configured account.
+func releaseParkedDMJobs(accountID, userID string) int64 {
+	res, err := db.Exec(`
+		UPDATE dm_jobs
+		SET status = $3, retry_base = attempts, run_at = NOW(), expires_at = NULL, updated_at = NOW()
+		WHERE status = $4 AND user_id = $2 AND expires_at > NOW()
+		  AND ig_account_id IS NOT DISTINCT FROM NULLIF($1, '')::integer
+	`, accountID, userID, jobPending, jobWaitingForUser)
+	if err != nil {
+		log.Println("❌ DM job release error:", err)
+		return 0
+	}
+
+	n, _ := res.RowsAffected()
+	return n
+}
+
+// expireParkedDMJobs kills parked jobs whose user never wrote in.
+func expireParkedDMJobs() {
+	rows, err := db.Query(`
+		UPDATE dm_jobs
+		SET status = $2, last_error = 'expired waiting for user to message', updated_at = NOW()
+		WHERE status = $1 AND expires_at <= NOW()
+		RETURNING id, user_id, post_id, comment_id, COALESCE(username, ''), attempts
+	`, jobWaitingForUser, jobDead)
+	if err != nil {
+		log.Println("❌ Parked DM job expiry error:", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var job DMJob
+		if err := rows.Scan(&job.ID, &job.UserID, &job.PostID, &job.CommentID, &job.Username, &job.Attempts); err != nil {
+			log.Println("❌ Parked DM job expiry error:", err)
+			return
+		}
+		log.Printf("⌛ DM to @%s expired waiting for the user to write in", job.Username)
+		logDM(job, "failed", "expired waiting for user to message")
+	}
+}
+
+// countDMJobs returns how many jobs are in the given state.
+func countDMJobs(status string) int {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM dm_jobs WHERE status = $1", status).Scan(&count)
+	return count
+}
+
+// countAccountDMJobs returns the account's job count per state.
+func countAccountDMJobs(accountID string) (map[string]int, error) {
+	rows, err := db.Query(
+		"SELECT status, COUNT(*) FROM dm_jobs WHERE ig_account_id IS NOT DISTINCT FROM $1::integer GROUP BY status",
+		jobAccountArg(accountID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{
+		jobPending: 0, jobInProgress: 0, jobSent: 0, jobFailed: 0, jobDead: 0, jobWaitingForUser: 0, jobSimulated: 0,
+	}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+
+	return counts, rows.Err()
+}
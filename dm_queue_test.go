@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"instagram-autodm/graph"
+	"instagram-autodm/graph/graphtest"
+)
+
+// The queue tests need a real Postgres. Point TEST_DATABASE_URL at a scratch
+// database: the schema is created on first use and every table is emptied
+// before each test.
+
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	if db == nil {
+		var err error
+		if db, err = sql.Open("postgres", dsn); err != nil {
+			t.Fatal("open:", err)
+		}
+		if err := db.Ping(); err != nil {
+			t.Fatal("ping:", err)
+		}
+		createTables()
+	}
+
+	rows, err := db.Query("SELECT tablename FROM pg_tables WHERE schemaname = 'public'")
+	if err != nil {
+		t.Fatal("list tables:", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tables = append(tables, pq.QuoteIdentifier(name))
+	}
+	rows.Close()
+
+	if _, err := db.Exec("TRUNCATE " + strings.Join(tables, ", ") + " RESTART IDENTITY CASCADE"); err != nil {
+		t.Fatal("truncate:", err)
+	}
+}
+
+// queueDeadJob stores a job for accountID and kills it after one attempt.
+func queueDeadJob(t *testing.T, accountID, userID string) int64 {
+	t.Helper()
+
+	queued, err := enqueueDMJob(DMJob{
+		AccountID: accountID,
+		UserID:    userID,
+		PostID:    "17900000000000001",
+		CommentID: "c_" + userID,
+		Username:  "user_" + userID,
+		Timestamp: time.Now(),
+	}, 0)
+	if err != nil || !queued {
+		t.Fatalf("enqueue: %v, queued=%v", err, queued)
+	}
+
+	job, err := claimDMJob()
+	if err != nil || job == nil {
+		t.Fatalf("claim: %v, job=%v", err, job)
+	}
+	recordDMJobAttempt(*job, errTestSend)
+	finishDMJob(job.ID, jobDead, errTestSend.Error())
+	return job.ID
+}
+
+var errTestSend = errors.New("send failed")
+
+func jobStatus(t *testing.T, jobID int64) (status string, attempts int) {
+	t.Helper()
+
+	err := db.QueryRow("SELECT status, attempts FROM dm_jobs WHERE id = $1", jobID).Scan(&status, &attempts)
+	if err == sql.ErrNoRows {
+		return "", 0
+	}
+	if err != nil {
+		t.Fatal("job status:", err)
+	}
+	return status, attempts
+}
+
+func TestRequeueDeadJobs(t *testing.T) {
+	setupTestDB(t)
+
+	mine := queueDeadJob(t, "1", "u1")
+	other := queueDeadJob(t, "2", "u2")
+	env := queueDeadJob(t, "", "u3")
+
+	n, err := requeueDeadJobs("1", nil, true)
+	if err != nil || n != 1 {
+		t.Fatalf("requeued %d jobs (%v), want 1", n, err)
+	}
+	if status, attempts := jobStatus(t, mine); status != jobPending || attempts != 1 {
+		t.Errorf("requeued job is %s after %d attempts, want %s after 1", status, attempts, jobPending)
+	}
+	if status, _ := jobStatus(t, other); status != jobDead {
+		t.Errorf("another account's job became %s", status)
+	}
+	if status, _ := jobStatus(t, env); status != jobDead {
+		t.Errorf("the env account's job became %s", status)
+	}
+
+	// The retry budget starts over from the requeue
+	job, err := claimDMJob()
+	if err != nil || job == nil || job.ID != mine {
+		t.Fatalf("claim after requeue: %+v, %v", job, err)
+	}
+	if job.Attempts != 2 || job.RetryBase != 1 {
+		t.Errorf("claimed attempt %d with retry base %d, want 2 and 1", job.Attempts, job.RetryBase)
+	}
+
+	// The env account's jobs are reached as "env"
+	n, err = requeueDeadJobs(envAccountID, nil, true)
+	if err != nil || n != 1 {
+		t.Fatalf("requeued %d env jobs (%v), want 1", n, err)
+	}
+	if status, _ := jobStatus(t, env); status != jobPending {
+		t.Errorf("requeued env job status = %s, want %s", status, jobPending)
+	}
+
+	jobs, err := listDeadJobs("ig_account_id = $1 AND status = $2", []interface{}{"2", jobDead}, 50, 0)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("listed %d dead jobs (%v), want 1", len(jobs), err)
+	}
+	if h := jobs[0].History; len(h) != 1 || h[0].Error != errTestSend.Error() {
+		t.Errorf("history = %+v, want the failed attempt", h)
+	}
+}
+
+func TestDiscardDeadJobs(t *testing.T) {
+	setupTestDB(t)
+
+	first := queueDeadJob(t, "1", "u1")
+	second := queueDeadJob(t, "1", "u2")
+
+	n, err := discardDeadJobs("1", []int64{first}, false)
+	if err != nil || n != 1 {
+		t.Fatalf("discarded %d jobs (%v), want 1", n, err)
+	}
+	if status, _ := jobStatus(t, first); status != "" {
+		t.Errorf("discarded job still %s", status)
+	}
+	if status, _ := jobStatus(t, second); status != jobDead {
+		t.Errorf("job not in the request became %s", status)
+	}
+}
+
+func TestRenderMessageForJob(t *testing.T) {
+	setupTestDB(t)
+	old := config
+	t.Cleanup(func() { config = old })
+	config.DMMessage = "Thanks!"
+
+	var productID, templateID int
+	err := db.QueryRow(`
+		INSERT INTO tbl_products (name, price, product_link) VALUES ('Preset Pack', 19, 'https://shop.example/p')
+		RETURNING id
+	`).Scan(&productID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow(`
+		INSERT INTO tbl_dm_templates (product_id, template_name, message_text, include_product_info)
+		VALUES ($1, 'default', 'Hi {{username}}, {{product.name}}: {{product.link}}', true)
+		RETURNING id
+	`, productID).Scan(&templateID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		job  DMJob
+		want string
+	}{
+		{"no template", DMJob{Username: "jane"}, "Thanks!"},
+		{"template with its product", DMJob{Username: "jane", TemplateID: templateID}, "Hi jane, Preset Pack: https://shop.example/p"},
+		{"missing template", DMJob{Username: "jane", TemplateID: templateID + 1}, "Thanks!"},
+	}
+
+	for _, tt := range tests {
+		if got := renderMessageForJob(tt.job); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// ============================================
+// SEND PATH AGAINST THE FAKE GRAPH API
+// ============================================
+
+const testIGBusinessID = "17841400000000001"
+
+// setupQueueTest points the app at a fresh graphtest server and configures
+// the env account, so comments can be run through the queue to the fake.
+func setupQueueTest(t *testing.T) *graphtest.Server {
+	t.Helper()
+	setupTestDB(t)
+
+	old := config
+	t.Cleanup(func() { config = old })
+	config = Config{
+		IGBusinessID:     testIGBusinessID,
+		AccessToken:      "env_token",
+		SendMode:         modeLive,
+		Keywords:         []string{"info"},
+		DMMessage:        "Here you go!",
+		ParkedDMTTL:      time.Hour,
+		MaxRetries:       3,
+		RetryBackoffBase: 2 * time.Second,
+	}
+
+	srv := graphtest.NewServer()
+	client := graph.New(graph.Config{BaseURL: srv.URL, DebugBaseURL: srv.URL})
+	prev := graphAPI
+	graphAPI = func(creds IGCredentials) graph.API {
+		return client.Account(creds.IGUserID, creds.AccessToken)
+	}
+	envToken.Lock()
+	envToken.token = "env_token"
+	envToken.Unlock()
+	atomic.StoreInt32(&envTokenAlerted, 0)
+	atomic.StoreInt32(&envTokenRefreshFailing, 0)
+
+	t.Cleanup(func() {
+		graphAPI = prev
+		srv.Close()
+	})
+	return srv
+}
+
+// runDueJob claims the next due job and sends it as a worker would.
+func runDueJob(t *testing.T) DMJob {
+	t.Helper()
+
+	job, err := claimDMJob()
+	if err != nil {
+		t.Fatal("claim:", err)
+	}
+	if job == nil {
+		t.Fatal("no job due")
+	}
+	processDMJob(*job)
+	return *job
+}
+
+func testComment(id, userID string) CommentData {
+	return CommentData{
+		ID:      id,
+		MediaID: "17900000000000001",
+		Text:    "Info please!",
+		From:    User{ID: userID, Username: "user_" + userID},
+	}
+}
+
+func dmLogStatus(userID, postID string) string {
+	var status string
+	db.QueryRow("SELECT status FROM dm_logs WHERE user_id = $1 AND post_id = $2", userID, postID).Scan(&status)
+	return status
+}
+
+func TestCommentIsSentAsPrivateReply(t *testing.T) {
+	srv := setupQueueTest(t)
+
+	c := testComment("c1", "u1")
+	processAccountComment("", c)
+	job := runDueJob(t)
+
+	if got, _ := jobStatus(t, job.ID); got != jobSent {
+		t.Errorf("job status = %s, want %s", got, jobSent)
+	}
+	if got := dmLogStatus("u1", c.MediaID); got != "sent" {
+		t.Errorf("dm_logs status = %q, want sent", got)
+	}
+
+	reqs := srv.RequestsTo(graphtest.Messages)
+	if len(reqs) != 1 {
+		t.Fatalf("got %d message requests, want 1", len(reqs))
+	}
+	var body struct {
+		Recipient Recipient       `json:"recipient"`
+		Message   OutboundMessage `json:"message"`
+	}
+	json.Unmarshal(reqs[0].Body, &body)
+	if body.Recipient.CommentID != "c1" || body.Message.Text != config.DMMessage {
+		t.Errorf("sent %s, want a Private Reply to c1 with %q", reqs[0].Body, config.DMMessage)
+	}
+	if reqs[0].Token != "env_token" {
+		t.Errorf("sent with token %q, want env_token", reqs[0].Token)
+	}
+
+	// The same user on the same post isn't messaged twice
+	processAccountComment("", testComment("c2", "u1"))
+	if job, _ := claimDMJob(); job != nil {
+		t.Errorf("duplicate comment queued job %d", job.ID)
+	}
+}
+
+func TestOwnCommentIsIgnored(t *testing.T) {
+	setupQueueTest(t)
+	accountID := insertTestAccount(t, modeLive)
+
+	processAccountComment("", testComment("c1", testIGBusinessID))
+	processAccountComment(accountID, testComment("c2", "17841400000000002"))
+	if job, _ := claimDMJob(); job != nil {
+		t.Errorf("our own comment queued job %d", job.ID)
+	}
+}
+
+func TestClosedWindowParksJob(t *testing.T) {
+	srv := setupQueueTest(t)
+	srv.On(graphtest.Messages, graphtest.WindowClosed()).Times(1)
+
+	processAccountComment("", testComment("c1", "u1"))
+	job := runDueJob(t)
+
+	if got, _ := jobStatus(t, job.ID); got != jobWaitingForUser {
+		t.Fatalf("job status = %s, want %s", got, jobWaitingForUser)
+	}
+	if got := dmLogStatus("u1", job.PostID); got != "" {
+		t.Errorf("parked job logged as %q", got)
+	}
+
+	// Writing in releases it
+	if n := releaseParkedDMJobs("", "u1"); n != 1 {
+		t.Fatalf("released %d jobs, want 1", n)
+	}
+	if got, _ := jobStatus(t, job.ID); got != jobPending {
+		t.Errorf("released job status = %s, want %s", got, jobPending)
+	}
+}
+
+func TestThrottledJobHonorsRetryAfter(t *testing.T) {
+	srv := setupQueueTest(t)
+	srv.On(graphtest.Messages, graphtest.Throttled(4, 2*time.Minute)).Times(1)
+
+	processAccountComment("", testComment("c1", "u1"))
+	job := runDueJob(t)
+
+	var status string
+	var wait float64
+	err := db.QueryRow(
+		"SELECT status, EXTRACT(EPOCH FROM run_at - NOW()) FROM dm_jobs WHERE id = $1",
+		job.ID,
+	).Scan(&status, &wait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != jobFailed {
+		t.Errorf("job status = %s, want %s", status, jobFailed)
+	}
+	if wait < 100 || wait > 120 {
+		t.Errorf("job due again in %.0fs, want the 120s Retry-After", wait)
+	}
+	if job, _ := claimDMJob(); job != nil {
+		t.Errorf("throttled job %d claimed again before Retry-After", job.ID)
+	}
+}
+
+func TestExpiredTokenNeedsReauth(t *testing.T) {
+	srv := setupQueueTest(t)
+	srv.On(graphtest.Messages, graphtest.TokenExpired())
+
+	var accountID string
+	err := db.QueryRow(`
+		INSERT INTO tbl_ig_accounts (platform_ig_account_id, username, access_token)
+		VALUES ('17841400000000002', 'creator', 'account_token')
+		RETURNING id
+	`).Scan(&accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processAccountComment(accountID, testComment("c1", "u1"))
+	job := runDueJob(t)
+
+	if got, _ := jobStatus(t, job.ID); got != jobDead {
+		t.Errorf("job status = %s, want %s", got, jobDead)
+	}
+	var status string
+	db.QueryRow("SELECT status FROM tbl_ig_accounts WHERE id = $1", accountID).Scan(&status)
+	if status != "needs_reauth" {
+		t.Errorf("account status = %q, want needs_reauth", status)
+	}
+	if reqs := srv.RequestsTo(graphtest.Messages); len(reqs) != 1 || reqs[0].Token != "account_token" {
+		t.Errorf("want one send with the account's token, got %+v", reqs)
+	}
+}
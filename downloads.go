@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ============================================
+// SIGNED DOWNLOAD LINKS
+// ============================================
+
+// A template with download_file delivers the file through a per-recipient
+// URL served by this app instead of the static download_link:
+//
+//	PUBLIC_BASE_URL/d/<grant_id>?expires=<unix>&sig=<hex HMAC-SHA256>
+//
+// The grant (tbl_download_grants) ties the link to the account, template,
+// post and recipient and counts downloads against DOWNLOAD_MAX_COUNT. Each
+// download is logged in tbl_download_logs.
+
+// downloadsEnabled reports whether signed links can be issued.
+func downloadsEnabled() bool {
+	return config.DownloadSecret != "" && config.PublicBaseURL != "" && fileStorage != nil
+}
+
+func signDownload(grantID int64, expires int64) string {
+	return hex.EncodeToString(hmacSHA256([]byte(config.DownloadSecret), []byte(fmt.Sprintf("%d:%d", grantID, expires))))
+}
+
+// signedDownloadURL issues (or reuses) the recipient's grant for the
+// template's file. An expired grant is renewed with a fresh download budget.
+func signedDownloadURL(t *DMTemplate, job DMJob) (string, error) {
+	if !downloadsEnabled() {
+		return "", fmt.Errorf("signed downloads need DOWNLOAD_SECRET and PUBLIC_BASE_URL")
+	}
+	key, err := accountFileKey(t.AccountID, t.DownloadFile)
+	if err != nil {
+		return "", err
+	}
+
+	var grantID int64
+	var expiresAt time.Time
+	err = db.QueryRow(`
+		INSERT INTO tbl_download_grants (
+			ig_account_id, template_id, post_id, user_id, file_key, max_downloads, expires_at
+		) VALUES (NULLIF($1, '')::integer, $2, $3, $4, $5, $6, NOW() + make_interval(secs => $7))
+		ON CONFLICT (user_id, post_id, file_key) DO UPDATE SET
+			download_count = CASE WHEN tbl_download_grants.expires_at < NOW() THEN 0
+			                      ELSE tbl_download_grants.download_count END,
+			expires_at = CASE WHEN tbl_download_grants.expires_at < NOW() THEN EXCLUDED.expires_at
+			                  ELSE tbl_download_grants.expires_at END
+		RETURNING id, expires_at
+	`, job.AccountID, t.ID, job.PostID, job.UserID, key, config.DownloadMaxCount,
+		config.DownloadTTL.Seconds()).Scan(&grantID, &expiresAt)
+	if err != nil {
+		return "", fmt.Errorf("database error: %v", err)
+	}
+
+	expires := expiresAt.Unix()
+	return fmt.Sprintf("%s/d/%d?expires=%d&sig=%s", config.PublicBaseURL, grantID, expires, signDownload(grantID, expires)), nil
+}
+
+// Signed download
+func downloadHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	grantID, err := strconv.ParseInt(p.ByName("grant_id"), 10, 64)
+	expires, err2 := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	sig, err3 := hex.DecodeString(r.URL.Query().Get("sig"))
+	if err != nil || err2 != nil || err3 != nil || config.DownloadSecret == "" {
+		http.Error(w, "Invalid download link", http.StatusForbidden)
+		return
+	}
+
+	want, _ := hex.DecodeString(signDownload(grantID, expires))
+	if !hmac.Equal(sig, want) {
+		http.Error(w, "Invalid download link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "Download link expired", http.StatusGone)
+		return
+	}
+
+	// Link previews would use up the recipient's downloads
+	if isLinkPreview(r.UserAgent()) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var key string
+	err = db.QueryRow("SELECT file_key FROM tbl_download_grants WHERE id = $1", grantID).Scan(&key)
+	if err != nil {
+		http.Error(w, "Invalid download link", http.StatusForbidden)
+		return
+	}
+
+	// A file that can't be served mustn't use up a download
+	if ok, err := fileStorage.Exists(key); err != nil || !ok {
+		log.Printf("❌ Download of %s unavailable (grant %d): %v", key, grantID, err)
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+
+	var userID string
+	err = db.QueryRow(`
+		UPDATE tbl_download_grants
+		SET download_count = download_count + 1
+		WHERE id = $1 AND download_count < max_downloads
+		RETURNING user_id
+	`, grantID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Download limit reached", http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update download grant %d: %v", grantID, err)
+		http.Error(w, "Failed to start download", http.StatusInternalServerError)
+		return
+	}
+
+	if err := fileStorage.Serve(w, r, key); err != nil {
+		log.Printf("❌ Failed to serve %s: %v", key, err)
+		releaseDownload(grantID)
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
+
+	logDownload(grantID, r.UserAgent())
+	log.Printf("⬇️ Download of %s by user %s (grant %d)", key, userID, grantID)
+}
+
+// releaseDownload gives back a download counted for a file that then
+// couldn't be served.
+func releaseDownload(grantID int64) {
+	_, err := db.Exec(`
+		UPDATE tbl_download_grants
+		SET download_count = download_count - 1
+		WHERE id = $1 AND download_count > 0
+	`, grantID)
+
+	if err != nil {
+		log.Println("❌ Download grant release error:", err)
+	}
+}
+
+func logDownload(grantID int64, userAgent string) {
+	_, err := db.Exec(`
+		INSERT INTO tbl_download_logs (grant_id, ig_account_id, template_id, post_id, user_id, file_key, user_agent)
+		SELECT id, ig_account_id, template_id, post_id, user_id, file_key, $2
+		FROM tbl_download_grants
+		WHERE id = $1
+	`, grantID, userAgent)
+
+	if err != nil {
+		log.Println("❌ Download log error:", err)
+	}
+}
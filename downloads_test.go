@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Requests that are turned away before the grant is looked up
+func TestDownloadHandlerChecksLink(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config.DownloadSecret = "d0wnl0ad"
+
+	router := httprouter.New()
+	router.GET("/d/:grant_id", downloadHandler)
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name      string
+		url       string
+		userAgent string
+		want      int
+	}{
+		{"no signature", fmt.Sprintf("/d/1?expires=%d", future), "", http.StatusForbidden},
+		{"wrong signature", fmt.Sprintf("/d/1?expires=%d&sig=%s", future, signDownload(2, future)), "", http.StatusForbidden},
+		{"expiry changed", fmt.Sprintf("/d/1?expires=%d&sig=%s", future+1, signDownload(1, future)), "", http.StatusForbidden},
+		{"bad grant id", fmt.Sprintf("/d/x?expires=%d&sig=%s", future, signDownload(1, future)), "", http.StatusForbidden},
+		{"expired", fmt.Sprintf("/d/1?expires=%d&sig=%s", past, signDownload(1, past)), "", http.StatusGone},
+		{"link preview", fmt.Sprintf("/d/1?expires=%d&sig=%s", future, signDownload(1, future)), "facebookexternalhit/1.1", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.Header.Set("User-Agent", tt.userAgent)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestDownloadCountsServedFilesOnly(t *testing.T) {
+	setupTestDB(t)
+	old, oldStorage := config, fileStorage
+	t.Cleanup(func() { config, fileStorage = old, oldStorage })
+	config.DownloadSecret = "d0wnl0ad"
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "7"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "7", "guide.pdf"), []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileStorage = localStorage{dir: dir}
+
+	router := httprouter.New()
+	router.GET("/d/:grant_id", downloadHandler)
+	expires := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		key   string
+		want  int
+		count int
+	}{
+		{"7/guide.pdf", http.StatusOK, 1},
+		{"7/removed.pdf", http.StatusNotFound, 0},
+	}
+
+	for _, tt := range tests {
+		var grantID int64
+		err := db.QueryRow(`
+			INSERT INTO tbl_download_grants (post_id, user_id, file_key, max_downloads, expires_at)
+			VALUES ('17900000000000001', '42', $1, 3, NOW() + INTERVAL '1 hour')
+			RETURNING id
+		`, tt.key).Scan(&grantID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("/d/%d?expires=%d&sig=%s", grantID, expires, signDownload(grantID, expires)), nil))
+
+		var count int
+		db.QueryRow("SELECT download_count FROM tbl_download_grants WHERE id = $1", grantID).Scan(&count)
+		if rec.Code != tt.want || count != tt.count {
+			t.Errorf("%s: got %d with %d download(s) counted, want %d with %d", tt.key, rec.Code, count, tt.want, tt.count)
+		}
+	}
+}
@@ -0,0 +1,942 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+
+	"instagram-autodm/graph"
+)
+
+// ============================================
+// MULTI-STEP DM FLOWS
+// ============================================
+
+// A flow is a graph of nodes stored as JSON per account. A trigger with a
+// flow_id starts the flow instead of sending a single template, and each user
+// gets one session (tbl_flow_sessions) remembering the node they are on:
+//
+//	{"start": "ask", "nodes": {
+//	  "ask":  {"type": "quick_replies", "text": "Want the PDF, {{username}}?",
+//	           "options": [{"title": "Yes", "next": "pdf"}, {"title": "No", "next": "bye"}]},
+//	  "pdf":  {"type": "text", "text": "Here you go: https://example.com/guide.pdf", "next": "wait"},
+//	  "wait": {"type": "wait", "duration": "2h", "next": "ask_more"},
+//	  "ask_more": {"type": "branch", "text": "Did it help?",
+//	               "branches": [{"match_mode": "whole_word", "pattern": "yes", "next": "thanks"}],
+//	               "next": "sorry"},
+//	  ...}}
+//
+// quick_replies, buttons and branch nodes wait for the user's answer; their
+// "next" is where answers that match nothing go (no "next": keep waiting).
+
+// Node types
+const (
+	FlowNodeText         = "text"          // send text, continue with next
+	FlowNodeQuickReplies = "quick_replies" // send text with quick replies, route on the chosen one
+	FlowNodeButtons      = "buttons"       // send a button template, route on the postback
+	FlowNodeWait         = "wait"          // pause for duration, then continue with next
+	FlowNodeBranch       = "branch"        // optionally ask text, route the typed answer by pattern
+	FlowNodeLeadCapture  = "lead_capture"  // ask for an email / phone, store it as a lead (see leads.go)
+)
+
+// Session states
+const (
+	flowActive       = "active"        // being advanced right now
+	flowWaitingReply = "waiting_reply" // sent a question, waiting for the user
+	flowWaitingTimer = "waiting_timer" // in a wait node until resume_at
+	// The next node goes to the user by ID but their 24-hour window is
+	// closed; it is sent when they write in
+	flowWaitingWindow = "waiting_window"
+	flowCompleted     = "completed"
+	flowFailed        = "failed"
+	flowExpired       = "expired" // the user never answered
+)
+
+const (
+	flowResumePollInterval = 5 * time.Second
+	// Sessions waiting for an answer longer than this are expired
+	flowSessionTTL = 7 * 24 * time.Hour
+	// Nodes sent in one go without waiting, to stop next-loops
+	maxFlowSteps = 25
+
+	maxQuickReplies     = 13
+	maxFlowButtons      = 3
+	maxButtonTitleRunes = 20
+)
+
+type Flow struct {
+	ID         int            `json:"id"`
+	AccountID  int            `json:"account_id"`
+	Name       string         `json:"name"`
+	Definition FlowDefinition `json:"definition"`
+	IsActive   bool           `json:"is_active"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+type FlowDefinition struct {
+	Start string              `json:"start"`
+	Nodes map[string]FlowNode `json:"nodes"`
+}
+
+type FlowNode struct {
+	Type     string       `json:"type"`
+	Text     string       `json:"text,omitempty"`
+	Next     string       `json:"next,omitempty"`
+	Options  []FlowOption `json:"options,omitempty"`  // quick_replies
+	Buttons  []FlowButton `json:"buttons,omitempty"`  // buttons
+	Duration string       `json:"duration,omitempty"` // wait, Go duration ("30m", "2h")
+	Branches []FlowBranch `json:"branches,omitempty"` // branch
+
+	// lead_capture
+	Capture     string `json:"capture,omitempty"`      // "email", "phone" or "email_or_phone"
+	ConfirmText string `json:"confirm_text,omitempty"` // sent once a valid answer is stored
+	InvalidText string `json:"invalid_text,omitempty"` // sent when the answer doesn't validate
+}
+
+type FlowOption struct {
+	Title   string `json:"title"`
+	Payload string `json:"payload,omitempty"` // defaults to title
+	Next    string `json:"next,omitempty"`
+}
+
+type FlowButton struct {
+	Type    string `json:"type"` // "postback" or "web_url"
+	Title   string `json:"title"`
+	Payload string `json:"payload,omitempty"` // postback, defaults to title
+	URL     string `json:"url,omitempty"`     // web_url
+	Next    string `json:"next,omitempty"`    // postback
+}
+
+// FlowBranch routes a typed answer; matching works like a trigger's.
+type FlowBranch struct {
+	MatchMode string `json:"match_mode"`
+	Pattern   string `json:"pattern"`
+	Next      string `json:"next,omitempty"`
+}
+
+type FlowRequest struct {
+	Name       string         `json:"name"`
+	Definition FlowDefinition `json:"definition"`
+	IsActive   *bool          `json:"is_active"`
+}
+
+// One user's position in a flow (one row of tbl_flow_sessions)
+type FlowSession struct {
+	AccountID   string
+	FlowID      int
+	UserID      string
+	Username    string
+	CommentText string
+	PostID      string // media the triggering comment was on
+	TemplateID  int    // DM template resolved for that comment, 0 if none
+	NodeID      string
+	Status      string
+	ResumeAt    time.Time
+}
+
+func (o FlowOption) payload() string {
+	if o.Payload != "" {
+		return o.Payload
+	}
+	return o.Title
+}
+
+func (b FlowButton) payload() string {
+	if b.Payload != "" {
+		return b.Payload
+	}
+	return b.Title
+}
+
+func (b FlowBranch) trigger() Trigger {
+	t := Trigger{MatchMode: b.MatchMode, Pattern: b.Pattern, IgnoreDiacritics: true}
+	if t.MatchMode == "" {
+		t.MatchMode = MatchWholeWord
+	}
+	return t
+}
+
+// waitsForAnswer reports whether the flow pauses after sending this node
+// until the user replies.
+func (n FlowNode) waitsForAnswer() bool {
+	switch n.Type {
+	case FlowNodeQuickReplies, FlowNodeButtons, FlowNodeBranch, FlowNodeLeadCapture:
+		return true
+	}
+	return false
+}
+
+// validate checks a definition before it is saved.
+func (d FlowDefinition) validate() error {
+	if len(d.Nodes) == 0 {
+		return fmt.Errorf("flow has no nodes")
+	}
+	start, ok := d.Nodes[d.Start]
+	if !ok {
+		return fmt.Errorf("start node %q not found", d.Start)
+	}
+	// The first message answers the comment; a flow can't open by waiting
+	if start.Type == FlowNodeWait {
+		return fmt.Errorf("start node %q can't be a wait", d.Start)
+	}
+
+	ids := make([]string, 0, len(d.Nodes))
+	for id := range d.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := d.validateNode(d.Nodes[id]); err != nil {
+			return fmt.Errorf("node %q: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (d FlowDefinition) validateNode(n FlowNode) error {
+	next := []string{n.Next}
+
+	switch n.Type {
+	case FlowNodeText:
+		if strings.TrimSpace(n.Text) == "" {
+			return fmt.Errorf("text is required")
+		}
+	case FlowNodeQuickReplies:
+		if strings.TrimSpace(n.Text) == "" {
+			return fmt.Errorf("text is required")
+		}
+		if len(n.Options) == 0 || len(n.Options) > maxQuickReplies {
+			return fmt.Errorf("quick_replies needs 1 to %d options", maxQuickReplies)
+		}
+		for _, o := range n.Options {
+			if err := validateButtonTitle(o.Title); err != nil {
+				return err
+			}
+			next = append(next, o.Next)
+		}
+	case FlowNodeButtons:
+		if strings.TrimSpace(n.Text) == "" {
+			return fmt.Errorf("text is required")
+		}
+		if len(n.Buttons) == 0 || len(n.Buttons) > maxFlowButtons {
+			return fmt.Errorf("buttons needs 1 to %d buttons", maxFlowButtons)
+		}
+		for _, b := range n.Buttons {
+			if err := validateButtonTitle(b.Title); err != nil {
+				return err
+			}
+			switch b.Type {
+			case "postback":
+				next = append(next, b.Next)
+			case "web_url":
+				if b.URL == "" {
+					return fmt.Errorf("web_url button %q needs a url", b.Title)
+				}
+			default:
+				return fmt.Errorf("unknown button type %q", b.Type)
+			}
+		}
+	case FlowNodeWait:
+		dur, err := time.ParseDuration(n.Duration)
+		if err != nil || dur <= 0 {
+			return fmt.Errorf("invalid duration %q", n.Duration)
+		}
+	case FlowNodeBranch:
+		if len(n.Branches) == 0 {
+			return fmt.Errorf("branch needs at least one branch")
+		}
+		for _, b := range n.Branches {
+			if err := b.trigger().validate(); err != nil {
+				return err
+			}
+			next = append(next, b.Next)
+		}
+	case FlowNodeLeadCapture:
+		if strings.TrimSpace(n.Text) == "" {
+			return fmt.Errorf("text is required")
+		}
+		switch n.Capture {
+		case "", LeadEmail, LeadPhone, LeadEmailOrPhone:
+		default:
+			return fmt.Errorf("unknown capture %q", n.Capture)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", n.Type)
+	}
+
+	for _, text := range []string{n.Text, n.ConfirmText, n.InvalidText} {
+		if err := validateTemplateText(text); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range next {
+		if _, ok := d.Nodes[id]; id != "" && !ok {
+			return fmt.Errorf("next node %q not found", id)
+		}
+	}
+
+	return nil
+}
+
+func validateButtonTitle(title string) error {
+	if strings.TrimSpace(title) == "" {
+		return fmt.Errorf("button title is required")
+	}
+	if utf8.RuneCountInString(title) > maxButtonTitleRunes {
+		return fmt.Errorf("button title %q is longer than %d characters", title, maxButtonTitleRunes)
+	}
+	return nil
+}
+
+// message builds what is sent for the node.
+func (n FlowNode) message(s *FlowSession) OutboundMessage {
+	text := s.render(n.Text)
+
+	switch n.Type {
+	case FlowNodeQuickReplies:
+		msg := OutboundMessage{Text: text}
+		for _, o := range n.Options {
+			msg.QuickReplies = append(msg.QuickReplies, QuickReply{
+				ContentType: "text",
+				Title:       o.Title,
+				Payload:     o.payload(),
+			})
+		}
+		return msg
+	case FlowNodeButtons:
+		payload := TemplatePayload{TemplateType: "button", Text: text}
+		for _, b := range n.Buttons {
+			button := Button{Type: b.Type, Title: b.Title, URL: b.URL}
+			if b.Type == "postback" {
+				button.Payload = b.payload()
+			}
+			payload.Buttons = append(payload.Buttons, button)
+		}
+		return OutboundMessage{Attachment: &Attachment{Type: "template", Payload: payload}}
+	}
+
+	return OutboundMessage{Text: text}
+}
+
+// render fills in {{username}} and {{comment.text}} from the comment that
+// started the flow.
+func (s *FlowSession) render(text string) string {
+	out, err := renderTemplate(DMTemplate{MessageText: text}, TemplateData{
+		Username:    s.Username,
+		CommentText: s.CommentText,
+	})
+	if err != nil {
+		return text
+	}
+	return out
+}
+
+// route picks the node to go to for the user's answer. ok is false when the
+// answer matches nothing and the node has no fallback.
+func (n FlowNode) route(text, payload string) (next string, ok bool) {
+	switch n.Type {
+	case FlowNodeQuickReplies:
+		for _, o := range n.Options {
+			if payload == o.payload() || (payload == "" && strings.EqualFold(strings.TrimSpace(text), o.Title)) {
+				return o.Next, true
+			}
+		}
+	case FlowNodeButtons:
+		for _, b := range n.Buttons {
+			if b.Type == "postback" && payload == b.payload() {
+				return b.Next, true
+			}
+		}
+	case FlowNodeBranch:
+		for _, b := range n.Branches {
+			if b.trigger().Matches(text) {
+				return b.Next, true
+			}
+		}
+	}
+
+	return n.Next, n.Next != ""
+}
+
+// ============================================
+// FLOW RUNNER
+// ============================================
+
+// runFlow sends nodes from s.NodeID on until the flow has to wait for the
+// user or a timer, or ends. The first message goes to first (a Private Reply
+// when the flow starts from a comment), the rest to the user by ID, which
+// needs their messaging window open; while it is closed the session waits
+// for them to write in. sent reports whether anything was delivered.
+func runFlow(s *FlowSession, def FlowDefinition, creds IGCredentials, first Recipient) (sent bool, err error) {
+	recipient := first
+	for step := 0; step < maxFlowSteps; step++ {
+		node, ok := def.Nodes[s.NodeID]
+		if !ok {
+			s.Status = flowCompleted
+			return sent, nil
+		}
+
+		if node.Type == FlowNodeWait {
+			d, _ := time.ParseDuration(node.Duration)
+			s.Status, s.NodeID, s.ResumeAt = flowWaitingTimer, node.Next, time.Now().Add(d)
+			return sent, nil
+		}
+
+		if recipient.CommentID == "" && !messagingWindowOpen(creds.IGUserID, s.UserID) {
+			s.Status = flowWaitingWindow
+			return sent, nil
+		}
+
+		msg := node.message(s)
+		trackMessageLinks(&msg, LinkContext{AccountID: s.AccountID, TemplateID: s.TemplateID, PostID: s.PostID, UserID: s.UserID})
+		if err := deliverMessage(creds, recipient, s.UserID, msg); err != nil {
+			var ge *graph.Error
+			if recipient.CommentID == "" && errors.As(err, &ge) && ge.Kind == graph.ErrMessagingWindow {
+				s.Status = flowWaitingWindow
+				return sent, nil
+			}
+			return sent, err
+		}
+		sent = true
+		recipient = Recipient{ID: s.UserID}
+
+		if node.waitsForAnswer() {
+			s.Status = flowWaitingReply
+			return sent, nil
+		}
+		s.NodeID = node.Next
+	}
+
+	return sent, fmt.Errorf("more than %d nodes without waiting, check for a loop", maxFlowSteps)
+}
+
+// Returned for a job whose flow sent nothing, so it isn't finished as sent;
+// retrying would only run the same flow again
+var errFlowSentNothing = errors.New("flow sent nothing from its start node")
+
+// startFlow runs a job's flow from its start node and reports whether
+// anything was sent. An error is only returned if nothing was sent, so the
+// job's retry starts the flow over cleanly.
+func startFlow(job DMJob, creds IGCredentials, recipient Recipient) (sent bool, err error) {
+	flow, err := getFlow(job.AccountID, strconv.Itoa(job.FlowID))
+	if err != nil {
+		return false, fmt.Errorf("flow %d not found: %v", job.FlowID, err)
+	}
+	if !flow.IsActive {
+		log.Printf("⚠️ Flow %q is inactive, sending the template instead", flow.Name)
+		err := sendTemplatedJob(job, creds, recipient)
+		return err == nil, err
+	}
+
+	log.Printf("🧭 Starting flow %q for @%s", flow.Name, job.Username)
+	s := &FlowSession{
+		AccountID:   job.AccountID,
+		FlowID:      flow.ID,
+		UserID:      job.UserID,
+		Username:    job.Username,
+		CommentText: job.Text,
+		PostID:      job.PostID,
+		TemplateID:  job.TemplateID,
+		NodeID:      flow.Definition.Start,
+		Status:      flowActive,
+	}
+
+	sent, err = runFlow(s, flow.Definition, creds, recipient)
+	if err != nil && !sent {
+		return false, err
+	}
+
+	// Saved before validation rejected it (a wait or missing start node):
+	// there is no Private Reply to build the rest of the flow on
+	if !sent {
+		log.Printf("⚠️ Flow %q sent nothing from its start node %q", flow.Name, flow.Definition.Start)
+		s.Status = flowFailed
+	}
+
+	finishFlowStep(s, err)
+	return sent, nil
+}
+
+// handleFlowReply routes a user's message or postback through the flow
+// waiting on them, if any.
+func handleFlowReply(accountID, userID, text, payload string) {
+	// The session keeps waiting; the user can answer once the account is back
+	if accountMode(accountID) == modePaused {
+		log.Printf("⏸️ Account %s is paused, flow answer from %s not handled", accountID, userID)
+		return
+	}
+
+	s, err := claimFlowSession(accountID, userID, flowWaitingReply)
+	if err != nil {
+		log.Println("❌ Flow session claim error:", err)
+		return
+	}
+	if s == nil {
+		return
+	}
+
+	flow, err := getFlow(accountID, strconv.Itoa(s.FlowID))
+	if err != nil {
+		log.Printf("❌ Flow %d not found for user %s: %v", s.FlowID, userID, err)
+		s.Status = flowFailed
+		saveFlowSession(s)
+		return
+	}
+
+	// A node removed by an edit ends the flow
+	node, exists := flow.Definition.Nodes[s.NodeID]
+	if exists && node.Type == FlowNodeLeadCapture {
+		handleLeadReply(s, node, flow.Definition, text)
+		return
+	}
+
+	next, ok := node.route(text, payload)
+	if exists && !ok {
+		log.Printf("🧭 Answer %q from %s doesn't match node %q, still waiting", text, userID, s.NodeID)
+		s.Status = flowWaitingReply
+		saveFlowSession(s)
+		return
+	}
+	s.NodeID = next
+
+	continueFlow(s, flow.Definition)
+}
+
+// resumeWindowFlow continues the user's flow if it was held for a closed
+// messaging window, which their message has just opened. Their message isn't
+// an answer to a node they haven't seen, so it reports whether it resumed one.
+func resumeWindowFlow(accountID, userID string) bool {
+	if accountMode(accountID) == modePaused {
+		return false
+	}
+
+	s, err := claimFlowSession(accountID, userID, flowWaitingWindow)
+	if err != nil {
+		log.Println("❌ Flow session claim error:", err)
+		return false
+	}
+	if s == nil {
+		return false
+	}
+
+	flow, err := getFlow(accountID, strconv.Itoa(s.FlowID))
+	if err != nil {
+		log.Printf("❌ Flow %d not found for user %s: %v", s.FlowID, userID, err)
+		s.Status = flowFailed
+		saveFlowSession(s)
+		return true
+	}
+
+	log.Printf("▶️ Resuming flow %d for user %s now their window is open", s.FlowID, userID)
+	continueFlow(s, flow.Definition)
+	return true
+}
+
+// resumeDueFlows continues sessions whose wait node has elapsed.
+func resumeDueFlows() {
+	sessions, err := claimDueFlowSessions()
+	if err != nil {
+		log.Println("❌ Flow resume error:", err)
+		return
+	}
+
+	for _, s := range sessions {
+		flow, err := getFlow(s.AccountID, strconv.Itoa(s.FlowID))
+		if err != nil {
+			log.Printf("❌ Flow %d not found for user %s: %v", s.FlowID, s.UserID, err)
+			s.Status = flowFailed
+			saveFlowSession(s)
+			continue
+		}
+
+		go continueFlow(s, flow.Definition)
+	}
+}
+
+// continueFlow runs s from its current node, messaging the user by ID.
+func continueFlow(s *FlowSession, def FlowDefinition) {
+	creds, logSimulated, err := flowCredentials(s)
+	if err == nil {
+		_, err = runFlow(s, def, creds, Recipient{ID: s.UserID})
+		logSimulated()
+	}
+	finishFlowStep(s, err)
+}
+
+// flowCredentials are the credentials for messaging a session's user. In
+// dry_run they collect the messages instead, and logSimulated records them
+// with the DM that started the flow; call it once done sending.
+func flowCredentials(s *FlowSession) (creds IGCredentials, logSimulated func(), err error) {
+	creds, err = credentialsForJob(DMJob{AccountID: s.AccountID})
+	if err != nil || !creds.DryRun {
+		return creds, func() {}, err
+	}
+
+	var simulated []OutboundMessage
+	creds.simulated = &simulated
+	return creds, func() { logSimulatedFollowUp(s, simulated) }, nil
+}
+
+func finishFlowStep(s *FlowSession, err error) {
+	if err != nil {
+		log.Printf("❌ Flow %d for user %s stopped at node %q: %v", s.FlowID, s.UserID, s.NodeID, err)
+		s.Status = flowFailed
+	}
+	if s.Status == flowCompleted {
+		log.Printf("🏁 Flow %d completed for user %s", s.FlowID, s.UserID)
+	}
+
+	saveFlowSession(s)
+}
+
+// ============================================
+// FLOW CRUD ENDPOINTS
+// ============================================
+
+func listFlowsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flows, err := listFlows(accountID)
+	if err != nil {
+		log.Printf("Failed to list flows: %v", err)
+		http.Error(w, "Failed to list flows", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"flows": flows,
+	})
+}
+
+func getFlowHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f, err := getFlow(p.ByName("account_id"), p.ByName("flow_id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Flow not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get flow", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+func createFlowHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f, ok := decodeFlowRequest(w, r)
+	if !ok {
+		return
+	}
+
+	flowID, err := createFlow(accountID, f)
+	if err != nil {
+		log.Printf("Failed to create flow: %v", err)
+		http.Error(w, "Failed to create flow", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"flow_id": flowID,
+		"message": "Flow created successfully",
+	})
+}
+
+func updateFlowHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f, ok := decodeFlowRequest(w, r)
+	if !ok {
+		return
+	}
+
+	found, err := updateFlow(p.ByName("account_id"), p.ByName("flow_id"), f)
+	if err != nil {
+		log.Printf("Failed to update flow: %v", err)
+		http.Error(w, "Failed to update flow", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Flow not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Flow updated successfully",
+	})
+}
+
+func deleteFlowHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	res, err := db.Exec(
+		"DELETE FROM tbl_dm_flows WHERE id = $1 AND ig_account_id = $2",
+		p.ByName("flow_id"), p.ByName("account_id"),
+	)
+	if err != nil {
+		http.Error(w, "Failed to delete flow", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Flow not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Flow deleted successfully",
+	})
+}
+
+// decodeFlowRequest parses and validates the body, writing the error
+// response itself when it returns false.
+func decodeFlowRequest(w http.ResponseWriter, r *http.Request) (Flow, bool) {
+	var req FlowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return Flow{}, false
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return Flow{}, false
+	}
+	if err := req.Definition.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Flow{}, false
+	}
+
+	return Flow{
+		Name:       req.Name,
+		Definition: req.Definition,
+		IsActive:   req.IsActive == nil || *req.IsActive,
+	}, true
+}
+
+// ============================================
+// FLOW DATABASE OPERATIONS
+// ============================================
+
+const flowColumns = `id, ig_account_id, name, definition, is_active, created_at, updated_at`
+
+func scanFlow(row interface{ Scan(...interface{}) error }) (Flow, error) {
+	var f Flow
+	var def []byte
+	if err := row.Scan(&f.ID, &f.AccountID, &f.Name, &def, &f.IsActive, &f.CreatedAt, &f.UpdatedAt); err != nil {
+		return f, err
+	}
+
+	err := json.Unmarshal(def, &f.Definition)
+	return f, err
+}
+
+func listFlows(accountID string) ([]Flow, error) {
+	rows, err := db.Query(`
+		SELECT `+flowColumns+`
+		FROM tbl_dm_flows
+		WHERE ig_account_id = $1
+		ORDER BY id
+	`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flows := []Flow{}
+	for rows.Next() {
+		f, err := scanFlow(rows)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, f)
+	}
+
+	return flows, rows.Err()
+}
+
+func getFlow(accountID, flowID string) (Flow, error) {
+	return scanFlow(db.QueryRow(`
+		SELECT `+flowColumns+`
+		FROM tbl_dm_flows
+		WHERE id = $1 AND ig_account_id = $2
+	`, flowID, accountID))
+}
+
+func createFlow(accountID string, f Flow) (int, error) {
+	def, _ := json.Marshal(f.Definition)
+
+	var flowID int
+	err := db.QueryRow(`
+		INSERT INTO tbl_dm_flows (ig_account_id, name, definition, is_active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, accountID, f.Name, string(def), f.IsActive).Scan(&flowID)
+
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+
+	log.Printf("Flow created successfully with ID: %d", flowID)
+	return flowID, nil
+}
+
+func updateFlow(accountID, flowID string, f Flow) (bool, error) {
+	def, _ := json.Marshal(f.Definition)
+
+	res, err := db.Exec(`
+		UPDATE tbl_dm_flows
+		SET name = $3, definition = $4, is_active = $5, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND ig_account_id = $2
+	`, flowID, accountID, f.Name, string(def), f.IsActive)
+	if err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// saveFlowSession upserts the user's session. Starting a flow replaces
+// whatever session the user had with the account.
+func saveFlowSession(s *FlowSession) {
+	resumeAt := sql.NullTime{Time: s.ResumeAt, Valid: s.Status == flowWaitingTimer}
+
+	_, err := db.Exec(`
+		INSERT INTO tbl_flow_sessions (
+			ig_account_id, flow_id, user_id, username, comment_text, node_id, status, resume_at,
+			post_id, template_id
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8::timestamptz, NULLIF($9, ''), NULLIF($10, 0))
+		ON CONFLICT (ig_account_id, user_id) DO UPDATE SET
+			flow_id = EXCLUDED.flow_id,
+			username = EXCLUDED.username,
+			comment_text = EXCLUDED.comment_text,
+			post_id = EXCLUDED.post_id,
+			template_id = EXCLUDED.template_id,
+			node_id = EXCLUDED.node_id,
+			status = EXCLUDED.status,
+			resume_at = EXCLUDED.resume_at,
+			updated_at = NOW()
+	`, s.AccountID, s.FlowID, s.UserID, s.Username, s.CommentText, s.NodeID, s.Status, resumeAt,
+		s.PostID, s.TemplateID)
+
+	if err != nil {
+		log.Println("❌ Flow session save error:", err)
+	}
+}
+
+const flowSessionColumns = `
+	ig_account_id::text, flow_id, user_id, COALESCE(username, ''), COALESCE(comment_text, ''),
+	COALESCE(post_id, ''), COALESCE(template_id, 0), node_id, status
+`
+
+func scanFlowSession(row interface{ Scan(...interface{}) error }) (*FlowSession, error) {
+	var s FlowSession
+	err := row.Scan(&s.AccountID, &s.FlowID, &s.UserID, &s.Username, &s.CommentText,
+		&s.PostID, &s.TemplateID, &s.NodeID, &s.Status)
+	return &s, err
+}
+
+// claimFlowSession marks the user's session active if it is in the given
+// waiting state, so two quick replies can't advance it twice. Returns nil if
+// there is nothing waiting.
+func claimFlowSession(accountID, userID, waiting string) (*FlowSession, error) {
+	s, err := scanFlowSession(db.QueryRow(`
+		UPDATE tbl_flow_sessions
+		SET status = $3, updated_at = NOW()
+		WHERE ig_account_id = $1 AND user_id = $2 AND status = $4
+		RETURNING `+flowSessionColumns,
+		accountID, userID, flowActive, waiting))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// claimDueFlowSessions marks sessions whose wait is over active and
+// returns them. Sessions of paused accounts stay put until they're resumed.
+func claimDueFlowSessions() ([]*FlowSession, error) {
+	rows, err := db.Query(`
+		UPDATE tbl_flow_sessions
+		SET status = $1, resume_at = NULL, updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM tbl_flow_sessions
+			WHERE status = $2 AND resume_at <= NOW()
+			  AND `+accountModeSQL("tbl_flow_sessions", 3)+` <> $4
+			ORDER BY resume_at
+			LIMIT 50
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+flowSessionColumns,
+		flowActive, flowWaitingTimer, config.SendMode, modePaused)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*FlowSession
+	for rows.Next() {
+		s, err := scanFlowSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// expireFlowSessions gives up on users who never answered (or never wrote
+// in to open their window).
+func expireFlowSessions() {
+	_, err := db.Exec(`
+		UPDATE tbl_flow_sessions
+		SET status = $1, updated_at = NOW()
+		WHERE status IN ($2, $4) AND updated_at < NOW() - make_interval(secs => $3)
+	`, flowExpired, flowWaitingReply, flowSessionTTL.Seconds(), flowWaitingWindow)
+
+	if err != nil {
+		log.Println("❌ Flow session expiry error:", err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"instagram-autodm/graph/graphtest"
+)
+
+func testFlow() FlowDefinition {
+	return FlowDefinition{
+		Start: "ask",
+		Nodes: map[string]FlowNode{
+			"ask": {Type: FlowNodeQuickReplies, Text: "Want the PDF, {{username}}?", Options: []FlowOption{
+				{Title: "Yes", Next: "pdf"},
+				{Title: "No", Payload: "NOPE", Next: "bye"},
+			}},
+			"pdf":  {Type: FlowNodeText, Text: "Here you go", Next: "wait"},
+			"wait": {Type: FlowNodeWait, Duration: "2h", Next: "help"},
+			"help": {Type: FlowNodeBranch, Text: "Did it help?", Branches: []FlowBranch{
+				{Pattern: "yes", Next: "bye"},
+				{MatchMode: MatchRegex, Pattern: `^no+\b`, Next: "menu"},
+			}},
+			"menu": {Type: FlowNodeButtons, Text: "Pick one", Buttons: []FlowButton{
+				{Type: "postback", Title: "Call me", Payload: "CALL", Next: "bye"},
+				{Type: "web_url", Title: "Shop", URL: "https://shop.example"},
+			}, Next: "bye"},
+			"bye":  {Type: FlowNodeText, Text: "Bye!", Next: "lead"},
+			"lead": {Type: FlowNodeLeadCapture, Text: "Your email?", Capture: LeadEmail},
+		},
+	}
+}
+
+func TestFlowDefinitionValidate(t *testing.T) {
+	if err := testFlow().validate(); err != nil {
+		t.Fatalf("valid flow: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(d *FlowDefinition)
+		want string
+	}{
+		{"no nodes", func(d *FlowDefinition) { d.Nodes = nil }, "no nodes"},
+		{"missing start", func(d *FlowDefinition) { d.Start = "nope" }, "start node"},
+		{"wait start", func(d *FlowDefinition) { d.Start = "wait" }, "can't be a wait"},
+		{"unknown type", func(d *FlowDefinition) { d.Nodes["bye"] = FlowNode{Type: "video"} }, "unknown type"},
+		{"text without text", func(d *FlowDefinition) { d.Nodes["bye"] = FlowNode{Type: FlowNodeText, Text: " "} }, "text is required"},
+		{"dangling next", func(d *FlowDefinition) { d.Nodes["bye"] = FlowNode{Type: FlowNodeText, Text: "x", Next: "gone"} }, "next node"},
+		{"bad duration", func(d *FlowDefinition) { d.Nodes["wait"] = FlowNode{Type: FlowNodeWait, Duration: "soon"} }, "invalid duration"},
+		{"negative duration", func(d *FlowDefinition) { d.Nodes["wait"] = FlowNode{Type: FlowNodeWait, Duration: "-1h"} }, "invalid duration"},
+		{"no options", func(d *FlowDefinition) { d.Nodes["ask"] = FlowNode{Type: FlowNodeQuickReplies, Text: "?"} }, "options"},
+		{"long button title", func(d *FlowDefinition) {
+			d.Nodes["ask"] = FlowNode{Type: FlowNodeQuickReplies, Text: "?", Options: []FlowOption{{Title: strings.Repeat("a", 21)}}}
+		}, "longer than"},
+		{"too many buttons", func(d *FlowDefinition) {
+			b := FlowButton{Type: "postback", Title: "x"}
+			d.Nodes["menu"] = FlowNode{Type: FlowNodeButtons, Text: "?", Buttons: []FlowButton{b, b, b, b}}
+		}, "buttons needs"},
+		{"web_url without url", func(d *FlowDefinition) {
+			d.Nodes["menu"] = FlowNode{Type: FlowNodeButtons, Text: "?", Buttons: []FlowButton{{Type: "web_url", Title: "x"}}}
+		}, "needs a url"},
+		{"bad branch regex", func(d *FlowDefinition) {
+			d.Nodes["help"] = FlowNode{Type: FlowNodeBranch, Branches: []FlowBranch{{MatchMode: MatchRegex, Pattern: "("}}}
+		}, "node \"help\""},
+		{"lead capture without text", func(d *FlowDefinition) { d.Nodes["bye"] = FlowNode{Type: FlowNodeLeadCapture} }, "text is required"},
+		{"unknown capture", func(d *FlowDefinition) {
+			d.Nodes["bye"] = FlowNode{Type: FlowNodeLeadCapture, Text: "Email?", Capture: "address"}
+		}, "unknown capture"},
+		{"unknown variable in confirm text", func(d *FlowDefinition) {
+			d.Nodes["bye"] = FlowNode{Type: FlowNodeLeadCapture, Text: "Email?", ConfirmText: "{{coupon}}"}
+		}, "coupon"},
+		{"unknown variable", func(d *FlowDefinition) { d.Nodes["bye"] = FlowNode{Type: FlowNodeText, Text: "{{coupon}}"} }, "coupon"},
+	}
+
+	for _, tt := range tests {
+		d := testFlow()
+		tt.edit(&d)
+		err := d.validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestFlowNodeRoute(t *testing.T) {
+	d := testFlow()
+
+	tests := []struct {
+		name    string
+		node    string
+		text    string
+		payload string
+		want    string
+		wantOK  bool
+	}{
+		{"quick reply payload", "ask", "", "Yes", "pdf", true},
+		{"quick reply custom payload", "ask", "No", "NOPE", "bye", true},
+		{"quick reply typed title", "ask", "  yes ", "", "pdf", true},
+		{"quick reply no match keeps waiting", "ask", "maybe", "", "", false},
+		{"button postback", "menu", "", "CALL", "bye", true},
+		{"button no match falls back to next", "menu", "hello", "", "bye", true},
+		{"branch whole word", "help", "Yes, thanks!", "", "bye", true},
+		{"branch with diacritics", "help", "yés", "", "bye", true},
+		{"branch regex", "help", "nooo", "", "menu", true},
+		{"branch no match", "help", "kind of", "", "", false},
+	}
+
+	for _, tt := range tests {
+		next, ok := d.Nodes[tt.node].route(tt.text, tt.payload)
+		if next != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tt.name, next, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestFlowNodeMessage(t *testing.T) {
+	d := testFlow()
+	s := &FlowSession{Username: "jane"}
+
+	msg := d.Nodes["ask"].message(s)
+	if msg.Text != "Want the PDF, jane?" {
+		t.Errorf("text = %q", msg.Text)
+	}
+	if len(msg.QuickReplies) != 2 || msg.QuickReplies[0].Payload != "Yes" || msg.QuickReplies[1].Payload != "NOPE" {
+		t.Errorf("quick replies = %+v", msg.QuickReplies)
+	}
+
+	msg = d.Nodes["menu"].message(s)
+	if msg.Text != "" || msg.Attachment == nil || msg.Attachment.Type != "template" {
+		t.Fatalf("buttons message = %+v", msg)
+	}
+	payload := msg.Attachment.Payload
+	if payload.TemplateType != "button" || payload.Text != "Pick one" || len(payload.Buttons) != 2 {
+		t.Fatalf("payload = %+v", payload)
+	}
+	if payload.Buttons[0].Payload != "CALL" || payload.Buttons[1].Payload != "" || payload.Buttons[1].URL != "https://shop.example" {
+		t.Errorf("buttons = %+v", payload.Buttons)
+	}
+}
+
+func TestRunFlowStopsAtWait(t *testing.T) {
+	d := testFlow()
+	s := &FlowSession{UserID: "42", NodeID: "wait", Status: flowActive}
+
+	sent, err := runFlow(s, d, IGCredentials{}, Recipient{ID: "42"})
+	if err != nil || sent {
+		t.Fatalf("runFlow: sent=%v err=%v", sent, err)
+	}
+	if s.Status != flowWaitingTimer || s.NodeID != "help" {
+		t.Errorf("session = %s at %q, want %s at help", s.Status, s.NodeID, flowWaitingTimer)
+	}
+	if d := time.Until(s.ResumeAt); d < 119*time.Minute || d > 2*time.Hour {
+		t.Errorf("resume in %v, want 2h", d)
+	}
+
+	s = &FlowSession{UserID: "42", NodeID: "removed", Status: flowActive}
+	if sent, err := runFlow(s, d, IGCredentials{}, Recipient{ID: "42"}); err != nil || sent || s.Status != flowCompleted {
+		t.Errorf("missing node: sent=%v err=%v status=%s", sent, err, s.Status)
+	}
+}
+
+func flowSessionStatus(t *testing.T, accountID, userID string) (status, nodeID string) {
+	t.Helper()
+	db.QueryRow("SELECT status, node_id FROM tbl_flow_sessions WHERE ig_account_id = $1 AND user_id = $2",
+		accountID, userID).Scan(&status, &nodeID)
+	return status, nodeID
+}
+
+func TestFlowWaitsForMessagingWindow(t *testing.T) {
+	srv := setupQueueTest(t)
+	accountID := insertTestAccount(t, modeLive)
+
+	def := FlowDefinition{Start: "hi", Nodes: map[string]FlowNode{
+		"hi":   {Type: FlowNodeText, Text: "Hi!", Next: "more"},
+		"more": {Type: FlowNodeText, Text: "One more thing", Next: "bye"},
+		"bye":  {Type: FlowNodeText, Text: "Bye!"},
+	}}
+	flowID, err := createFlow(accountID, Flow{Name: "window", Definition: def, IsActive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := credentialsForJob(DMJob{AccountID: accountID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Private Reply goes out, the next node needs the user to write in
+	job := DMJob{AccountID: accountID, FlowID: flowID, UserID: "u1", Username: "jane", CommentID: "c1"}
+	if sent, err := startFlow(job, creds, Recipient{CommentID: "c1"}); err != nil || !sent {
+		t.Fatalf("startFlow: sent=%v err=%v", sent, err)
+	}
+	if n := len(srv.RequestsTo(graphtest.Messages)); n != 1 {
+		t.Fatalf("sent %d messages, want the Private Reply only", n)
+	}
+	if status, node := flowSessionStatus(t, accountID, "u1"); status != flowWaitingWindow || node != "more" {
+		t.Fatalf("session %s at %q, want %s at more", status, node, flowWaitingWindow)
+	}
+
+	// Their message opens the window and the flow carries on; Meta still
+	// refusing the window holds it again
+	srv.On(graphtest.Messages, graphtest.Response{}).Times(1)
+	srv.On(graphtest.Messages, graphtest.WindowClosed()).Times(1)
+	var event MessagingEvent
+	json.Unmarshal([]byte(`{"sender": {"id": "u1"}, "message": {"mid": "m1", "text": "hello"}}`), &event)
+	processInboundMessage(creds.IGUserID, accountID, event)
+
+	if n := len(srv.RequestsTo(graphtest.Messages)); n != 3 {
+		t.Fatalf("sent %d messages, want 3", n)
+	}
+	if status, node := flowSessionStatus(t, accountID, "u1"); status != flowWaitingWindow || node != "bye" {
+		t.Fatalf("session %s at %q, want %s at bye", status, node, flowWaitingWindow)
+	}
+
+	srv.Reset()
+	processInboundMessage(creds.IGUserID, accountID, event)
+	if status, _ := flowSessionStatus(t, accountID, "u1"); status != flowCompleted {
+		t.Errorf("session %s, want %s", status, flowCompleted)
+	}
+}
+
+// A flow saved before wait start nodes were rejected sends nothing, so the
+// job and its comment's Private Reply mustn't count as sent.
+func TestFlowSendingNothingIsNotSent(t *testing.T) {
+	srv := setupQueueTest(t)
+	accountID := insertTestAccount(t, modeLive)
+
+	def := FlowDefinition{Start: "wait", Nodes: map[string]FlowNode{
+		"wait": {Type: FlowNodeWait, Duration: "1h", Next: "hi"},
+		"hi":   {Type: FlowNodeText, Text: "Hi!"},
+	}}
+	flowID, err := createFlow(accountID, Flow{Name: "legacy", Definition: def, IsActive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := enqueueDMJob(DMJob{AccountID: accountID, FlowID: flowID, UserID: "u1", PostID: "17900000000000001", CommentID: "c1"}, 0)
+	if err != nil || !queued {
+		t.Fatalf("enqueue: %v, queued=%v", err, queued)
+	}
+	job := runDueJob(t)
+
+	if n := len(srv.RequestsTo(graphtest.Messages)); n != 0 {
+		t.Errorf("sent %d messages", n)
+	}
+	if got, _ := jobStatus(t, job.ID); got != jobDead {
+		t.Errorf("job status = %s, want %s", got, jobDead)
+	}
+	var replies int
+	db.QueryRow("SELECT COUNT(*) FROM private_replies WHERE comment_id = 'c1'").Scan(&replies)
+	if replies != 0 {
+		t.Error("comment's Private Reply marked as used")
+	}
+	if status, _ := flowSessionStatus(t, accountID, "u1"); status != flowFailed {
+		t.Errorf("session %s, want %s", status, flowFailed)
+	}
+}
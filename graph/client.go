@@ -0,0 +1,284 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ============================================
+// GRAPH API CLIENT
+// ============================================
+
+// One Client (base URL, API version, HTTP transport) is shared by the whole
+// app; Account binds it to one Instagram account's ID and token. Tokens go in
+// the Authorization header, never in the query string.
+
+const (
+	DefaultBaseURL      = "https://graph.instagram.com"
+	DefaultDebugBaseURL = "https://graph.facebook.com"
+	DefaultVersion      = "v18.0"
+	DefaultTimeout      = 30 * time.Second
+)
+
+// API is everything the app asks of the Graph API for one account.
+type API interface {
+	// SendMessage sends a DM. recipient and message are marshaled as-is into
+	// the request's "recipient" and "message" fields.
+	SendMessage(recipient, message interface{}) (*MessageResponse, error)
+	ReplyToComment(commentID, message string) (string, error)
+	CreateContainer(c Container) (string, error)
+	ContainerStatus(containerID string) (*ContainerStatus, error)
+	Publish(containerID string) (string, error)
+	GetMe() (*User, error)
+	// RefreshToken exchanges the account's long-lived token (at least 24
+	// hours old) for a new one.
+	RefreshToken() (*Token, error)
+	// DebugToken inspects the account's token using an app token
+	// ("app_id|app_secret").
+	DebugToken(appToken string) (*TokenDebug, error)
+}
+
+type Config struct {
+	BaseURL      string        // default DefaultBaseURL
+	DebugBaseURL string        // host for debug_token, default DefaultDebugBaseURL
+	Version      string        // default DefaultVersion
+	Timeout      time.Duration // per request, default DefaultTimeout
+}
+
+type Client struct {
+	baseURL      string
+	debugBaseURL string
+	version      string
+	http         *http.Client
+}
+
+func New(cfg Config) *Client {
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultBaseURL
+	}
+	if cfg.DebugBaseURL == "" {
+		cfg.DebugBaseURL = DefaultDebugBaseURL
+	}
+	if cfg.Version == "" {
+		cfg.Version = DefaultVersion
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 16
+
+	return &Client{
+		baseURL:      strings.TrimRight(cfg.BaseURL, "/"),
+		debugBaseURL: strings.TrimRight(cfg.DebugBaseURL, "/"),
+		version:      strings.Trim(cfg.Version, "/"),
+		http:         &http.Client{Transport: transport, Timeout: cfg.Timeout},
+	}
+}
+
+// Account returns the API for one Instagram account.
+func (c *Client) Account(igUserID, accessToken string) API {
+	return &Account{client: c, igUserID: igUserID, token: accessToken}
+}
+
+// Account is the Client bound to one Instagram account.
+type Account struct {
+	client   *Client
+	igUserID string
+	token    string
+}
+
+// ============================================
+// RESPONSES
+// ============================================
+
+type MessageResponse struct {
+	RecipientID string `json:"recipient_id"`
+	MessageID   string `json:"message_id"`
+}
+
+type User struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	Username    string `json:"username"`
+	Name        string `json:"name"`
+	AccountType string `json:"account_type"`
+}
+
+// Container is a media container to create before publishing. Set ImageURL
+// for a photo, or VideoURL (and MediaType "REELS") for a reel.
+type Container struct {
+	ImageURL     string `json:"image_url,omitempty"`
+	VideoURL     string `json:"video_url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Caption      string `json:"caption,omitempty"`
+	MediaType    string `json:"media_type,omitempty"`
+}
+
+// ContainerStatus reports video processing; StatusCode is IN_PROGRESS,
+// FINISHED, PUBLISHED, ERROR or EXPIRED.
+type ContainerStatus struct {
+	ID         string `json:"id"`
+	StatusCode string `json:"status_code"`
+	Status     string `json:"status"`
+}
+
+// Token is a refreshed access token; ExpiresIn is in seconds.
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// TokenDebug is the data of a debug_token response. ExpiresAt is a unix
+// time, 0 for tokens that don't expire.
+type TokenDebug struct {
+	AppID     string   `json:"app_id"`
+	UserID    string   `json:"user_id"`
+	IsValid   bool     `json:"is_valid"`
+	ExpiresAt int64    `json:"expires_at"`
+	Scopes    []string `json:"scopes"`
+}
+
+type idResponse struct {
+	ID string `json:"id"`
+}
+
+// ============================================
+// ENDPOINTS
+// ============================================
+
+func (a *Account) SendMessage(recipient, message interface{}) (*MessageResponse, error) {
+	var resp MessageResponse
+	err := a.do("POST", "/"+a.igUserID+"/messages", map[string]interface{}{
+		"recipient": recipient,
+		"message":   message,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ReplyToComment posts a public reply and returns the new comment's ID.
+func (a *Account) ReplyToComment(commentID, message string) (string, error) {
+	var resp idResponse
+	err := a.do("POST", "/"+commentID+"/replies", map[string]string{"message": message}, &resp)
+	return resp.ID, err
+}
+
+func (a *Account) CreateContainer(c Container) (string, error) {
+	var resp idResponse
+	if err := a.do("POST", "/"+a.igUserID+"/media", c, &resp); err != nil {
+		return "", err
+	}
+	if resp.ID == "" {
+		return "", fmt.Errorf("no ID in container response")
+	}
+	return resp.ID, nil
+}
+
+func (a *Account) ContainerStatus(containerID string) (*ContainerStatus, error) {
+	var resp ContainerStatus
+	if err := a.do("GET", "/"+containerID+"?fields=id,status_code,status", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Publish publishes a container and returns the media ID.
+func (a *Account) Publish(containerID string) (string, error) {
+	var resp idResponse
+	err := a.do("POST", "/"+a.igUserID+"/media_publish", map[string]string{"creation_id": containerID}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.ID == "" {
+		return "", fmt.Errorf("no media ID in publish response")
+	}
+	return resp.ID, nil
+}
+
+func (a *Account) GetMe() (*User, error) {
+	var resp User
+	if err := a.do("GET", "/me?fields=id,user_id,username,name,account_type", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (a *Account) RefreshToken() (*Token, error) {
+	var resp Token
+	u := a.client.baseURL + "/refresh_access_token?grant_type=ig_refresh_token"
+	if err := a.client.send("GET", u, a.token, nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.AccessToken == "" {
+		return nil, fmt.Errorf("no access token in refresh response")
+	}
+	return &resp, nil
+}
+
+func (a *Account) DebugToken(appToken string) (*TokenDebug, error) {
+	var resp struct {
+		Data TokenDebug `json:"data"`
+	}
+	u := a.client.debugBaseURL + "/" + a.client.version + "/debug_token?input_token=" + url.QueryEscape(a.token)
+	if err := a.client.send("GET", u, appToken, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Data, nil
+}
+
+// do calls a versioned Graph API path with the account's token.
+func (a *Account) do(method, path string, body, out interface{}) error {
+	return a.client.send(method, a.client.baseURL+"/"+a.client.version+path, a.token, body, out)
+}
+
+// send sends a JSON request and decodes a 2xx response into out. Non-2xx
+// responses come back as *Error.
+func (c *Client) send(method, u, token string, body, out interface{}) error {
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("payload error: %v", err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return fmt.Errorf("request error: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("network error reaching Graph API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ParseError(resp, b)
+	}
+
+	if out != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return fmt.Errorf("failed to decode Graph API response: %v", err)
+		}
+	}
+	return nil
+}
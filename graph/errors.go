@@ -0,0 +1,124 @@
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ============================================
+// GRAPH API ERRORS
+// ============================================
+
+// ErrorKind tells the caller's retry policy what to do with a failed call.
+type ErrorKind string
+
+const (
+	ErrRateLimited     ErrorKind = "rate_limited"     // back off, then retry
+	ErrTransient       ErrorKind = "transient"        // retry with normal backoff
+	ErrAuth            ErrorKind = "auth"             // token expired/invalid, account needs reauth
+	ErrPermission      ErrorKind = "permission"       // app lacks a permission, permanent
+	ErrMessagingWindow ErrorKind = "messaging_window" // 24-hour window closed, permanent for now
+	ErrInvalidUser     ErrorKind = "invalid_user"     // recipient can't be messaged, permanent
+	ErrInvalidRequest  ErrorKind = "invalid_request"  // bad parameters, permanent
+)
+
+// Minimum wait after a throttling error when Meta doesn't tell us how long
+const RateLimitBackoff = 1 * time.Minute
+
+// Error is a parsed Graph API error response.
+type Error struct {
+	Kind       ErrorKind     `json:"-"`
+	StatusCode int           `json:"-"`
+	Code       int           `json:"code"`
+	Subcode    int           `json:"error_subcode"`
+	Type       string        `json:"type"`
+	Message    string        `json:"message"`
+	Transient  bool          `json:"is_transient"`
+	FBTraceID  string        `json:"fbtrace_id"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Kind == ErrMessagingWindow {
+		return "24_hour_messaging_window_expired: User must message you first or within 24 hours"
+	}
+	return fmt.Sprintf("api_error_%d: %s (code %d, subcode %d): %s", e.StatusCode, e.Kind, e.Code, e.Subcode, e.Message)
+}
+
+// Retryable reports whether the same request may succeed later.
+func (e *Error) Retryable() bool {
+	return e.Kind == ErrRateLimited || e.Kind == ErrTransient
+}
+
+// ParseError builds an Error from a non-2xx response.
+func ParseError(resp *http.Response, body []byte) *Error {
+	var envelope struct {
+		Error Error `json:"error"`
+	}
+	json.Unmarshal(body, &envelope)
+
+	ge := envelope.Error
+	ge.StatusCode = resp.StatusCode
+	if ge.Message == "" {
+		ge.Message = string(body)
+	}
+	ge.Kind = Classify(ge)
+	if ge.Kind == ErrRateLimited {
+		ge.RetryAfter = retryAfter(resp)
+	}
+
+	return &ge
+}
+
+// Classify maps Meta's error codes to an ErrorKind.
+func Classify(e Error) ErrorKind {
+	switch {
+	case e.Code == 4 || e.Code == 17 || e.Code == 32 || e.Code == 613:
+		return ErrRateLimited
+	case e.Code == 190 || e.Code == 102:
+		return ErrAuth
+	case e.Code == 10 && e.Subcode == 2534022:
+		return ErrMessagingWindow
+	case e.Code == 100 && (e.Subcode == 2534014 || e.Subcode == 2018001):
+		return ErrInvalidUser
+	case e.Code == 551:
+		return ErrInvalidUser
+	case e.Code == 10 || (e.Code >= 200 && e.Code <= 299):
+		return ErrPermission
+	case e.Transient || e.Code == 1 || e.Code == 2 || e.StatusCode >= 500:
+		return ErrTransient
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return ErrInvalidRequest
+}
+
+// retryAfter reads how long Meta wants us to wait from the Retry-After header
+// or the estimated_time_to_regain_access (minutes) in X-Business-Use-Case-Usage.
+func retryAfter(resp *http.Response) time.Duration {
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	var usage map[string][]struct {
+		EstimatedTimeToRegainAccess int `json:"estimated_time_to_regain_access"`
+	}
+	if err := json.Unmarshal([]byte(resp.Header.Get("X-Business-Use-Case-Usage")), &usage); err == nil {
+		var wait time.Duration
+		for _, entries := range usage {
+			for _, u := range entries {
+				if d := time.Duration(u.EstimatedTimeToRegainAccess) * time.Minute; d > wait {
+					wait = d
+				}
+			}
+		}
+		if wait > 0 {
+			return wait
+		}
+	}
+
+	return RateLimitBackoff
+}
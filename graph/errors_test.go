@@ -0,0 +1,81 @@
+package graph
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  Error
+		want ErrorKind
+	}{
+		{"app rate limit", Error{StatusCode: 400, Code: 4}, ErrRateLimited},
+		{"user rate limit", Error{StatusCode: 400, Code: 17}, ErrRateLimited},
+		{"page rate limit", Error{StatusCode: 400, Code: 32}, ErrRateLimited},
+		{"custom rate limit", Error{StatusCode: 400, Code: 613}, ErrRateLimited},
+		{"429 without a code", Error{StatusCode: 429}, ErrRateLimited},
+		{"expired token", Error{StatusCode: 401, Code: 190, Subcode: 463}, ErrAuth},
+		{"session key", Error{StatusCode: 400, Code: 102}, ErrAuth},
+		{"messaging window", Error{StatusCode: 400, Code: 10, Subcode: 2534022}, ErrMessagingWindow},
+		{"user not found", Error{StatusCode: 400, Code: 100, Subcode: 2534014}, ErrInvalidUser},
+		{"no matching user", Error{StatusCode: 400, Code: 100, Subcode: 2018001}, ErrInvalidUser},
+		{"user unavailable", Error{StatusCode: 400, Code: 551}, ErrInvalidUser},
+		{"permission denied", Error{StatusCode: 403, Code: 10}, ErrPermission},
+		{"permission range", Error{StatusCode: 403, Code: 230}, ErrPermission},
+		{"flagged transient", Error{StatusCode: 400, Code: 100, Transient: true}, ErrTransient},
+		{"unknown error", Error{StatusCode: 500, Code: 1}, ErrTransient},
+		{"service error", Error{StatusCode: 503, Code: 2}, ErrTransient},
+		{"5xx without a code", Error{StatusCode: 502}, ErrTransient},
+		{"bad parameter", Error{StatusCode: 400, Code: 100}, ErrInvalidRequest},
+	}
+
+	for _, tt := range tests {
+		if got := Classify(tt.err); got != tt.want {
+			t.Errorf("%s: Classify(%+v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrorRetryAfter(t *testing.T) {
+	body := []byte(`{"error":{"message":"Application request limit reached","code":4}}`)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+	}{
+		{"Retry-After", map[string]string{"Retry-After": "120"}, 2 * time.Minute},
+		{"usage header", map[string]string{"X-Business-Use-Case-Usage": `{"1784":[{"estimated_time_to_regain_access":5}]}`}, 5 * time.Minute},
+		{"no hint", nil, RateLimitBackoff},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{}}
+		for k, v := range tt.headers {
+			resp.Header.Set(k, v)
+		}
+
+		ge := ParseError(resp, body)
+		if ge.Kind != ErrRateLimited {
+			t.Fatalf("%s: kind = %s, want %s", tt.name, ge.Kind, ErrRateLimited)
+		}
+		if ge.RetryAfter != tt.want {
+			t.Errorf("%s: RetryAfter = %v, want %v", tt.name, ge.RetryAfter, tt.want)
+		}
+	}
+}
+
+func TestParseErrorWithoutEnvelope(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{}}
+
+	ge := ParseError(resp, []byte("Bad Gateway"))
+	if ge.Kind != ErrTransient || !ge.Retryable() {
+		t.Errorf("kind = %s, want a retryable %s", ge.Kind, ErrTransient)
+	}
+	if ge.Message != "Bad Gateway" {
+		t.Errorf("message = %q, want the raw body", ge.Message)
+	}
+}
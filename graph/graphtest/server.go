@@ -0,0 +1,486 @@
+// Package graphtest is a fake Instagram Graph API for end-to-end tests.
+//
+// It serves the endpoints the app uses (messages, media, media_publish,
+// comment replies, container status, /me and token refresh/debug), answers
+// with canned successes unless a scripted response says otherwise, and
+// records every request.
+//
+//	srv := graphtest.NewServer()
+//	defer srv.Close()
+//	srv.On(graphtest.Messages, graphtest.WindowClosed()).Times(1)
+//	// point the app at srv.URL (GRAPH_API_BASE_URL), run it, then
+//	reqs := srv.RequestsTo(graphtest.Messages)
+//
+// cmd/fakegraph runs the same fake as a standalone server.
+package graphtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints
+const (
+	Messages        = "messages"
+	Media           = "media"
+	MediaPublish    = "media_publish"
+	Replies         = "replies"
+	ContainerStatus = "container_status"
+	Me              = "me"
+	RefreshToken    = "refresh_access_token"
+	DebugToken      = "debug_token"
+)
+
+var versionSegment = regexp.MustCompile(`^v\d+\.\d+$`)
+
+// Request is one recorded call.
+type Request struct {
+	Method   string          `json:"method"`
+	Endpoint string          `json:"endpoint"`
+	Path     string          `json:"path"`
+	Query    string          `json:"query,omitempty"`
+	Token    string          `json:"token"` // from the Bearer header or access_token
+	Body     json.RawMessage `json:"body,omitempty"`
+	Status   int             `json:"status"`
+	At       time.Time       `json:"at"`
+}
+
+// Response is a scripted answer. A nil Body with a 2xx Status gives the
+// endpoint's normal success body.
+type Response struct {
+	Status  int
+	Body    json.RawMessage
+	Headers map[string]string
+	Delay   time.Duration
+}
+
+// Rule answers calls to an endpoint with a Response, for the next n calls
+// (see Times) or until removed by Reset.
+type Rule struct {
+	endpoint string
+	response Response
+	left     int // -1 = unlimited
+}
+
+// Times limits the rule to the next n matching calls.
+func (r *Rule) Times(n int) *Rule {
+	r.left = n
+	return r
+}
+
+// Fake is the Graph API handler. Use NewServer in tests or mount it
+// yourself.
+type Fake struct {
+	// What /me returns
+	AccountID string
+	Username  string
+
+	mu       sync.Mutex
+	rules    []*Rule
+	requests []Request
+	seq      int
+}
+
+func New() *Fake {
+	return &Fake{AccountID: "17841400000000001", Username: "fake_account"}
+}
+
+// On scripts the response to the endpoint's calls. Rules are checked in the
+// order added; calls no rule matches succeed.
+func (f *Fake) On(endpoint string, resp Response) *Rule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rule := &Rule{endpoint: endpoint, response: resp, left: -1}
+	f.rules = append(f.rules, rule)
+	return rule
+}
+
+// Reset drops all scripted responses and recorded requests.
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = nil
+	f.requests = nil
+}
+
+// Requests returns every call received so far, oldest first.
+func (f *Fake) Requests() []Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Request(nil), f.requests...)
+}
+
+// RequestsTo returns the calls to one endpoint.
+func (f *Fake) RequestsTo(endpoint string) []Request {
+	var out []Request
+	for _, r := range f.Requests() {
+		if r.Endpoint == endpoint {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, controlPrefix) {
+		f.serveControl(w, r)
+		return
+	}
+
+	endpoint, id := route(r.Method, r.URL.Path)
+	body, _ := io.ReadAll(r.Body)
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+
+	var resp Response
+	if endpoint == "" {
+		resp = GraphError(http.StatusBadRequest, 100, 33, "Unsupported request - fake Graph API has no "+r.Method+" "+r.URL.Path)
+	} else {
+		resp = f.respond(endpoint, id)
+	}
+
+	f.mu.Lock()
+	rec := Request{
+		Method:   r.Method,
+		Endpoint: endpoint,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		Token:    token,
+		Status:   resp.Status,
+		At:       time.Now(),
+	}
+	if json.Valid(body) {
+		rec.Body = body
+	}
+	f.requests = append(f.requests, rec)
+	f.mu.Unlock()
+
+	if resp.Delay > 0 {
+		select {
+		case <-time.After(resp.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+// route maps a path like /v18.0/123/messages to an endpoint and the object
+// ID it addresses.
+func route(method, path string) (endpoint, id string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 0 && versionSegment.MatchString(parts[0]) {
+		parts = parts[1:]
+	}
+
+	switch {
+	case len(parts) == 1 && method == http.MethodGet &&
+		(parts[0] == Me || parts[0] == RefreshToken || parts[0] == DebugToken):
+		return parts[0], ""
+	case len(parts) == 1 && parts[0] != "" && method == http.MethodGet:
+		return ContainerStatus, parts[0]
+	case len(parts) == 2 && method == http.MethodPost:
+		switch parts[1] {
+		case Messages, Media, MediaPublish, Replies:
+			return parts[1], parts[0]
+		}
+	}
+	return "", ""
+}
+
+// respond picks the scripted response for a call, filling in the success
+// body where the script leaves it out.
+func (f *Fake) respond(endpoint, id string) Response {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	resp := Response{Status: http.StatusOK}
+	for _, rule := range f.rules {
+		if rule.endpoint != endpoint || rule.left == 0 {
+			continue
+		}
+		if rule.left > 0 {
+			rule.left--
+		}
+		resp = rule.response
+		break
+	}
+
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	if resp.Body == nil && resp.Status < 300 {
+		resp.Body = f.successBody(endpoint, id)
+	}
+	return resp
+}
+
+func (f *Fake) successBody(endpoint, id string) json.RawMessage {
+	var v interface{}
+	switch endpoint {
+	case Messages:
+		v = map[string]string{"recipient_id": "fake_recipient", "message_id": fmt.Sprintf("m_fake_%d", f.seq)}
+	case Media:
+		v = map[string]string{"id": fmt.Sprintf("1790000000%d", f.seq)}
+	case MediaPublish:
+		v = map[string]string{"id": fmt.Sprintf("1800000000%d", f.seq)}
+	case Replies:
+		v = map[string]string{"id": fmt.Sprintf("1810000000%d", f.seq)}
+	case ContainerStatus:
+		v = map[string]string{"id": id, "status_code": "FINISHED", "status": "Finished: Media container is ready"}
+	case Me:
+		v = map[string]string{"id": f.AccountID, "user_id": f.AccountID, "username": f.Username, "account_type": "BUSINESS"}
+	case RefreshToken:
+		v = map[string]interface{}{"access_token": fmt.Sprintf("IGfake_refreshed_%d", f.seq), "token_type": "bearer", "expires_in": 5184000}
+	case DebugToken:
+		v = map[string]interface{}{"data": map[string]interface{}{
+			"app_id":     "fake_app",
+			"user_id":    f.AccountID,
+			"is_valid":   true,
+			"expires_at": time.Now().Add(60 * 24 * time.Hour).Unix(),
+			"scopes":     []string{"instagram_business_basic", "instagram_business_manage_messages"},
+		}}
+	}
+
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// ============================================
+// CANNED RESPONSES
+// ============================================
+
+// GraphError is an error response in Meta's envelope.
+func GraphError(status, code, subcode int, message string) Response {
+	b, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message":       message,
+			"type":          "OAuthException",
+			"code":          code,
+			"error_subcode": subcode,
+			"fbtrace_id":    "fake_trace",
+		},
+	})
+	return Response{Status: status, Body: b}
+}
+
+// WindowClosed is the 24-hour messaging window error (10 / 2534022).
+func WindowClosed() Response {
+	return GraphError(http.StatusBadRequest, 10, 2534022, "This message is sent outside of allowed window.")
+}
+
+// Throttled is a rate limit error (code 4, 17, 32 or 613) asking us to
+// wait retryAfter (none if zero).
+func Throttled(code int, retryAfter time.Duration) Response {
+	resp := GraphError(http.StatusBadRequest, code, 0, "Application request limit reached")
+	if retryAfter > 0 {
+		resp.Headers = map[string]string{"Retry-After": fmt.Sprintf("%d", int(retryAfter.Seconds()))}
+	}
+	return resp
+}
+
+// ServerError is a transient 5xx.
+func ServerError(status int) Response {
+	b, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message":      "An unexpected error has occurred. Please retry your request later.",
+			"type":         "OAuthException",
+			"code":         2,
+			"is_transient": true,
+			"fbtrace_id":   "fake_trace",
+		},
+	})
+	return Response{Status: status, Body: b}
+}
+
+// TokenExpired is an invalid/expired access token error (190).
+func TokenExpired() Response {
+	return GraphError(http.StatusUnauthorized, 190, 463, "Error validating access token: Session has expired.")
+}
+
+// Slow succeeds after delay.
+func Slow(delay time.Duration) Response {
+	return Response{Status: http.StatusOK, Delay: delay}
+}
+
+// ============================================
+// SCRIPTING OVER HTTP
+// ============================================
+
+// Outside Go (cmd/fakegraph), the fake is driven through:
+//
+//	POST /_fake/script    ScriptRule or [ScriptRule]
+//	GET  /_fake/requests  recorded requests (?endpoint= to filter)
+//	POST /_fake/reset     drop rules and requests
+
+const controlPrefix = "/_fake/"
+
+// ScriptRule is a Rule in JSON, e.g.
+//
+//	{"endpoint": "messages", "preset": "window_closed", "times": 2}
+//	{"endpoint": "replies", "status": 500, "body": {"error": {"code": 1}}}
+type ScriptRule struct {
+	Endpoint   string            `json:"endpoint"`
+	Times      int               `json:"times"`  // 0 = every call
+	Preset     string            `json:"preset"` // window_closed, throttled, server_error, token_expired, slow
+	Status     int               `json:"status"`
+	Code       int               `json:"code"` // throttled: 4 (default), 17, 32 or 613
+	Body       json.RawMessage   `json:"body"`
+	Headers    map[string]string `json:"headers"`
+	Delay      string            `json:"delay"`       // Go duration, e.g. "3s"
+	RetryAfter string            `json:"retry_after"` // throttled only
+}
+
+// Response builds the scripted Response.
+func (s ScriptRule) Response() (Response, error) {
+	var delay, retryAfter time.Duration
+	var err error
+	if s.Delay != "" {
+		if delay, err = time.ParseDuration(s.Delay); err != nil {
+			return Response{}, fmt.Errorf("invalid delay %q", s.Delay)
+		}
+	}
+	if s.RetryAfter != "" {
+		if retryAfter, err = time.ParseDuration(s.RetryAfter); err != nil {
+			return Response{}, fmt.Errorf("invalid retry_after %q", s.RetryAfter)
+		}
+	}
+
+	var resp Response
+	switch s.Preset {
+	case "":
+		resp = Response{Status: s.Status, Body: s.Body}
+	case "window_closed":
+		resp = WindowClosed()
+	case "throttled":
+		code := s.Code
+		if code == 0 {
+			code = 4
+		}
+		resp = Throttled(code, retryAfter)
+	case "server_error":
+		status := s.Status
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		resp = ServerError(status)
+	case "token_expired":
+		resp = TokenExpired()
+	case "slow":
+		resp = Slow(delay)
+	default:
+		return Response{}, fmt.Errorf("unknown preset %q", s.Preset)
+	}
+
+	if delay > 0 {
+		resp.Delay = delay
+	}
+	for k, v := range s.Headers {
+		if resp.Headers == nil {
+			resp.Headers = map[string]string{}
+		}
+		resp.Headers[k] = v
+	}
+	return resp, nil
+}
+
+// Script adds JSON rules, as On does.
+func (f *Fake) Script(rules []ScriptRule) error {
+	for _, sr := range rules {
+		switch sr.Endpoint {
+		case Messages, Media, MediaPublish, Replies, ContainerStatus, Me, RefreshToken, DebugToken:
+		default:
+			return fmt.Errorf("unknown endpoint %q", sr.Endpoint)
+		}
+
+		resp, err := sr.Response()
+		if err != nil {
+			return err
+		}
+		rule := f.On(sr.Endpoint, resp)
+		if sr.Times > 0 {
+			rule.Times(sr.Times)
+		}
+	}
+	return nil
+}
+
+func (f *Fake) serveControl(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == controlPrefix+"script" && r.Method == http.MethodPost:
+		body, _ := io.ReadAll(r.Body)
+		var rules []ScriptRule
+		if err := json.Unmarshal(body, &rules); err != nil {
+			var rule ScriptRule
+			if err := json.Unmarshal(body, &rule); err != nil {
+				http.Error(w, "Invalid script rule", http.StatusBadRequest)
+				return
+			}
+			rules = []ScriptRule{rule}
+		}
+		if err := f.Script(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.URL.Path == controlPrefix+"requests" && r.Method == http.MethodGet:
+		reqs := f.Requests()
+		if endpoint := r.URL.Query().Get("endpoint"); endpoint != "" {
+			reqs = f.RequestsTo(endpoint)
+		}
+		if reqs == nil {
+			reqs = []Request{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reqs)
+
+	case r.URL.Path == controlPrefix+"reset" && r.Method == http.MethodPost:
+		f.Reset()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ============================================
+// TEST SERVER
+// ============================================
+
+// Server is a Fake listening on a local port.
+type Server struct {
+	*Fake
+	URL string
+	ts  *httptest.Server
+}
+
+func NewServer() *Server {
+	f := New()
+	ts := httptest.NewServer(f)
+	return &Server{Fake: f, URL: ts.URL, ts: ts}
+}
+
+func (s *Server) Close() {
+	s.ts.Close()
+}
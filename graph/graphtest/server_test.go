@@ -0,0 +1,137 @@
+package graphtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		method, path string
+		endpoint, id string
+	}{
+		{"POST", "/v18.0/1784/messages", Messages, "1784"},
+		{"POST", "/1784/media", Media, "1784"},
+		{"POST", "/v21.0/1784/media_publish", MediaPublish, "1784"},
+		{"POST", "/v18.0/c1/replies", Replies, "c1"},
+		{"GET", "/v18.0/1790", ContainerStatus, "1790"},
+		{"GET", "/v18.0/me", Me, ""},
+		{"GET", "/v18.0/1784/messages", "", ""},
+		{"POST", "/v18.0/1784/likes", "", ""},
+		{"POST", "/", "", ""},
+	}
+
+	for _, tt := range tests {
+		endpoint, id := route(tt.method, tt.path)
+		if endpoint != tt.endpoint || id != tt.id {
+			t.Errorf("route(%s %s) = %q, %q; want %q, %q", tt.method, tt.path, endpoint, id, tt.endpoint, tt.id)
+		}
+	}
+}
+
+func TestScriptedResponses(t *testing.T) {
+	f := New()
+	f.On(Messages, WindowClosed()).Times(1)
+	f.On(Messages, Throttled(613, 30*time.Second)).Times(1)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v18.0/1784/messages", strings.NewReader(`{"message":{"text":"hi"}}`))
+		req.Header.Set("Authorization", "Bearer tok")
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send(); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "2534022") {
+		t.Errorf("first call: %d %s, want the window error", rec.Code, rec.Body)
+	}
+	if rec := send(); rec.Code != http.StatusBadRequest || rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("second call: %d with Retry-After %q, want throttled for 30s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := send(); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "message_id") {
+		t.Errorf("third call: %d %s, want success", rec.Code, rec.Body)
+	}
+
+	reqs := f.RequestsTo(Messages)
+	if len(reqs) != 3 {
+		t.Fatalf("recorded %d requests, want 3", len(reqs))
+	}
+	if reqs[0].Token != "tok" || string(reqs[0].Body) != `{"message":{"text":"hi"}}` || reqs[0].Status != http.StatusBadRequest {
+		t.Errorf("recorded %+v", reqs[0])
+	}
+
+	f.Reset()
+	if len(f.Requests()) != 0 {
+		t.Error("Reset kept recorded requests")
+	}
+}
+
+func TestScriptRuleResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   ScriptRule
+		status int
+		header string
+		delay  time.Duration
+		ok     bool
+	}{
+		{"window closed", ScriptRule{Preset: "window_closed"}, http.StatusBadRequest, "", 0, true},
+		{"throttled", ScriptRule{Preset: "throttled", RetryAfter: "1m"}, http.StatusBadRequest, "60", 0, true},
+		{"server error", ScriptRule{Preset: "server_error", Status: 503}, 503, "", 0, true},
+		{"token expired", ScriptRule{Preset: "token_expired"}, http.StatusUnauthorized, "", 0, true},
+		{"slow", ScriptRule{Preset: "slow", Delay: "3s"}, http.StatusOK, "", 3 * time.Second, true},
+		{"raw", ScriptRule{Status: 500, Body: []byte(`{"error":{"code":1}}`)}, 500, "", 0, true},
+		{"unknown preset", ScriptRule{Preset: "flaky"}, 0, "", 0, false},
+		{"bad delay", ScriptRule{Preset: "slow", Delay: "soon"}, 0, "", 0, false},
+	}
+
+	for _, tt := range tests {
+		resp, err := tt.rule.Response()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tt.name, err, tt.ok)
+			continue
+		}
+		if resp.Status != tt.status || resp.Headers["Retry-After"] != tt.header || resp.Delay != tt.delay {
+			t.Errorf("%s: got %d / %q / %v, want %d / %q / %v",
+				tt.name, resp.Status, resp.Headers["Retry-After"], resp.Delay, tt.status, tt.header, tt.delay)
+		}
+	}
+}
+
+func TestControlEndpoints(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/_fake/script", "application/json",
+		strings.NewReader(`{"endpoint": "replies", "preset": "server_error", "times": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("script: got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(srv.URL+"/_fake/script", "application/json", strings.NewReader(`[{"endpoint": "likes"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown endpoint: got %d, want 400", resp.StatusCode)
+	}
+
+	for _, want := range []int{http.StatusInternalServerError, http.StatusOK} {
+		resp, err := http.Post(srv.URL+"/v18.0/c1/replies", "application/json", strings.NewReader(`{"message":"hi"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("reply: got %d, want %d", resp.StatusCode, want)
+		}
+	}
+}
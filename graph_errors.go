@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"instagram-autodm/graph"
+)
+
+// ============================================
+// GRAPH API RETRY POLICY
+// ============================================
+
+// Errors are parsed and classified by the graph package (graph.Error); this
+// is what the DM, reply and flow senders do with them.
+
+// retryDelay decides whether a failed send should be retried and after how
+// long. Errors that aren't Graph API errors (network failures) are retried.
+func retryDelay(err error, attempt int) (time.Duration, bool) {
+	if attempt > config.MaxRetries {
+		return 0, false
+	}
+
+	backoff := config.RetryBackoffBase * time.Duration(1<<uint(attempt-1))
+
+	var ge *graph.Error
+	if !errors.As(err, &ge) {
+		return backoff, true
+	}
+	if !ge.Retryable() {
+		return 0, false
+	}
+	if ge.Kind == graph.ErrRateLimited && ge.RetryAfter > backoff {
+		return ge.RetryAfter, true
+	}
+
+	return backoff, true
+}
+
+// markAccountNeedsReauth flags the IG account whose token was rejected so the
+// dashboard can ask the creator to reconnect it, and alerts the first time.
+// The env account has no row; it's alerted once until its token is refreshed.
+func markAccountNeedsReauth(igAccountID string, cause error) {
+	log.Printf("🔑 Access token for IG account %s rejected, marking needs_reauth: %v", igAccountID, cause)
+
+	var username string
+	err := db.QueryRow(`
+		UPDATE tbl_ig_accounts
+		SET status = 'needs_reauth', updated_at = CURRENT_TIMESTAMP
+		WHERE platform_ig_account_id = $1 AND status IS DISTINCT FROM 'needs_reauth'
+		RETURNING COALESCE(username, '')
+	`, igAccountID).Scan(&username)
+
+	switch {
+	case err == nil:
+	case err == sql.ErrNoRows:
+		// Already flagged, or the env account
+		if igAccountID != config.IGBusinessID || !atomic.CompareAndSwapInt32(&envTokenAlerted, 0, 1) {
+			return
+		}
+	default:
+		log.Println("❌ Account status update error:", err)
+		return
+	}
+
+	sendAlert("account_needs_reauth", map[string]interface{}{
+		"ig_account_id": igAccountID,
+		"username":      username,
+		"error":         cause.Error(),
+	})
+}
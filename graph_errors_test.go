@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"instagram-autodm/graph"
+)
+
+func TestRetryDelay(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config.MaxRetries = 3
+	config.RetryBackoffBase = 2 * time.Second
+
+	tests := []struct {
+		name    string
+		err     error
+		attempt int
+		want    time.Duration
+		retry   bool
+	}{
+		{"network error", errors.New("connection reset"), 1, 2 * time.Second, true},
+		{"backoff doubles", errors.New("connection reset"), 3, 8 * time.Second, true},
+		{"out of attempts", errors.New("connection reset"), 4, 0, false},
+		{"transient", &graph.Error{Kind: graph.ErrTransient}, 2, 4 * time.Second, true},
+		{"throttled, Retry-After wins", &graph.Error{Kind: graph.ErrRateLimited, RetryAfter: time.Minute}, 1, time.Minute, true},
+		{"throttled, backoff wins", &graph.Error{Kind: graph.ErrRateLimited, RetryAfter: time.Second}, 2, 4 * time.Second, true},
+		{"auth", &graph.Error{Kind: graph.ErrAuth}, 1, 0, false},
+		{"messaging window", &graph.Error{Kind: graph.ErrMessagingWindow}, 1, 0, false},
+		{"invalid request", &graph.Error{Kind: graph.ErrInvalidRequest}, 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, retry := retryDelay(tt.err, tt.attempt)
+		if got != tt.want || retry != tt.retry {
+			t.Errorf("%s: retryDelay = %v, %v; want %v, %v", tt.name, got, retry, tt.want, tt.retry)
+		}
+	}
+}
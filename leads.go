@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ============================================
+// LEAD CAPTURE
+// ============================================
+
+// A lead_capture flow node asks for an email address and/or phone number,
+// validates the answer and stores it in tbl_leads against the account, the
+// commenter, the post and the DM template that started the flow.
+
+// What a lead_capture node asks for
+const (
+	LeadEmail        = "email"
+	LeadPhone        = "phone"
+	LeadEmailOrPhone = "email_or_phone"
+)
+
+const (
+	defaultLeadConfirmText = "Thanks, got it! ✅"
+	defaultLeadInvalidText = "Hmm, that doesn't look right. Could you send it again?"
+	// Sent when a valid answer couldn't be stored
+	leadRetryText = "Sorry, we couldn't save that just now. Could you send it again?"
+)
+
+var (
+	leadEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	leadPhonePattern = regexp.MustCompile(`\+?\d[\d\s().\-]{5,}\d`)
+)
+
+type Lead struct {
+	ID         int       `json:"id"`
+	UserID     string    `json:"user_id"`
+	Username   string    `json:"username"`
+	PostID     string    `json:"post_id"`
+	TemplateID int       `json:"template_id,omitempty"`
+	FlowID     int       `json:"flow_id,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	Phone      string    `json:"phone,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// parseLead finds an email or phone number (per capture) in a reply like
+// "sure, it's jane@example.com". Phone numbers are normalized to digits with
+// an optional leading +.
+func parseLead(capture, text string) (email, phone string, ok bool) {
+	if capture != LeadPhone {
+		if m := leadEmailPattern.FindString(text); m != "" {
+			return strings.ToLower(m), "", true
+		}
+	}
+
+	if capture == LeadPhone || capture == LeadEmailOrPhone {
+		if m := leadPhonePattern.FindString(text); m != "" {
+			digits := strings.Map(func(r rune) rune {
+				if r >= '0' && r <= '9' {
+					return r
+				}
+				return -1
+			}, m)
+			// E.164 allows at most 15 digits
+			if len(digits) >= 7 && len(digits) <= 15 {
+				if strings.HasPrefix(m, "+") {
+					digits = "+" + digits
+				}
+				return "", digits, true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// handleLeadReply validates the answer to a lead_capture node. A valid answer
+// is stored and confirmed and the flow moves on; anything else, or an answer
+// that couldn't be stored, is re-asked.
+func handleLeadReply(s *FlowSession, node FlowNode, def FlowDefinition, text string) {
+	creds, logSimulated, err := flowCredentials(s)
+	if err != nil {
+		finishFlowStep(s, err)
+		return
+	}
+	defer logSimulated()
+	recipient := Recipient{ID: s.UserID}
+
+	capture := node.Capture
+	if capture == "" {
+		capture = LeadEmail
+	}
+
+	reask := func(reply string) {
+		if err := deliverMessage(creds, recipient, s.UserID, OutboundMessage{Text: s.render(reply)}); err != nil {
+			log.Printf("❌ Failed to re-ask %s for their %s: %v", s.UserID, capture, err)
+		}
+		s.Status = flowWaitingReply
+		saveFlowSession(s)
+	}
+
+	email, phone, ok := parseLead(capture, text)
+	if !ok {
+		log.Printf("📇 Invalid %s from %s: %q", capture, s.UserID, text)
+		reply := node.InvalidText
+		if reply == "" {
+			reply = defaultLeadInvalidText
+		}
+		reask(reply)
+		return
+	}
+
+	if err := storeLead(s, email, phone); err != nil {
+		log.Printf("❌ Failed to store lead for %s, asking again: %v", s.UserID, err)
+		reask(leadRetryText)
+		return
+	}
+	log.Printf("📇 Lead captured for @%s (account %s, post %s)", s.Username, s.AccountID, s.PostID)
+
+	confirm := node.ConfirmText
+	if confirm == "" {
+		confirm = defaultLeadConfirmText
+	}
+	if err := deliverMessage(creds, recipient, s.UserID, OutboundMessage{Text: s.render(confirm)}); err != nil {
+		finishFlowStep(s, err)
+		return
+	}
+
+	s.NodeID = node.Next
+	_, err = runFlow(s, def, creds, recipient)
+	finishFlowStep(s, err)
+}
+
+// storeLead upserts the lead for the session's user and post, keeping an
+// email or phone captured earlier when only the other one is given.
+func storeLead(s *FlowSession, email, phone string) error {
+	_, err := db.Exec(`
+		INSERT INTO tbl_leads (ig_account_id, user_id, username, post_id, template_id, flow_id, email, phone)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, 0), NULLIF($7, ''), NULLIF($8, ''))
+		ON CONFLICT (ig_account_id, user_id, post_id) DO UPDATE SET
+			username = EXCLUDED.username,
+			template_id = COALESCE(EXCLUDED.template_id, tbl_leads.template_id),
+			flow_id = EXCLUDED.flow_id,
+			email = COALESCE(EXCLUDED.email, tbl_leads.email),
+			phone = COALESCE(EXCLUDED.phone, tbl_leads.phone),
+			updated_at = NOW()
+	`, s.AccountID, s.UserID, s.Username, s.PostID, s.TemplateID, s.FlowID, email, phone)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+
+	return nil
+}
+
+// ============================================
+// LEAD EXPORT
+// ============================================
+
+// Export leads as CSV (default) or NDJSON
+// Filters: since, until (RFC3339 or YYYY-MM-DD; a date-only until includes that day)
+func exportLeadsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		http.Error(w, "format must be csv or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	var since, until time.Time
+	for _, f := range []struct {
+		param string
+		dst   *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		v := q.Get(f.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse("2006-01-02", v); err != nil {
+				http.Error(w, "Invalid "+f.param+" (use RFC3339 or YYYY-MM-DD)", http.StatusBadRequest)
+				return
+			}
+			if f.param == "until" {
+				t = t.Add(24 * time.Hour)
+			}
+		}
+		*f.dst = t
+	}
+
+	leads, err := listLeads(accountID, since, until)
+	if err != nil {
+		log.Printf("Failed to export leads: %v", err)
+		http.Error(w, "Failed to export leads", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("leads-%s.%s", accountID, format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, l := range leads {
+			enc.Encode(l)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "user_id", "username", "post_id", "template_id", "flow_id", "email", "phone", "created_at", "updated_at"})
+	for _, l := range leads {
+		cw.Write([]string{
+			strconv.Itoa(l.ID), l.UserID, l.Username, l.PostID,
+			optionalID(l.TemplateID), optionalID(l.FlowID), l.Email, l.Phone,
+			l.CreatedAt.Format(time.RFC3339), l.UpdatedAt.Format(time.RFC3339),
+		})
+	}
+	cw.Flush()
+}
+
+func optionalID(id int) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.Itoa(id)
+}
+
+// listLeads returns the account's leads oldest first. Zero times mean no bound.
+func listLeads(accountID string, since, until time.Time) ([]Lead, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, COALESCE(username, ''), post_id, COALESCE(template_id, 0), COALESCE(flow_id, 0),
+		       COALESCE(email, ''), COALESCE(phone, ''), created_at, updated_at
+		FROM tbl_leads
+		WHERE ig_account_id = $1
+		  AND ($2 OR created_at >= $3::timestamptz)
+		  AND ($4 OR created_at < $5::timestamptz)
+		ORDER BY created_at, id
+	`, accountID, since.IsZero(), since, until.IsZero(), until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leads := []Lead{}
+	for rows.Next() {
+		var l Lead
+		if err := rows.Scan(&l.ID, &l.UserID, &l.Username, &l.PostID, &l.TemplateID, &l.FlowID,
+			&l.Email, &l.Phone, &l.CreatedAt, &l.UpdatedAt); err != nil {
+			return nil, err
+		}
+		leads = append(leads, l)
+	}
+
+	return leads, rows.Err()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"instagram-autodm/graph/graphtest"
+)
+
+func TestParseLead(t *testing.T) {
+	tests := []struct {
+		capture, text string
+		email, phone  string
+		ok            bool
+	}{
+		{LeadEmail, "sure, it's Jane.Doe@Example.com!", "jane.doe@example.com", "", true},
+		{LeadEmail, "call me at +1 555 010 9999", "", "", false},
+		{LeadPhone, "+1 (555) 010-9999", "", "+15550109999", true},
+		{LeadPhone, "555.010.9999 thanks", "", "5550109999", true},
+		{LeadPhone, "jane@example.com", "", "", false},
+		{LeadPhone, "12345", "", "", false},
+		{LeadPhone, "+1234567890123456789", "", "", false},
+		{LeadEmailOrPhone, "jane@example.com or 5550109999", "jane@example.com", "", true},
+		{LeadEmailOrPhone, "0044 20 7946 0958", "", "00442079460958", true},
+		{LeadEmailOrPhone, "no thanks", "", "", false},
+	}
+
+	for _, tt := range tests {
+		email, phone, ok := parseLead(tt.capture, tt.text)
+		if email != tt.email || phone != tt.phone || ok != tt.ok {
+			t.Errorf("parseLead(%s, %q) = %q, %q, %v; want %q, %q, %v",
+				tt.capture, tt.text, email, phone, ok, tt.email, tt.phone, tt.ok)
+		}
+	}
+}
+
+func TestStoreLeadKeepsEarlierContact(t *testing.T) {
+	setupTestDB(t)
+	if _, err := db.Exec("INSERT INTO tbl_ig_accounts (platform_ig_account_id, access_token) VALUES ('17841400000000001', 'tok')"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &FlowSession{AccountID: "1", UserID: "42", Username: "jane", PostID: "17900000000000001"}
+	if err := storeLead(s, "jane@example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeLead(s, "", "+15550109999"); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	var email, phone string
+	err := db.QueryRow(`
+		SELECT COUNT(*) OVER (), COALESCE(email, ''), COALESCE(phone, '') FROM tbl_leads
+	`).Scan(&count, &email, &phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || email != "jane@example.com" || phone != "+15550109999" {
+		t.Errorf("got %d lead(s) with %q / %q, want one with both", count, email, phone)
+	}
+}
+
+func TestLeadCaptureReply(t *testing.T) {
+	srv := setupQueueTest(t)
+	accountID := insertTestAccount(t, modeLive)
+
+	node := FlowNode{Type: FlowNodeLeadCapture, Text: "Your email?", Capture: LeadEmail, InvalidText: "Not an email"}
+	def := FlowDefinition{Start: "lead", Nodes: map[string]FlowNode{"lead": node}}
+	flowID, err := createFlow(accountID, Flow{Name: "leads", Definition: def, IsActive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := func(flowID int) *FlowSession {
+		return &FlowSession{AccountID: accountID, FlowID: flowID, UserID: "42", Username: "jane", PostID: "17900000000000001", NodeID: "lead"}
+	}
+
+	tests := []struct {
+		name   string
+		flowID int
+		text   string
+		reply  string
+		status string
+		stored bool
+	}{
+		{"invalid answer", flowID, "no thanks", "Not an email", flowWaitingReply, false},
+		// The flow is gone, so the lead row can't reference it
+		{"not stored", 999, "jane@example.com", leadRetryText, flowWaitingReply, false},
+		{"stored", flowID, "jane@example.com", defaultLeadConfirmText, flowCompleted, true},
+	}
+
+	for _, tt := range tests {
+		srv.Reset()
+		s := session(tt.flowID)
+		handleLeadReply(s, node, def, tt.text)
+
+		reqs := srv.RequestsTo(graphtest.Messages)
+		if len(reqs) != 1 || !strings.Contains(string(reqs[0].Body), tt.reply) {
+			t.Errorf("%s: sent %+v, want %q", tt.name, reqs, tt.reply)
+		}
+		if s.Status != tt.status {
+			t.Errorf("%s: session %s, want %s", tt.name, s.Status, tt.status)
+		}
+		var leads int
+		db.QueryRow("SELECT COUNT(*) FROM tbl_leads WHERE ig_account_id = $1", accountID).Scan(&leads)
+		if (leads == 1) != tt.stored {
+			t.Errorf("%s: %d lead(s) stored, want stored=%v", tt.name, leads, tt.stored)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ============================================
+// CLICK-TRACKED LINKS
+// ============================================
+
+// When PUBLIC_BASE_URL is set, every link in an outgoing DM (template text,
+// flow messages, product card buttons) is replaced by PUBLIC_BASE_URL/l/<code>.
+// Codes are per recipient, so a click can be tied to the account, template,
+// post and user before we redirect to the real URL.
+
+const shortCodeLength = 8
+
+const shortCodeAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// Link preview fetchers open every URL in a DM; their hits aren't clicks
+var linkPreviewAgents = []string{"facebookexternalhit", "Facebot", "Instagram-Preview"}
+
+// Who a tracked link was sent to
+type LinkContext struct {
+	AccountID  string // "" for the env-configured account
+	TemplateID int
+	PostID     string
+	UserID     string
+}
+
+func jobLinkContext(job DMJob) LinkContext {
+	return LinkContext{AccountID: job.AccountID, TemplateID: job.TemplateID, PostID: job.PostID, UserID: job.UserID}
+}
+
+// trackMessageLinks rewrites the links in msg's text and URL buttons.
+func trackMessageLinks(msg *OutboundMessage, ctx LinkContext) {
+	if config.PublicBaseURL == "" {
+		return
+	}
+
+	msg.Text = trackLinks(msg.Text, ctx)
+	if msg.Attachment == nil {
+		return
+	}
+
+	payload := &msg.Attachment.Payload
+	payload.Text = trackLinks(payload.Text, ctx)
+	trackButtonLinks(payload.Buttons, ctx)
+	for i := range payload.Elements {
+		trackButtonLinks(payload.Elements[i].Buttons, ctx)
+	}
+}
+
+func trackButtonLinks(buttons []Button, ctx LinkContext) {
+	for i := range buttons {
+		if buttons[i].URL != "" {
+			buttons[i].URL = trackURL(buttons[i].URL, ctx)
+		}
+	}
+}
+
+// trackLinks replaces each URL in text with its short link. Punctuation
+// ending a sentence ("see https://x.com/a.") stays outside the link.
+func trackLinks(text string, ctx LinkContext) string {
+	return linkPattern.ReplaceAllStringFunc(text, func(m string) string {
+		target := strings.TrimRight(m, ".,!?;:)")
+		return trackURL(target, ctx) + m[len(target):]
+	})
+}
+
+// trackURL returns the short link for target, or target itself if it is
+// already ours or the link can't be stored.
+func trackURL(target string, ctx LinkContext) string {
+	if strings.HasPrefix(target, config.PublicBaseURL+"/") {
+		return target
+	}
+
+	code, err := shortLinkCode(target, ctx)
+	if err != nil {
+		log.Printf("⚠️ Failed to create short link for %s: %v", target, err)
+		return target
+	}
+
+	return config.PublicBaseURL + "/l/" + code
+}
+
+// shortLinkCode reuses the code already issued for this recipient, post and
+// URL, so a retried job sends the same link.
+func shortLinkCode(target string, ctx LinkContext) (string, error) {
+	code, err := newShortCode()
+	if err != nil {
+		return "", err
+	}
+
+	err = db.QueryRow(`
+		INSERT INTO tbl_short_links (code, ig_account_id, template_id, post_id, user_id, target_url)
+		VALUES ($1, NULLIF($2, '')::integer, NULLIF($3, 0), $4, $5, $6)
+		ON CONFLICT (user_id, post_id, target_url) DO UPDATE SET target_url = EXCLUDED.target_url
+		RETURNING code
+	`, code, ctx.AccountID, ctx.TemplateID, ctx.PostID, ctx.UserID, target).Scan(&code)
+
+	return code, err
+}
+
+func newShortCode() (string, error) {
+	max := big.NewInt(int64(len(shortCodeAlphabet)))
+	b := make([]byte, shortCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = shortCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// Short link redirect
+func shortLinkHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	code := p.ByName("code")
+
+	var target string
+	err := db.QueryRow("SELECT target_url FROM tbl_short_links WHERE code = $1", code).Scan(&target)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up short link %s: %v", code, err)
+		http.Error(w, "Failed to resolve link", http.StatusInternalServerError)
+		return
+	}
+
+	if !isLinkPreview(r.UserAgent()) {
+		recordClick(code, r.UserAgent())
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func isLinkPreview(userAgent string) bool {
+	for _, agent := range linkPreviewAgents {
+		if strings.Contains(userAgent, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+func recordClick(code, userAgent string) {
+	_, err := db.Exec(`
+		INSERT INTO tbl_link_clicks (code, ig_account_id, template_id, post_id, user_id, user_agent)
+		SELECT code, ig_account_id, template_id, post_id, user_id, $2
+		FROM tbl_short_links
+		WHERE code = $1
+	`, code, userAgent)
+
+	if err != nil {
+		log.Println("❌ Link click log error:", err)
+	}
+}
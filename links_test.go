@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func setPublicBaseURL(t *testing.T, url string) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config.PublicBaseURL = url
+}
+
+// Links already pointing at PUBLIC_BASE_URL are left alone, which lets the
+// URL matching and punctuation handling be checked without a database.
+func TestTrackLinksKeepsOwnLinks(t *testing.T) {
+	setPublicBaseURL(t, "https://go.example")
+
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"no links", "Thanks for commenting!"},
+		{"own link", "Here: https://go.example/l/abcd2345"},
+		{"sentence end", "See https://go.example/l/abcd2345."},
+		{"trailing punctuation", "Really? https://go.example/l/abcd2345?!"},
+		{"in parentheses", "(https://go.example/l/abcd2345)"},
+		{"two links", "https://go.example/a, https://go.example/b;"},
+	}
+
+	for _, tt := range tests {
+		if got := trackLinks(tt.text, LinkContext{}); got != tt.text {
+			t.Errorf("%s: got %q, want it unchanged", tt.name, got)
+		}
+	}
+}
+
+func TestIsLinkPreview(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      bool
+	}{
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"Mozilla/5.0 (compatible; Facebot)", true},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Instagram 300.0", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isLinkPreview(tt.userAgent); got != tt.want {
+			t.Errorf("isLinkPreview(%q) = %v, want %v", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestTrackLinks(t *testing.T) {
+	setupTestDB(t)
+	setPublicBaseURL(t, "https://go.example")
+
+	ctx := LinkContext{PostID: "17900000000000001", UserID: "42"}
+	short := `https://go\.example/l/[a-zA-Z0-9]{8}`
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "Get it: https://shop.example/p", "^Get it: " + short + "$"},
+		{"sentence end", "See https://shop.example/p.", "^See " + short + `\.$`},
+		{"in parentheses", "(https://shop.example/p?ref=dm)!", `^\(` + short + `\)!$`},
+		{"query kept in target", "https://shop.example/p?a=1&b=2", "^" + short + "$"},
+	}
+
+	for _, tt := range tests {
+		got := trackLinks(tt.text, ctx)
+		if !regexp.MustCompile(tt.want).MatchString(got) {
+			t.Errorf("%s: got %q, want match for %s", tt.name, got, tt.want)
+		}
+	}
+
+	var targets int
+	db.QueryRow("SELECT COUNT(DISTINCT target_url) FROM tbl_short_links").Scan(&targets)
+	if targets != 3 {
+		t.Errorf("stored %d target URLs, want 3", targets)
+	}
+
+	// A retried job sends the same link
+	first := trackLinks("https://shop.example/p", ctx)
+	if again := trackLinks("https://shop.example/p", ctx); again != first {
+		t.Errorf("retry got %q, want %q", again, first)
+	}
+}
+
+func TestShortLinkHandler(t *testing.T) {
+	setupTestDB(t)
+	setPublicBaseURL(t, "https://go.example")
+
+	link := trackLinks("https://shop.example/p", LinkContext{PostID: "17900000000000001", UserID: "42"})
+	code := link[len("https://go.example/l/"):]
+
+	router := httprouter.New()
+	router.GET("/l/:code", shortLinkHandler)
+
+	for _, userAgent := range []string{"Mozilla/5.0", "facebookexternalhit/1.1"} {
+		req := httptest.NewRequest("GET", "/l/"+code, nil)
+		req.Header.Set("User-Agent", userAgent)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://shop.example/p" {
+			t.Errorf("%s: got %d to %q", userAgent, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+	var clicks int
+	db.QueryRow("SELECT COUNT(*) FROM tbl_link_clicks WHERE code = $1", code).Scan(&clicks)
+	if clicks != 1 {
+		t.Errorf("recorded %d clicks, want 1 (previews don't count)", clicks)
+	}
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/l/nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown code: got %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ============================================
+// INSTAGRAM LIVE
+// ============================================
+
+// Comments on a live broadcast arrive as live_comments changes whose media id
+// is the broadcast. They are stored in tbl_live_chat_messages, matched against
+// the account's triggers like post comments, and answered after LIVE_DM_DELAY
+// (default immediately) so the DM lands while the stream is still running.
+
+type BroadcastSummary struct {
+	BroadcastID   string         `json:"broadcast_id"`
+	StartedAt     time.Time      `json:"started_at"`
+	LastMessageAt time.Time      `json:"last_message_at"`
+	Messages      int            `json:"messages"`
+	Participants  int            `json:"participants"`
+	KeywordHits   int            `json:"keyword_hits"`
+	HitsByTrigger map[string]int `json:"hits_by_trigger"`
+	DMsQueued     int            `json:"dms_queued"`
+	DMsSent       int            `json:"dms_sent"`
+	DMsFailed     int            `json:"dms_failed"`
+}
+
+func processLiveComment(accountID string, c CommentData) {
+	if accountID == "" {
+		log.Printf("Live comment from @%s ignored: account is not connected", c.From.Username)
+		return
+	}
+
+	log.Printf("🔴 Live comment from @%s on broadcast %s: %s", c.From.Username, c.MediaID, c.Text)
+
+	userRowID, err := storeCommenter(accountID, c.From)
+	if err != nil {
+		log.Printf("❌ Failed to store live participant %s: %v", c.From.ID, err)
+		return
+	}
+
+	res, err := db.Exec(`
+		INSERT INTO tbl_live_chat_messages (ig_account_id, broadcast_id, platform_message_id, ig_user_id, text)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+		ON CONFLICT (platform_message_id) DO NOTHING
+	`, accountID, c.MediaID, c.ID, userRowID, c.Text)
+	if err != nil {
+		log.Printf("❌ Failed to store live comment %s: %v", c.ID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Redelivery of a message we already handled
+		return
+	}
+
+	trigger, queued := queueTriggeredDM(accountID, c, config.LiveDMDelay)
+	if trigger == nil {
+		return
+	}
+
+	keyword := trigger.Name
+	if keyword == "" {
+		keyword = trigger.Pattern
+	}
+
+	_, err = db.Exec(`
+		UPDATE tbl_live_chat_messages
+		SET trigger_id = NULLIF($2, 0), matched_keyword = $3, dm_queued = $4
+		WHERE platform_message_id = $1
+	`, c.ID, trigger.ID, keyword, queued)
+	if err != nil {
+		log.Printf("❌ Failed to update live comment %s: %v", c.ID, err)
+	}
+}
+
+// List broadcasts
+func listBroadcastsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT broadcast_id, MIN(created_at), MAX(created_at), COUNT(*)
+		FROM tbl_live_chat_messages
+		WHERE ig_account_id = $1 AND broadcast_id IS NOT NULL
+		GROUP BY broadcast_id
+		ORDER BY MAX(created_at) DESC
+		LIMIT 50
+	`, accountID)
+	if err != nil {
+		log.Printf("Failed to list broadcasts: %v", err)
+		http.Error(w, "Failed to list broadcasts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type broadcast struct {
+		BroadcastID   string    `json:"broadcast_id"`
+		StartedAt     time.Time `json:"started_at"`
+		LastMessageAt time.Time `json:"last_message_at"`
+		Messages      int       `json:"messages"`
+	}
+	broadcasts := []broadcast{}
+	for rows.Next() {
+		var b broadcast
+		if err := rows.Scan(&b.BroadcastID, &b.StartedAt, &b.LastMessageAt, &b.Messages); err != nil {
+			http.Error(w, "Failed to list broadcasts", http.StatusInternalServerError)
+			return
+		}
+		broadcasts = append(broadcasts, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"broadcasts": broadcasts,
+	})
+}
+
+// Broadcast Summary
+func broadcastSummaryHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	broadcastID := p.ByName("broadcast_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	summary, err := getBroadcastSummary(accountID, broadcastID)
+	if err != nil {
+		log.Printf("Failed to build broadcast summary: %v", err)
+		http.Error(w, "Failed to build broadcast summary", http.StatusInternalServerError)
+		return
+	}
+	if summary.Messages == 0 {
+		http.Error(w, "Broadcast not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+func getBroadcastSummary(accountID, broadcastID string) (*BroadcastSummary, error) {
+	s := &BroadcastSummary{BroadcastID: broadcastID, HitsByTrigger: map[string]int{}}
+
+	err := db.QueryRow(`
+		SELECT COUNT(*), COUNT(DISTINCT ig_user_id), COUNT(matched_keyword),
+		       COUNT(*) FILTER (WHERE dm_queued),
+		       COALESCE(MIN(created_at), NOW()), COALESCE(MAX(created_at), NOW())
+		FROM tbl_live_chat_messages
+		WHERE ig_account_id = $1 AND broadcast_id = $2
+	`, accountID, broadcastID).Scan(&s.Messages, &s.Participants, &s.KeywordHits,
+		&s.DMsQueued, &s.StartedAt, &s.LastMessageAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT matched_keyword, COUNT(*)
+		FROM tbl_live_chat_messages
+		WHERE ig_account_id = $1 AND broadcast_id = $2 AND matched_keyword IS NOT NULL
+		GROUP BY matched_keyword
+	`, accountID, broadcastID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var hits int
+		if err := rows.Scan(&name, &hits); err != nil {
+			return nil, err
+		}
+		s.HitsByTrigger[name] = hits
+	}
+
+	err = db.QueryRow(`
+		SELECT COUNT(*) FILTER (WHERE status = $3), COUNT(*) FILTER (WHERE status = $4)
+		FROM dm_jobs
+		WHERE ig_account_id = $1 AND post_id = $2
+	`, accountID, broadcastID, jobSent, jobDead).Scan(&s.DMsSent, &s.DMsFailed)
+
+	return s, err
+}
@@ -1,20 +1,23 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/julienschmidt/httprouter"
 	_ "github.com/lib/pq"
+
+	"instagram-autodm/graph"
 )
 
 // CONFIG STRUCT
@@ -23,10 +26,33 @@ type Config struct {
 	DatabaseURL      string
 	VerifyToken      string
 	AccessToken      string
+	AppSecrets       []string
+	AllowUnsigned    bool // accept unsigned webhooks when APP_SECRET is unset
 	IGBusinessID     string
+	SendMode         string // mode of the env-configured account
+	GraphBaseURL     string
+	GraphVersion     string
+	GraphDebugURL    string // host for debug_token
+	MetaAppID        string // with APP_SECRET, lets us read token expiry from debug_token
+	RefreshBefore    time.Duration
+	AlertWebhookURL  string
 	Keywords         []string
 	DMMessage        string
 	DMDelay          time.Duration
+	LiveDMDelay      time.Duration
+	ParkedDMTTL      time.Duration
+	PublicBaseURL    string // where /l/:code short links are served, "" disables click tracking
+	DownloadSecret   string // HMAC key for /d/ download links
+	DownloadTTL      time.Duration
+	DownloadMaxCount int
+	StorageBackend   string // "local" or "s3"
+	StorageDir       string
+	S3Endpoint       string
+	S3Bucket         string
+	S3Region         string
+	S3AccessKey      string
+	S3SecretKey      string
+	Workers          int
 	MaxRetries       int
 	RetryBackoffBase time.Duration
 }
@@ -35,15 +61,43 @@ type Config struct {
 type WebhookPayload struct {
 	Object string `json:"object"`
 	Entry  []struct {
-		ID      string   `json:"id"`
-		Time    int64    `json:"time"`
-		Changes []Change `json:"changes"`
+		ID        string           `json:"id"`
+		Time      int64            `json:"time"`
+		Changes   []Change         `json:"changes"`
+		Messaging []MessagingEvent `json:"messaging"`
 	} `json:"entry"`
 }
 
+// Value is decoded according to Field (CommentData for comments and
+// live_comments, MessagingEvent for messages and messaging_postbacks)
 type Change struct {
-	Field string      `json:"field"`
-	Value CommentData `json:"value"`
+	Field string          `json:"field"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Inbound DM (or an echo of one we sent) or postback
+type MessagingEvent struct {
+	Sender struct {
+		ID string `json:"id"`
+	} `json:"sender"`
+	Recipient struct {
+		ID string `json:"id"`
+	} `json:"recipient"`
+	Timestamp int64 `json:"timestamp"`
+	Message   *struct {
+		Mid        string `json:"mid"`
+		Text       string `json:"text"`
+		IsEcho     bool   `json:"is_echo"`
+		QuickReply *struct {
+			Payload string `json:"payload"`
+		} `json:"quick_reply,omitempty"`
+	} `json:"message,omitempty"`
+	// Tap on a postback button
+	Postback *struct {
+		Mid     string `json:"mid"`
+		Title   string `json:"title"`
+		Payload string `json:"payload"`
+	} `json:"postback,omitempty"`
 }
 
 type CommentData struct {
@@ -52,6 +106,19 @@ type CommentData struct {
 	Text     string `json:"text"`
 	From     User   `json:"from"`
 	ParentID string `json:"parent_id,omitempty"`
+	Media    struct {
+		ID               string `json:"id"`
+		MediaProductType string `json:"media_product_type"`
+	} `json:"media"`
+}
+
+// normalized fills MediaID from the nested media object, which is how
+// live_comments (and newer comments) payloads identify the media.
+func (c CommentData) normalized() CommentData {
+	if c.MediaID == "" {
+		c.MediaID = c.Media.ID
+	}
+	return c
 }
 
 type User struct {
@@ -59,6 +126,76 @@ type User struct {
 	Username string `json:"username"`
 }
 
+// MESSAGE RECIPIENT
+// Exactly one of ID or CommentID is set. A CommentID recipient sends a
+// Private Reply to that comment, which Meta allows once per comment within
+// privateReplyWindow of it being posted, even if the commenter never
+// messaged us.
+type Recipient struct {
+	ID        string `json:"id,omitempty"`
+	CommentID string `json:"comment_id,omitempty"`
+}
+
+const privateReplyWindow = 7 * 24 * time.Hour
+
+// OUTBOUND MESSAGE
+// Plain text, optionally with quick replies, or a template attachment
+// (button template for postback / URL buttons).
+type OutboundMessage struct {
+	Text         string       `json:"text,omitempty"`
+	QuickReplies []QuickReply `json:"quick_replies,omitempty"`
+	Attachment   *Attachment  `json:"attachment,omitempty"`
+}
+
+type QuickReply struct {
+	ContentType string `json:"content_type"`
+	Title       string `json:"title"`
+	Payload     string `json:"payload"`
+}
+
+type Attachment struct {
+	Type    string          `json:"type"`
+	Payload TemplatePayload `json:"payload"`
+}
+
+type TemplatePayload struct {
+	TemplateType string           `json:"template_type"`
+	Text         string           `json:"text,omitempty"`
+	Buttons      []Button         `json:"buttons,omitempty"`
+	Elements     []GenericElement `json:"elements,omitempty"`
+}
+
+// One card of a generic template; several make a carousel
+type GenericElement struct {
+	Title    string   `json:"title"`
+	Subtitle string   `json:"subtitle,omitempty"`
+	ImageURL string   `json:"image_url,omitempty"`
+	Buttons  []Button `json:"buttons,omitempty"`
+}
+
+type Button struct {
+	Type    string `json:"type"` // "postback" or "web_url"
+	Title   string `json:"title"`
+	URL     string `json:"url,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// summary is the text kept in the conversation history.
+func (m OutboundMessage) summary() string {
+	if m.Text != "" || m.Attachment == nil {
+		return m.Text
+	}
+	if m.Attachment.Payload.Text != "" {
+		return m.Attachment.Payload.Text
+	}
+
+	var titles []string
+	for _, e := range m.Attachment.Payload.Elements {
+		titles = append(titles, e.Title)
+	}
+	return "[cards] " + strings.Join(titles, ", ")
+}
+
 // DATABASE MODEL
 type DMLog struct {
 	ID         int
@@ -70,21 +207,29 @@ type DMLog struct {
 	RetryCount int
 }
 
-// JOB QUEUE STRUCT
+// JOB QUEUE STRUCT (one row of dm_jobs)
 type DMJob struct {
-	UserID    string
-	PostID    string
-	CommentID string
-	Text      string
-	Username  string
-	Timestamp time.Time
+	ID         int64
+	Attempts   int
+	RetryBase  int    // attempts before the last requeue; the retry budget counts from here
+	AccountID  string // tbl_ig_accounts.id, "" if the sender isn't a connected account
+	TriggerID  int    // winning triggers.id, 0 for a global keyword
+	TemplateID int    // tbl_dm_templates.id, 0 to send DM_MESSAGE
+	ProductID  int    // tbl_products.id, 0 if none
+	FlowID     int    // tbl_dm_flows.id, 0 for a single templated message
+	DryRun     bool   // account is in dry_run mode: record, don't send
+	UserID     string
+	PostID     string
+	CommentID  string
+	Text       string
+	Username   string
+	Timestamp  time.Time
 }
 
 // GLOBALS
 var (
-	db      *sql.DB
-	config  Config
-	dmQueue chan DMJob
+	db     *sql.DB
+	config Config
 )
 
 // CORS Middleware
@@ -115,21 +260,60 @@ func main() {
 	// Load configuration
 	config = loadConfig()
 
+	// Subcommands that talk to a running server instead of being one
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulateCommand(os.Args[2:]))
+	}
+
+	if len(config.AppSecrets) == 0 && !config.AllowUnsigned {
+		log.Fatal("❌ APP_SECRET is required to verify webhooks (set WEBHOOK_SIGNATURE_OPTIONAL=true to accept unsigned deliveries)")
+	}
+	if !validSendMode(config.SendMode) {
+		log.Fatalf("❌ SEND_MODE must be live, dry_run or paused, got %q", config.SendMode)
+	}
+
 	// Init DB
 	initDB()
 	defer db.Close()
 
-	// DM queue
-	dmQueue = make(chan DMJob, 100)
+	// Graph API client shared by every account
+	graphClient = graph.New(graph.Config{
+		BaseURL:      config.GraphBaseURL,
+		DebugBaseURL: config.GraphDebugURL,
+		Version:      config.GraphVersion,
+	})
+	initEnvToken()
+
+	// Users answered while SEND_MODE was dry_run get real DMs now
+	if config.SendMode == modeLive {
+		if n, err := clearSimulatedDMs(envAccountID); err != nil {
+			log.Println("❌ Failed to clear simulated DMs:", err)
+		} else if n > 0 {
+			log.Printf("🧹 Cleared %d simulated DM(s) from a dry run", n)
+		}
+	}
 
-	// Start worker
-	go dmWorker()
+	// File storage for signed downloads
+	if fileStorage, err = newFileStorage(config); err != nil {
+		log.Fatal("❌ File storage: ", err)
+	}
+
+	// Start scheduler and worker pool (jobs live in the dm_jobs table)
+	jobs := make(chan DMJob)
+	go dmScheduler(jobs)
+	for i := 0; i < config.Workers; i++ {
+		go dmWorker(jobs)
+	}
+	go commentReplyScheduler()
+	go tokenRefreshScheduler()
 
 	// Routes
 	router := httprouter.New()
 	router.GET("/webhook", webhookGETHandler)
-	router.POST("/webhook", webhookPOSTHandler)
+	router.POST("/webhook", verifyWebhookSignature(webhookPOSTHandler))
 	router.GET("/health", healthHandler)
+	router.GET("/l/:code", shortLinkHandler)
+	router.GET("/d/:grant_id", downloadHandler)
 
 	// Add test endpoint
 	router.GET("/test", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -160,6 +344,16 @@ func main() {
 	// Start server
 	log.Printf("🚀 Instagram Auto-DM Server running on port %s", config.Port)
 	log.Printf("📌 Keywords: %v", config.Keywords)
+	log.Printf("📌 DM delay: %v, workers: %d", config.DMDelay, config.Workers)
+	if len(config.AppSecrets) == 0 {
+		log.Println("⚠️  WEBHOOK_SIGNATURE_OPTIONAL=true and no APP_SECRET, webhook signatures will NOT be verified")
+	}
+	if config.PublicBaseURL == "" {
+		log.Println("⚠️  PUBLIC_BASE_URL not set, links in DMs will not be click-tracked")
+	}
+	if config.SendMode != modeLive {
+		log.Printf("⚠️  SEND_MODE=%s for IG_BUSINESS_ID, its DMs will not be sent", config.SendMode)
+	}
 	log.Fatal(http.ListenAndServe(":"+config.Port, corsRouter))
 }
 
@@ -175,20 +369,83 @@ func loadConfig() Config {
 		delay = 30 * time.Second
 	}
 
+	// Live comments are answered while the broadcast is running
+	liveDelay, _ := time.ParseDuration(os.Getenv("LIVE_DM_DELAY"))
+
+	// How long a DM waits for the user to open a messaging window
+	parkedTTL, _ := time.ParseDuration(os.Getenv("PARKED_DM_TTL"))
+	if parkedTTL == 0 {
+		parkedTTL = 7 * 24 * time.Hour
+	}
+
+	var appSecrets []string
+	for _, s := range strings.Split(os.Getenv("APP_SECRET"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			appSecrets = append(appSecrets, s)
+		}
+	}
+
+	workers := 4
+	if wk := os.Getenv("DM_WORKERS"); wk != "" {
+		fmt.Sscanf(wk, "%d", &workers)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
 	maxRetries := 3
 	if mr := os.Getenv("MAX_RETRIES"); mr != "" {
 		fmt.Sscanf(mr, "%d", &maxRetries)
 	}
 
+	// Signed download links
+	downloadTTL, _ := time.ParseDuration(os.Getenv("DOWNLOAD_LINK_TTL"))
+	if downloadTTL == 0 {
+		downloadTTL = 72 * time.Hour
+	}
+	downloadMax := 3
+	if dm := os.Getenv("DOWNLOAD_MAX_COUNT"); dm != "" {
+		fmt.Sscanf(dm, "%d", &downloadMax)
+	}
+
+	// Tokens are refreshed once they are this close to expiring
+	refreshBefore, _ := time.ParseDuration(os.Getenv("TOKEN_REFRESH_BEFORE"))
+	if refreshBefore == 0 {
+		refreshBefore = 10 * 24 * time.Hour
+	}
+
 	return Config{
 		Port:             getEnv("PORT", "8080"),
 		DatabaseURL:      getEnv("DATABASE_URL", ""),
 		VerifyToken:      getEnv("VERIFY_TOKEN", ""),
 		AccessToken:      getEnv("ACCESS_TOKEN", ""),
+		AppSecrets:       appSecrets,
+		AllowUnsigned:    os.Getenv("WEBHOOK_SIGNATURE_OPTIONAL") == "true",
 		IGBusinessID:     getEnv("IG_BUSINESS_ID", ""),
+		SendMode:         getEnv("SEND_MODE", modeLive),
+		GraphBaseURL:     getEnv("GRAPH_API_BASE_URL", graph.DefaultBaseURL),
+		GraphVersion:     getEnv("GRAPH_API_VERSION", graph.DefaultVersion),
+		GraphDebugURL:    getEnv("GRAPH_API_DEBUG_BASE_URL", graph.DefaultDebugBaseURL),
+		MetaAppID:        os.Getenv("META_APP_ID"),
+		RefreshBefore:    refreshBefore,
+		AlertWebhookURL:  os.Getenv("ALERT_WEBHOOK_URL"),
 		Keywords:         keywords,
 		DMMessage:        getEnv("DM_MESSAGE", "Thank you! 🙏"),
 		DMDelay:          delay,
+		LiveDMDelay:      liveDelay,
+		ParkedDMTTL:      parkedTTL,
+		PublicBaseURL:    strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/"),
+		DownloadSecret:   os.Getenv("DOWNLOAD_SECRET"),
+		DownloadTTL:      downloadTTL,
+		DownloadMaxCount: downloadMax,
+		StorageBackend:   getEnv("STORAGE_BACKEND", "local"),
+		StorageDir:       getEnv("STORAGE_DIR", "./storage"),
+		S3Endpoint:       getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Bucket:         os.Getenv("S3_BUCKET"),
+		S3Region:         getEnv("S3_REGION", "us-east-1"),
+		S3AccessKey:      os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:      os.Getenv("S3_SECRET_KEY"),
+		Workers:          workers,
 		MaxRetries:       maxRetries,
 		RetryBackoffBase: 2 * time.Second,
 	}
@@ -234,6 +491,61 @@ func createTables() {
 	CREATE INDEX IF NOT EXISTS idx_user_post ON dm_logs(user_id, post_id);
 	CREATE INDEX IF NOT EXISTS idx_status ON dm_logs(status);
 
+	-- Durable DM job queue
+	CREATE TABLE IF NOT EXISTS dm_jobs (
+		id BIGSERIAL PRIMARY KEY,
+		ig_account_id INTEGER,
+		trigger_id INTEGER,
+		template_id INTEGER,
+		product_id INTEGER,
+		flow_id INTEGER,
+		user_id VARCHAR(255) NOT NULL,
+		post_id VARCHAR(255) NOT NULL,
+		comment_id VARCHAR(255) NOT NULL,
+		username VARCHAR(255),
+		comment_text TEXT,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		run_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		locked_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_id, post_id)
+	);
+
+	-- Columns added to dm_jobs after the queue was introduced; older databases
+	-- need them before the indexes below
+	ALTER TABLE dm_jobs ADD COLUMN IF NOT EXISTS ig_account_id INTEGER;
+	ALTER TABLE dm_jobs ADD COLUMN IF NOT EXISTS trigger_id INTEGER;
+	ALTER TABLE dm_jobs ADD COLUMN IF NOT EXISTS template_id INTEGER;
+	ALTER TABLE dm_jobs ADD COLUMN IF NOT EXISTS product_id INTEGER;
+	ALTER TABLE dm_jobs ADD COLUMN IF NOT EXISTS retry_base INTEGER NOT NULL DEFAULT 0;
+
+	CREATE INDEX IF NOT EXISTS idx_dm_jobs_due ON dm_jobs(status, run_at);
+	CREATE INDEX IF NOT EXISTS idx_dm_jobs_account ON dm_jobs(ig_account_id, status);
+
+	-- Every send attempt made for a job
+	CREATE TABLE IF NOT EXISTS dm_job_attempts (
+		id BIGSERIAL PRIMARY KEY,
+		job_id BIGINT NOT NULL REFERENCES dm_jobs(id) ON DELETE CASCADE,
+		attempt INTEGER NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		error_message TEXT,
+		attempted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_dm_job_attempts_job ON dm_job_attempts(job_id);
+
+	-- A comment can only ever receive one Private Reply
+	CREATE TABLE IF NOT EXISTS private_replies (
+		comment_id VARCHAR(255) PRIMARY KEY,
+		user_id VARCHAR(255) NOT NULL,
+		post_id VARCHAR(255) NOT NULL,
+		sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
 	-- New Tables for Production API
 	CREATE TABLE IF NOT EXISTS tbl_app_users (
 		id SERIAL PRIMARY KEY,
@@ -274,10 +586,255 @@ func createTables() {
 		message_text TEXT,
 		include_download_link BOOLEAN DEFAULT FALSE,
 		download_link TEXT,
+		download_file TEXT,
 		include_product_info BOOLEAN DEFAULT FALSE,
 		is_default BOOLEAN DEFAULT FALSE,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
+
+	CREATE TABLE IF NOT EXISTS tbl_dm_template_products (
+		template_id INTEGER NOT NULL REFERENCES tbl_dm_templates(id) ON DELETE CASCADE,
+		product_id INTEGER NOT NULL REFERENCES tbl_products(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (template_id, product_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS tbl_posts (
+		id SERIAL PRIMARY KEY,
+		media_id VARCHAR(255) UNIQUE NOT NULL,
+		ig_account_id INTEGER REFERENCES tbl_ig_accounts(id),
+		media_type VARCHAR(50),
+		caption TEXT,
+		product_id INTEGER REFERENCES tbl_products(id),
+		dm_template_id INTEGER REFERENCES tbl_dm_templates(id),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS tbl_ig_users (
+		id SERIAL PRIMARY KEY,
+		ig_account_id INTEGER REFERENCES tbl_ig_accounts(id),
+		platform_user_id VARCHAR(255) NOT NULL,
+		username VARCHAR(255),
+		first_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(ig_account_id, platform_user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS tbl_comments (
+		id SERIAL PRIMARY KEY,
+		ig_account_id INTEGER REFERENCES tbl_ig_accounts(id),
+		platform_comment_id VARCHAR(255) UNIQUE NOT NULL,
+		media_id VARCHAR(255),
+		parent_id VARCHAR(255),
+		ig_user_id INTEGER REFERENCES tbl_ig_users(id),
+		text TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_comments_media ON tbl_comments(media_id);
+
+	CREATE TABLE IF NOT EXISTS tbl_live_chat_messages (
+		id SERIAL PRIMARY KEY,
+		ig_account_id INTEGER REFERENCES tbl_ig_accounts(id),
+		broadcast_id VARCHAR(255),
+		platform_message_id VARCHAR(255) UNIQUE NOT NULL,
+		ig_user_id INTEGER REFERENCES tbl_ig_users(id),
+		text TEXT,
+		trigger_id INTEGER,
+		matched_keyword VARCHAR(255),
+		dm_queued BOOLEAN DEFAULT FALSE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_live_chat_broadcast ON tbl_live_chat_messages(ig_account_id, broadcast_id);
+
+	-- 24-hour messaging window per (IG business account, user)
+	CREATE TABLE IF NOT EXISTS tbl_conversations (
+		id SERIAL PRIMARY KEY,
+		ig_business_id VARCHAR(255) NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		last_inbound_at TIMESTAMP,
+		last_outbound_at TIMESTAMP,
+		UNIQUE(ig_business_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS tbl_conversation_messages (
+		id SERIAL PRIMARY KEY,
+		ig_business_id VARCHAR(255) NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		direction VARCHAR(10) NOT NULL,
+		platform_message_id VARCHAR(255) UNIQUE,
+		text TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_conversation_messages_user ON tbl_conversation_messages(ig_business_id, user_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS tbl_dm_flows (
+		id SERIAL PRIMARY KEY,
+		ig_account_id INTEGER NOT NULL REFERENCES tbl_ig_accounts(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		definition JSONB NOT NULL,
+		is_active BOOLEAN DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS tbl_flow_sessions (
+		id BIGSERIAL PRIMARY KEY,
+		ig_account_id INTEGER NOT NULL REFERENCES tbl_ig_accounts(id) ON DELETE CASCADE,
+		flow_id INTEGER NOT NULL REFERENCES tbl_dm_flows(id) ON DELETE CASCADE,
+		user_id VARCHAR(255) NOT NULL,
+		username VARCHAR(255),
+		comment_text TEXT,
+		post_id VARCHAR(255),
+		template_id INTEGER,
+		node_id VARCHAR(100) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		resume_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(ig_account_id, user_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_flow_sessions_resume ON tbl_flow_sessions(status, resume_at);
+
+	CREATE TABLE IF NOT EXISTS tbl_leads (
+		id SERIAL PRIMARY KEY,
+		ig_account_id INTEGER NOT NULL REFERENCES tbl_ig_accounts(id) ON DELETE CASCADE,
+		user_id VARCHAR(255) NOT NULL,
+		username VARCHAR(255),
+		post_id VARCHAR(255) NOT NULL DEFAULT '',
+		template_id INTEGER REFERENCES tbl_dm_templates(id) ON DELETE SET NULL,
+		flow_id INTEGER REFERENCES tbl_dm_flows(id) ON DELETE SET NULL,
+		email VARCHAR(255),
+		phone VARCHAR(32),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(ig_account_id, user_id, post_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_leads_account ON tbl_leads(ig_account_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS tbl_short_links (
+		code VARCHAR(16) PRIMARY KEY,
+		ig_account_id INTEGER,
+		template_id INTEGER,
+		post_id VARCHAR(255) NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		target_url TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_id, post_id, target_url)
+	);
+
+	CREATE TABLE IF NOT EXISTS tbl_link_clicks (
+		id BIGSERIAL PRIMARY KEY,
+		code VARCHAR(16) NOT NULL REFERENCES tbl_short_links(code) ON DELETE CASCADE,
+		ig_account_id INTEGER,
+		template_id INTEGER,
+		post_id VARCHAR(255) NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		user_agent TEXT,
+		clicked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_link_clicks_template ON tbl_link_clicks(template_id);
+	CREATE INDEX IF NOT EXISTS idx_link_clicks_post ON tbl_link_clicks(post_id);
+
+	CREATE TABLE IF NOT EXISTS tbl_download_grants (
+		id BIGSERIAL PRIMARY KEY,
+		ig_account_id INTEGER,
+		template_id INTEGER,
+		post_id VARCHAR(255) NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		file_key TEXT NOT NULL,
+		download_count INTEGER NOT NULL DEFAULT 0,
+		max_downloads INTEGER NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(user_id, post_id, file_key)
+	);
+
+	CREATE TABLE IF NOT EXISTS tbl_download_logs (
+		id BIGSERIAL PRIMARY KEY,
+		grant_id BIGINT NOT NULL REFERENCES tbl_download_grants(id) ON DELETE CASCADE,
+		ig_account_id INTEGER,
+		template_id INTEGER,
+		post_id VARCHAR(255) NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		file_key TEXT NOT NULL,
+		user_agent TEXT,
+		downloaded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS triggers (
+		id SERIAL PRIMARY KEY,
+		ig_account_id INTEGER NOT NULL REFERENCES tbl_ig_accounts(id) ON DELETE CASCADE,
+		name VARCHAR(255),
+		match_mode VARCHAR(20) NOT NULL DEFAULT 'whole_word',
+		pattern TEXT NOT NULL,
+		case_sensitive BOOLEAN DEFAULT FALSE,
+		ignore_diacritics BOOLEAN DEFAULT TRUE,
+		priority INTEGER DEFAULT 0,
+		media_id VARCHAR(255),
+		dm_template_id INTEGER REFERENCES tbl_dm_templates(id) ON DELETE SET NULL,
+		flow_id INTEGER REFERENCES tbl_dm_flows(id) ON DELETE SET NULL,
+		reply_variants TEXT[],
+		reply_delay_seconds INTEGER NOT NULL DEFAULT 0,
+		reply_cursor INTEGER NOT NULL DEFAULT 0,
+		is_active BOOLEAN DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_triggers_account ON triggers(ig_account_id, is_active);
+
+	CREATE TABLE IF NOT EXISTS tbl_comment_replies (
+		id BIGSERIAL PRIMARY KEY,
+		ig_account_id INTEGER NOT NULL REFERENCES tbl_ig_accounts(id) ON DELETE CASCADE,
+		trigger_id INTEGER REFERENCES triggers(id) ON DELETE SET NULL,
+		comment_id VARCHAR(255) UNIQUE NOT NULL,
+		post_id VARCHAR(255) NOT NULL,
+		user_id VARCHAR(255) NOT NULL,
+		message TEXT NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error_message TEXT,
+		platform_reply_id VARCHAR(255),
+		run_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_comment_replies_due ON tbl_comment_replies(status, run_at);
+
+	-- Refreshed ACCESS_TOKEN, kept across restarts while ACCESS_TOKEN is unchanged
+	CREATE TABLE IF NOT EXISTS tbl_env_tokens (
+		ig_user_id VARCHAR(255) PRIMARY KEY,
+		source_token_hash VARCHAR(64) NOT NULL,
+		access_token TEXT NOT NULL,
+		expires_at TIMESTAMP,
+		refreshed_at TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Columns added after the initial schema
+	ALTER TABLE tbl_ig_accounts ADD COLUMN IF NOT EXISTS status VARCHAR(50) DEFAULT 'active';
+	ALTER TABLE dm_jobs ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+	ALTER TABLE dm_jobs ADD COLUMN IF NOT EXISTS flow_id INTEGER;
+	ALTER TABLE triggers ADD COLUMN IF NOT EXISTS flow_id INTEGER REFERENCES tbl_dm_flows(id) ON DELETE SET NULL;
+	ALTER TABLE tbl_flow_sessions ADD COLUMN IF NOT EXISTS post_id VARCHAR(255);
+	ALTER TABLE tbl_flow_sessions ADD COLUMN IF NOT EXISTS template_id INTEGER;
+	ALTER TABLE tbl_dm_templates ADD COLUMN IF NOT EXISTS download_file TEXT;
+	ALTER TABLE triggers ADD COLUMN IF NOT EXISTS reply_variants TEXT[];
+	ALTER TABLE triggers ADD COLUMN IF NOT EXISTS reply_delay_seconds INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE triggers ADD COLUMN IF NOT EXISTS reply_cursor INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE tbl_ig_accounts ADD COLUMN IF NOT EXISTS send_mode VARCHAR(20) NOT NULL DEFAULT 'live';
+	ALTER TABLE dm_logs ADD COLUMN IF NOT EXISTS ig_account_id INTEGER;
+	ALTER TABLE dm_logs ADD COLUMN IF NOT EXISTS message TEXT;
+	ALTER TABLE tbl_ig_accounts ADD COLUMN IF NOT EXISTS token_expires_at TIMESTAMP;
+	ALTER TABLE tbl_ig_accounts ADD COLUMN IF NOT EXISTS token_refreshed_at TIMESTAMP;
+	ALTER TABLE tbl_ig_accounts ADD COLUMN IF NOT EXISTS token_refresh_error TEXT;
 	`
 
 	_, err := db.Exec(schema)
@@ -305,93 +862,137 @@ func webhookPOSTHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Par
 	timestamp := time.Now().Format("2006-01-02 15:04:05")
 	log.Printf("\n\nWebhook received %s\n", timestamp)
 
-	var payload map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		log.Println("Error decoding webhook body:", err)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading webhook body:", err)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	out, _ := json.MarshalIndent(payload, "", "  ")
-	log.Println(string(out))
-
-	// Process the webhook payload for comments
-	if entries, ok := payload["entry"].([]interface{}); ok {
-		for _, e := range entries {
-			entry, _ := e.(map[string]interface{})
-			if changes, ok := entry["changes"].([]interface{}); ok {
-				for _, c := range changes {
-					change, _ := c.(map[string]interface{})
-					if field, ok := change["field"].(string); ok && field == "comments" {
-						if value, ok := change["value"].(map[string]interface{}); ok {
-							// Convert map to CommentData struct
-							processCommentFromMap(value)
-						}
-					}
-				}
-			}
-		}
+	log.Println(string(body))
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Println("Error decoding webhook body:", err)
+		w.WriteHeader(http.StatusOK)
+		return
 	}
 
+	// Route each entry to the account it belongs to
+	dispatchWebhook(payload)
+
 	w.WriteHeader(http.StatusOK)
 }
 
-// COMMENT PROCESSOR (from map)
-func processCommentFromMap(commentMap map[string]interface{}) {
-	// Extract fields from map
-	id, _ := commentMap["id"].(string)
-	mediaID, _ := commentMap["media_id"].(string)
-	text, _ := commentMap["text"].(string)
+// COMMENT PROCESSOR
+// processAccountComment runs the store → trigger → template → queue pipeline
+// for a comment on one connected account's media. accountID is "" when the
+// env-configured account isn't connected through the API.
+func processAccountComment(accountID string, c CommentData) {
+	if accountID != "" {
+		storeComment(accountID, c)
+	}
 
-	fromMap, _ := commentMap["from"].(map[string]interface{})
-	userID, _ := fromMap["id"].(string)
-	username, _ := fromMap["username"].(string)
+	// Public reply only goes with a DM that was actually queued
+	trigger, queued := queueTriggeredDM(accountID, c, config.DMDelay)
+	if queued && accountID != "" && len(trigger.ReplyVariants) > 0 {
+		queueCommentReply(accountID, *trigger, c)
+	}
+}
 
-	c := CommentData{
-		ID:      id,
-		MediaID: mediaID,
-		Text:    text,
-		From: User{
-			ID:       userID,
-			Username: username,
-		},
+// queueTriggeredDM matches the comment against the account's triggers and, if
+// one fires, queues a DM due after delay. It returns the winning trigger (nil
+// if none) and whether a new job was queued.
+func queueTriggeredDM(accountID string, c CommentData, delay time.Duration) (*Trigger, bool) {
+	// Our own comments, e.g. public replies, never trigger DMs
+	if c.From.ID != "" && c.From.ID == igUserIDForAccount(accountID) {
+		return nil, false
 	}
 
-	processComment(c)
-}
+	if accountMode(accountID) == modePaused {
+		log.Printf("⏸️ Account %s is paused, comment %s not answered", accountID, c.ID)
+		return nil, false
+	}
 
-// COMMENT PROCESSOR
-func processComment(c CommentData) {
-	text := strings.ToLower(c.Text)
-
-	// Check keywords
-	match := false
-	for _, kw := range config.Keywords {
-		if strings.Contains(text, kw) {
-			match = true
-			break
+	// Check triggers, falling back to the global KEYWORDS list
+	var triggers []Trigger
+	if accountID != "" {
+		var err error
+		if triggers, err = loadTriggers(accountID, true); err != nil {
+			log.Println("❌ Failed to load triggers:", err)
 		}
 	}
-	if !match {
-		return
+	if len(triggers) == 0 {
+		triggers = keywordTriggers(config.Keywords)
 	}
 
+	trigger := matchTrigger(triggers, c)
+	if trigger == nil {
+		return nil, false
+	}
+	log.Printf("🎯 Comment matched trigger %q (%s)", trigger.Name, trigger.MatchMode)
+
+	// Pick the template and product for this post
+	templateID, productID := resolveDMContent(accountID, trigger, c.MediaID)
+
 	// Duplicate check
 	if isDuplicate(c.From.ID, c.MediaID) {
 		log.Println("⚠️ Duplicate DM skipped")
-		return
+		return trigger, false
 	}
 
 	// Queue the job
-	dmQueue <- DMJob{
-		UserID:    c.From.ID,
-		PostID:    c.MediaID,
-		CommentID: c.ID,
-		Text:      c.Text,
-		Username:  c.From.Username,
-		Timestamp: time.Now(),
+	queued, err := enqueueDMJob(DMJob{
+		AccountID:  accountID,
+		TriggerID:  trigger.ID,
+		TemplateID: templateID,
+		ProductID:  productID,
+		FlowID:     trigger.FlowID,
+		UserID:     c.From.ID,
+		PostID:     c.MediaID,
+		CommentID:  c.ID,
+		Text:       c.Text,
+		Username:   c.From.Username,
+		Timestamp:  time.Now(),
+	}, delay)
+	if err != nil {
+		log.Printf("❌ Failed to queue DM job for @%s: %v", c.From.Username, err)
+		return trigger, false
+	}
+	if !queued {
+		log.Println("⚠️ Duplicate DM job skipped")
+		return trigger, false
 	}
 
 	log.Printf("📩 DM job queued for @%s", c.From.Username)
+	return trigger, true
+}
+
+// ACCOUNT LOOKUP
+// Resolves an Instagram business ID to its tbl_ig_accounts row, if connected.
+func accountIDForIGUser(igID string) string {
+	var accountID string
+	db.QueryRow(
+		"SELECT id FROM tbl_ig_accounts WHERE platform_ig_account_id = $1",
+		igID,
+	).Scan(&accountID)
+
+	return accountID
+}
+
+// igUserIDForAccount is the Instagram business ID of a tbl_ig_accounts row,
+// or IG_BUSINESS_ID for the env-configured account ("").
+func igUserIDForAccount(accountID string) string {
+	if accountID == "" {
+		return config.IGBusinessID
+	}
+
+	var igID string
+	db.QueryRow(
+		"SELECT platform_ig_account_id FROM tbl_ig_accounts WHERE id = $1",
+		accountID,
+	).Scan(&igID)
+
+	return igID
 }
 
 // DUPLICATE CHECKER
@@ -405,105 +1006,278 @@ func isDuplicate(userID, postID string) bool {
 	return err == nil && count > 0
 }
 
-// DM WORKER
-func dmWorker() {
-	for job := range dmQueue {
-		log.Printf("⏳ Waiting %v before sending DM to @%s", config.DMDelay, job.Username)
-		time.Sleep(config.DMDelay)
-		log.Printf("📤 Sending DM to @%s (user: %s, post: %s)", job.Username, job.UserID, job.PostID)
-		err := sendDMWithRetry(job)
+// DM SCHEDULER
+// Jobs are stamped with run_at = comment time + DM_DELAY when queued, so the
+// delay is per-message latency. The scheduler claims jobs as they fall due
+// and hands them to the worker pool; the unbuffered channel means it never
+// claims more than it has idle workers for.
+func dmScheduler(jobs chan<- DMJob) {
+	var lastSweep, lastFlowCheck time.Time
+	for {
+		if time.Since(lastSweep) > parkedJobSweepInterval {
+			expireParkedDMJobs()
+			expireFlowSessions()
+			lastSweep = time.Now()
+		}
+		if time.Since(lastFlowCheck) > flowResumePollInterval {
+			resumeDueFlows()
+			lastFlowCheck = time.Now()
+		}
 
+		job, err := claimDMJob()
 		if err != nil {
-			log.Printf("❌ DM send failed for @%s: %v", job.Username, err)
-			logDM(job, "failed", err.Error())
-		} else {
-			log.Printf("✅ DM sent successfully to @%s", job.Username)
-			logDM(job, "sent", "")
+			log.Println("❌ DM job claim error:", err)
+			time.Sleep(dmQueuePollInterval)
+			continue
+		}
+		if job == nil {
+			time.Sleep(dmQueuePollInterval)
+			continue
 		}
+
+		jobs <- *job
+	}
+}
+
+// DM WORKER
+func dmWorker(jobs <-chan DMJob) {
+	for job := range jobs {
+		processDMJob(job)
+	}
+}
+
+// processDMJob sends one claimed job and records the outcome: sent, parked
+// until the user writes in, rescheduled, or dead.
+func processDMJob(job DMJob) {
+	log.Printf("📤 Sending DM to @%s (user: %s, post: %s, attempt %d)", job.Username, job.UserID, job.PostID, job.Attempts)
+	err := sendDMJob(job)
+	recordDMJobAttempt(job, err)
+
+	if err == nil && job.DryRun {
+		log.Printf("🧪 DM to @%s simulated (dry run)", job.Username)
+		finishDMJob(job.ID, jobSimulated, "")
+		return
 	}
+	if err == nil {
+		log.Printf("✅ DM sent successfully to @%s", job.Username)
+		logDM(job, "sent", "")
+		finishDMJob(job.ID, jobSent, "")
+		return
+	}
+
+	// Closed messaging window: park until the user writes in
+	var ge *graph.Error
+	if errors.As(err, &ge) && ge.Kind == graph.ErrMessagingWindow {
+		log.Printf("🅿️ DM to @%s parked for up to %v until they message us", job.Username, config.ParkedDMTTL)
+		parkDMJob(job.ID, err.Error(), config.ParkedDMTTL)
+		return
+	}
+
+	if delay, ok := retryDelay(err, job.Attempts-job.RetryBase); ok && err != errFlowSentNothing {
+		// Reschedule instead of sleeping so other jobs keep flowing
+		log.Printf("🔁 DM to @%s failed, retrying in %v: %v", job.Username, delay, err)
+		retryDMJob(job.ID, err.Error(), delay)
+		return
+	}
+
+	log.Printf("❌ DM send failed for @%s: %v", job.Username, err)
+	logDM(job, "failed", err.Error())
+	finishDMJob(job.ID, jobDead, err.Error())
 }
 
-func sendDMWithRetry(job DMJob) error {
-	var last error
+func sendDMJob(job DMJob) error {
+	creds, err := credentialsForJob(job)
+	if err != nil {
+		return err
+	}
+
+	// Mode as of the claim, so the worker logs the job the way it was sent
+	creds.DryRun = job.DryRun
+	var simulated []OutboundMessage
+	if creds.DryRun {
+		creds.simulated = &simulated
+	}
+
+	recipient, ok := recipientForJob(job, creds.IGUserID)
+	if !ok {
+		log.Printf("⏸️ Messaging window closed for @%s, deferring", job.Username)
+		return errMessagingWindowClosed
+	}
+	if recipient.CommentID != "" {
+		log.Printf("💬 Sending as Private Reply to comment %s", recipient.CommentID)
+	}
+
+	delivered := true
+	if job.FlowID != 0 {
+		delivered, err = startFlow(job, creds, recipient)
+	} else {
+		err = sendTemplatedJob(job, creds, recipient)
+	}
+	if err != nil {
+		return err
+	}
+	if !delivered {
+		return errFlowSentNothing
+	}
 
-	for attempt := 0; attempt <= config.MaxRetries; attempt++ {
-		if attempt > 0 {
-			backoff := config.RetryBackoffBase * time.Duration(1<<uint(attempt-1))
-			time.Sleep(backoff)
+	if creds.DryRun {
+		logSimulatedDM(job, simulated)
+		return nil
+	}
+	if recipient.CommentID != "" {
+		markPrivateReplySent(job)
+	}
+	return nil
+}
+
+// deliverMessage sends one message and records it in the conversation
+// history. Token errors flag the account for re-authorization.
+func deliverMessage(creds IGCredentials, recipient Recipient, userID string, msg OutboundMessage) error {
+	if creds.DryRun {
+		log.Printf("🧪 [dry run] Would send to %s: %s", userID, msg.summary())
+		if creds.simulated != nil {
+			*creds.simulated = append(*creds.simulated, msg)
 		}
+		return nil
+	}
 
-		err := sendDM(job.UserID, config.DMMessage)
-		if err == nil {
-			return nil
+	if err := sendDM(creds, recipient, msg); err != nil {
+		var ge *graph.Error
+		if errors.As(err, &ge) && ge.Kind == graph.ErrAuth {
+			markAccountNeedsReauth(creds.IGUserID, err)
 		}
+		return err
+	}
+
+	recordConversationMessage(creds.IGUserID, userID, directionOutbound, "", msg.summary(), time.Now())
+	return nil
+}
 
-		last = err
+// SENDER CREDENTIALS
+// Jobs for a connected account are sent with that account's own token; the
+// rest use IG_BUSINESS_ID / ACCESS_TOKEN.
+type IGCredentials struct {
+	IGUserID    string
+	AccessToken string
+	DryRun      bool // record instead of sending (see send_mode.go)
+
+	simulated *[]OutboundMessage // collects dry-run messages for one job
+}
+
+func credentialsForJob(job DMJob) (IGCredentials, error) {
+	if job.AccountID == "" {
+		return IGCredentials{
+			IGUserID:    config.IGBusinessID,
+			AccessToken: envAccessToken(),
+			DryRun:      config.SendMode == modeDryRun,
+		}, nil
 	}
 
-	return last
+	var creds IGCredentials
+	var mode string
+	err := db.QueryRow(
+		"SELECT platform_ig_account_id, COALESCE(access_token, ''), send_mode FROM tbl_ig_accounts WHERE id = $1",
+		job.AccountID,
+	).Scan(&creds.IGUserID, &creds.AccessToken, &mode)
+	creds.DryRun = mode == modeDryRun
+	if err != nil {
+		return creds, fmt.Errorf("account %s not found: %v", job.AccountID, err)
+	}
+	if creds.AccessToken == "" {
+		return creds, fmt.Errorf("account %s has no access token", job.AccountID)
+	}
+
+	return creds, nil
 }
 
-// DM SENDER
-// Note: Instagram's 24-hour messaging rule applies:
-// You can only send DMs to users who have messaged you in the last 24 hours.
-// For development/testing, use test users from your Meta app.
-func sendDM(userID, message string) error {
-	url := fmt.Sprintf("https://graph.instagram.com/v15.0/%s/messages", config.IGBusinessID)
+// GRAPH API
+// graphClient is set up in main from GRAPH_API_BASE_URL / GRAPH_API_VERSION.
+// graphAPI is a variable so tests and tools can swap in a fake.
+var graphClient *graph.Client
+
+var graphAPI = func(creds IGCredentials) graph.API {
+	return graphClient.Account(creds.IGUserID, creds.AccessToken)
+}
 
-	body := map[string]any{
-		"recipient": map[string]string{"id": userID},
-		"message":   map[string]string{"text": message},
+// RECIPIENT SELECTION
+// The first message to a commenter must be a Private Reply keyed on the
+// comment ID: a plain user-ID send is rejected with code 10 / subcode 2534022
+// unless the user has messaged us in the last 24 hours. Once the comment has
+// used up its Private Reply (or is too old for one) we can only reach the user
+// by ID while their messaging window is open. ok is false when neither works
+// and the job has to wait for the user to write in.
+func recipientForJob(job DMJob, igUserID string) (recipient Recipient, ok bool) {
+	if job.CommentID != "" {
+		switch {
+		case time.Since(job.Timestamp) > privateReplyWindow:
+			log.Printf("⚠️ Comment %s is older than %v, Private Reply not possible", job.CommentID, privateReplyWindow)
+		case hasPrivateReply(job.CommentID):
+			log.Printf("⚠️ Comment %s already has a Private Reply", job.CommentID)
+		default:
+			return Recipient{CommentID: job.CommentID}, true
+		}
 	}
 
-	jsonBody, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+	if messagingWindowOpen(igUserID, job.UserID) {
+		return Recipient{ID: job.UserID}, true
+	}
 
-	log.Printf("📡 API Call: POST %s", url)
-	log.Printf("📦 Payload: %s", string(jsonBody))
+	return Recipient{}, false
+}
+
+// PRIVATE REPLY TRACKING
+func hasPrivateReply(commentID string) bool {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM private_replies WHERE comment_id = $1",
+		commentID,
+	).Scan(&count)
+
+	return err == nil && count > 0
+}
+
+func markPrivateReplySent(job DMJob) {
+	_, err := db.Exec(`
+		INSERT INTO private_replies (comment_id, user_id, post_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (comment_id) DO NOTHING
+	`, job.CommentID, job.UserID, job.PostID)
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("❌ Request error: %v", err)
-		return err
+		log.Println("❌ Private reply log error:", err)
 	}
-	defer resp.Body.Close()
-
-	b, _ := io.ReadAll(resp.Body)
-	log.Printf("📥 Response Status: %d", resp.StatusCode)
-	log.Printf("📥 Response Body: %s", string(b))
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		// Parse error for better debugging
-		var errResp map[string]any
-		if err := json.Unmarshal(b, &errResp); err == nil {
-			if errData, ok := errResp["error"].(map[string]any); ok {
-				if code, ok := errData["code"].(float64); ok && code == 10 {
-					if subcode, ok := errData["error_subcode"].(float64); ok && subcode == 2534022 {
-						return fmt.Errorf("24_hour_messaging_window_expired: User must message you first or within 24 hours")
-					}
-				}
-			}
-		}
-		return fmt.Errorf("api_error_%d: %s", resp.StatusCode, string(b))
+}
+
+// DM SENDER
+// Note: Instagram's 24-hour messaging rule applies to ID recipients:
+// you can only send them DMs if they have messaged you in the last 24 hours.
+// CommentID recipients (Private Replies) are exempt, once per comment.
+// For development/testing, use test users from your Meta app.
+func sendDM(creds IGCredentials, recipient Recipient, message OutboundMessage) error {
+	log.Printf("📡 Sending DM from %s: %s", creds.IGUserID, message.summary())
+
+	resp, err := graphAPI(creds).SendMessage(recipient, message)
+	if err != nil {
+		log.Printf("❌ Send error: %v", err)
+		return err
 	}
 
+	log.Printf("📥 Message %s delivered", resp.MessageID)
 	return nil
 }
 
 // DM LOGGING
 func logDM(job DMJob, status, errMsg string) {
 	_, err := db.Exec(`
-		INSERT INTO dm_logs (user_id, post_id, comment_id, status, error_message)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO dm_logs (user_id, post_id, comment_id, status, retry_count, error_message, ig_account_id)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, '')::integer)
 		ON CONFLICT (user_id, post_id) DO UPDATE
-		SET retry_count = dm_logs.retry_count + 1,
+		SET retry_count = $5,
 		    status = $4,
-		    error_message = $5,
+		    error_message = $6,
+		    ig_account_id = NULLIF($7, '')::integer,
 		    sent_at = CURRENT_TIMESTAMP
-	`, job.UserID, job.PostID, job.CommentID, status, errMsg)
+	`, job.UserID, job.PostID, job.CommentID, status, job.Attempts-1, errMsg, job.AccountID)
 
 	if err != nil {
 		log.Println("❌ DM log error:", err)
@@ -519,8 +1293,12 @@ func healthHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	}
 
 	json.NewEncoder(w).Encode(map[string]any{
-		"status":     "healthy",
-		"queue_size": len(dmQueue),
-		"keywords":   config.Keywords,
+		"status":             "healthy",
+		"queue_size":         countDMJobs(jobPending),
+		"waiting_for_user":   countDMJobs(jobWaitingForUser),
+		"keywords":           config.Keywords,
+		"signature_failures": atomic.LoadInt64(&webhookSignatureFailures),
+		"unknown_accounts":   atomic.LoadInt64(&webhookUnknownAccountEvents),
+		"needs_reauth":       countNeedsReauth(),
 	})
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"instagram-autodm/graph"
+)
+
+// ============================================
+// INBOUND MESSAGES & 24-HOUR WINDOW
+// ============================================
+
+// Meta only lets us message a user by ID within 24 hours of their last
+// message to us. Every inbound DM refreshes that window and is kept in the
+// conversation history alongside what we send.
+
+const messagingWindow = 24 * time.Hour
+
+const (
+	directionInbound  = "inbound"
+	directionOutbound = "outbound"
+)
+
+// Returned (instead of calling the API) when a job can't be sent because
+// the comment's Private Reply is used up and the user's window is closed
+var errMessagingWindowClosed = &graph.Error{
+	Kind:    graph.ErrMessagingWindow,
+	Code:    10,
+	Subcode: 2534022,
+	Message: "messaging window closed, waiting for the user to write in",
+}
+
+// processInboundMessage handles a DM, quick reply or postback from a user.
+func processInboundMessage(igID, accountID string, event MessagingEvent) {
+	if event.Sender.ID == igID {
+		return
+	}
+
+	var mid, text, payload string
+	switch {
+	case event.Message != nil && !event.Message.IsEcho:
+		mid, text = event.Message.Mid, event.Message.Text
+		if event.Message.QuickReply != nil {
+			payload = event.Message.QuickReply.Payload
+		}
+	case event.Postback != nil:
+		mid, text, payload = event.Postback.Mid, event.Postback.Title, event.Postback.Payload
+	default:
+		return
+	}
+
+	at := time.Now()
+	if event.Timestamp > 0 {
+		at = time.UnixMilli(event.Timestamp)
+	}
+
+	log.Printf("📨 Inbound DM from %s to %s: %s", event.Sender.ID, igID, text)
+
+	if accountID != "" {
+		if _, err := storeCommenter(accountID, User{ID: event.Sender.ID}); err != nil {
+			log.Printf("❌ Failed to store message sender %s: %v", event.Sender.ID, err)
+		}
+	}
+
+	recordConversationMessage(igID, event.Sender.ID, directionInbound, mid, text, at)
+
+	// The window is open now: send anything parked for this user
+	if n := releaseParkedDMJobs(accountID, event.Sender.ID); n > 0 {
+		log.Printf("▶️ Released %d parked DM(s) for user %s", n, event.Sender.ID)
+	}
+
+	// Move the user's conversation flow on: resume one held for the window,
+	// or route the answer through one waiting for it
+	if accountID != "" && !resumeWindowFlow(accountID, event.Sender.ID) {
+		handleFlowReply(accountID, event.Sender.ID, text, payload)
+	}
+}
+
+// recordConversationMessage appends to the history and moves the matching
+// last_inbound_at / last_outbound_at forward.
+func recordConversationMessage(igID, userID, direction, mid, text string, at time.Time) {
+	_, err := db.Exec(`
+		INSERT INTO tbl_conversation_messages (ig_business_id, user_id, direction, platform_message_id, text, created_at)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6::timestamptz)
+		ON CONFLICT (platform_message_id) DO NOTHING
+	`, igID, userID, direction, mid, text, at)
+	if err != nil {
+		log.Println("❌ Conversation message log error:", err)
+	}
+
+	column := "last_outbound_at"
+	if direction == directionInbound {
+		column = "last_inbound_at"
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO tbl_conversations (ig_business_id, user_id, `+column+`)
+		VALUES ($1, $2, $3::timestamptz)
+		ON CONFLICT (ig_business_id, user_id) DO UPDATE
+		SET `+column+` = GREATEST(tbl_conversations.`+column+`, EXCLUDED.`+column+`)
+	`, igID, userID, at)
+	if err != nil {
+		log.Println("❌ Conversation window update error:", err)
+	}
+}
+
+// messagingWindowOpen reports whether userID messaged igID in the last 24 hours.
+func messagingWindowOpen(igID, userID string) bool {
+	var open bool
+	db.QueryRow(`
+		SELECT COALESCE(last_inbound_at > NOW() - make_interval(secs => $3), false)
+		FROM tbl_conversations
+		WHERE ig_business_id = $1 AND user_id = $2
+	`, igID, userID, messagingWindow.Seconds()).Scan(&open)
+
+	return open
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// ============================================
+// PUBLISHED MEDIA BINDINGS (tbl_posts)
+// ============================================
+
+// Each post or reel published through the API remembers the product and DM
+// template chosen at publish time, so comments on it get the right message.
+
+type PostBinding struct {
+	MediaID      string
+	AccountID    string
+	MediaType    string
+	ProductID    int
+	DMTemplateID int
+}
+
+// validatePublishRefs makes sure the product and template picked for a post
+// belong to the account publishing it. Zero IDs mean "none" and are allowed.
+func validatePublishRefs(accountID string, productID, dmTemplateID int) error {
+	if productID != 0 {
+		var exists bool
+		db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM tbl_products WHERE id = $1 AND ig_account_id = $2)",
+			productID, accountID,
+		).Scan(&exists)
+		if !exists {
+			return fmt.Errorf("product %d not found for this account", productID)
+		}
+	}
+
+	if dmTemplateID != 0 {
+		var exists bool
+		db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM tbl_dm_templates WHERE id = $1 AND ig_account_id = $2)",
+			dmTemplateID, accountID,
+		).Scan(&exists)
+		if !exists {
+			return fmt.Errorf("DM template %d not found for this account", dmTemplateID)
+		}
+	}
+
+	return nil
+}
+
+func savePostBinding(b PostBinding, caption string) {
+	_, err := db.Exec(`
+		INSERT INTO tbl_posts (media_id, ig_account_id, media_type, caption, product_id, dm_template_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, 0))
+		ON CONFLICT (media_id) DO UPDATE SET
+			product_id = EXCLUDED.product_id,
+			dm_template_id = EXCLUDED.dm_template_id
+	`, b.MediaID, b.AccountID, b.MediaType, caption, b.ProductID, b.DMTemplateID)
+
+	if err != nil {
+		log.Printf("Failed to store post binding for %s: %v", b.MediaID, err)
+		return
+	}
+
+	log.Printf("Post %s bound to product %d and DM template %d", b.MediaID, b.ProductID, b.DMTemplateID)
+}
+
+// getPostBinding returns nil if the media wasn't published through the API.
+func getPostBinding(mediaID string) (*PostBinding, error) {
+	var b PostBinding
+	err := db.QueryRow(`
+		SELECT media_id, ig_account_id::text, COALESCE(media_type, ''),
+		       COALESCE(product_id, 0), COALESCE(dm_template_id, 0)
+		FROM tbl_posts
+		WHERE media_id = $1
+	`, mediaID).Scan(&b.MediaID, &b.AccountID, &b.MediaType, &b.ProductID, &b.DMTemplateID)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// defaultTemplate returns the account's default DM template and its product,
+// or zeros if it has none.
+func defaultTemplate(accountID string) (templateID, productID int) {
+	db.QueryRow(`
+		SELECT id, COALESCE(product_id, 0)
+		FROM tbl_dm_templates
+		WHERE ig_account_id = $1 AND is_default
+		ORDER BY id DESC
+		LIMIT 1
+	`, accountID).Scan(&templateID, &productID)
+
+	return templateID, productID
+}
+
+// resolveDMContent picks the template and product for a comment on mediaID.
+// A template set on the winning trigger comes first, then the one bound to
+// the post at publish time, then the account's default template.
+func resolveDMContent(accountID string, trigger *Trigger, mediaID string) (templateID, productID int) {
+	binding, err := getPostBinding(mediaID)
+	if err != nil {
+		log.Printf("Failed to look up post binding for %s: %v", mediaID, err)
+	}
+	if binding != nil {
+		templateID, productID = binding.DMTemplateID, binding.ProductID
+	}
+
+	if trigger != nil && trigger.DMTemplateID != 0 {
+		templateID = trigger.DMTemplateID
+	}
+
+	if templateID == 0 && accountID != "" {
+		var defaultProductID int
+		templateID, defaultProductID = defaultTemplate(accountID)
+		if productID == 0 {
+			productID = defaultProductID
+		}
+	}
+
+	if productID == 0 && templateID != 0 {
+		db.QueryRow(
+			"SELECT COALESCE(product_id, 0) FROM tbl_dm_templates WHERE id = $1",
+			templateID,
+		).Scan(&productID)
+	}
+
+	return templateID, productID
+}
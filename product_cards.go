@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// ============================================
+// PRODUCT CARDS
+// ============================================
+
+// With include_product_info the linked product is sent as a generic-template
+// card (image, title, price subtitle, "Buy" button) after the template text.
+// Products added through tbl_dm_template_products become extra cards in a
+// carousel. If the card is rejected the product details are sent as text.
+//
+// A Private Reply is a single message, so jobs sent that way keep the
+// product block inline in the text instead.
+
+const (
+	maxCarouselCards = 10
+	maxCardTextRunes = 80
+)
+
+// sendTemplatedJob sends a job that isn't a flow: its rendered template (or
+// DM_MESSAGE), plus product cards when the template asks for them.
+func sendTemplatedJob(job DMJob, creds IGCredentials, recipient Recipient) error {
+	send := func(msg OutboundMessage) error {
+		trackMessageLinks(&msg, jobLinkContext(job))
+		return deliverMessage(creds, recipient, job.UserID, msg)
+	}
+
+	if recipient.CommentID != "" {
+		return send(OutboundMessage{Text: renderMessageForJob(job)})
+	}
+
+	text, t := renderJob(job, true)
+	var products []*Product
+	if t != nil && t.IncludeProductInfo {
+		products = templateProducts(t, jobProductID(job, t))
+	}
+	if len(products) == 0 {
+		return send(OutboundMessage{Text: renderMessageForJob(job)})
+	}
+
+	textSent := false
+	if strings.TrimSpace(text) != "" {
+		if err := send(OutboundMessage{Text: text}); err != nil {
+			return err
+		}
+		textSent = true
+	}
+
+	err := send(productCards(products))
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("⚠️ Product card rejected for @%s, sending it as text: %v", job.Username, err)
+	err = send(OutboundMessage{Text: productBlocks(products)})
+	if err != nil && textSent {
+		// The template text is out; retrying the job would send it twice
+		log.Printf("❌ Product text fallback failed for @%s: %v", job.Username, err)
+		return nil
+	}
+
+	return err
+}
+
+// productCards builds a generic template with one card per product.
+func productCards(products []*Product) OutboundMessage {
+	payload := TemplatePayload{TemplateType: "generic"}
+	for _, p := range products {
+		payload.Elements = append(payload.Elements, productCard(p))
+	}
+
+	return OutboundMessage{Attachment: &Attachment{Type: "template", Payload: payload}}
+}
+
+func productCard(p *Product) GenericElement {
+	var subtitle []string
+	if p.Price > 0 {
+		subtitle = append(subtitle, fmt.Sprintf("%.2f", p.Price))
+	}
+	if p.Description != "" {
+		subtitle = append(subtitle, p.Description)
+	}
+
+	card := GenericElement{
+		Title:    truncateRunes(p.Name, maxCardTextRunes),
+		Subtitle: truncateRunes(strings.Join(subtitle, " · "), maxCardTextRunes),
+		ImageURL: p.ImageURL,
+	}
+	if p.ProductLink != "" {
+		card.Buttons = []Button{{Type: "web_url", Title: "Buy", URL: p.ProductLink}}
+	}
+
+	return card
+}
+
+// productBlocks is the text fallback for a set of cards.
+func productBlocks(products []*Product) string {
+	blocks := make([]string, len(products))
+	for i, p := range products {
+		blocks[i] = productBlock(p)
+	}
+	return strings.Join(blocks, "\n\n")
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// templateProducts returns the cards for a template: the job's product
+// first, then the template's extra products in position order.
+func templateProducts(t *DMTemplate, productID int) []*Product {
+	ids := []int{}
+	if productID != 0 {
+		ids = append(ids, productID)
+	}
+
+	rows, err := db.Query(`
+		SELECT product_id FROM tbl_dm_template_products
+		WHERE template_id = $1
+		ORDER BY position, product_id
+	`, t.ID)
+	if err != nil {
+		log.Printf("⚠️ Failed to load products for DM template %d: %v", t.ID, err)
+	} else {
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil && id != productID {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	var products []*Product
+	for _, id := range ids {
+		if len(products) == maxCarouselCards {
+			break
+		}
+		p, err := loadProduct(id)
+		if err != nil {
+			log.Printf("⚠️ Failed to load product %d: %v", id, err)
+			continue
+		}
+		if p.Name != "" {
+			products = append(products, p)
+		}
+	}
+
+	return products
+}
+
+// setTemplateProducts links the extra carousel products to a template.
+func setTemplateProducts(templateID int, productIDs []int) error {
+	for i, productID := range productIDs {
+		_, err := db.Exec(`
+			INSERT INTO tbl_dm_template_products (template_id, product_id, position)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (template_id, product_id) DO UPDATE SET position = EXCLUDED.position
+		`, templateID, productID, i)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+	}
+
+	return nil
+}
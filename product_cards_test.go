@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProductCard(t *testing.T) {
+	tests := []struct {
+		name    string
+		product Product
+		want    GenericElement
+	}{
+		{
+			name:    "full product",
+			product: Product{Name: "Preset Pack", Description: "20 presets", Price: 19, ImageURL: "https://img.example/p.jpg", ProductLink: "https://shop.example/p"},
+			want: GenericElement{
+				Title:    "Preset Pack",
+				Subtitle: "19.00 · 20 presets",
+				ImageURL: "https://img.example/p.jpg",
+				Buttons:  []Button{{Type: "web_url", Title: "Buy", URL: "https://shop.example/p"}},
+			},
+		},
+		{
+			name:    "no price or link",
+			product: Product{Name: "Free guide"},
+			want:    GenericElement{Title: "Free guide"},
+		},
+		{
+			name:    "long text truncated",
+			product: Product{Name: strings.Repeat("ж", 100), Description: strings.Repeat("a", 100)},
+			want:    GenericElement{Title: strings.Repeat("ж", 79) + "…", Subtitle: strings.Repeat("a", 79) + "…"},
+		},
+	}
+
+	for _, tt := range tests {
+		got := productCard(&tt.product)
+		if got.Title != tt.want.Title || got.Subtitle != tt.want.Subtitle || got.ImageURL != tt.want.ImageURL {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+		if len(got.Buttons) != len(tt.want.Buttons) || (len(got.Buttons) == 1 && got.Buttons[0] != tt.want.Buttons[0]) {
+			t.Errorf("%s: buttons = %+v, want %+v", tt.name, got.Buttons, tt.want.Buttons)
+		}
+	}
+}
+
+func TestProductCardsMessage(t *testing.T) {
+	products := []*Product{{Name: "One", Price: 5}, {Name: "Two"}}
+
+	msg := productCards(products)
+	if msg.Attachment == nil || msg.Attachment.Payload.TemplateType != "generic" || len(msg.Attachment.Payload.Elements) != 2 {
+		t.Fatalf("productCards = %+v", msg)
+	}
+	if got := msg.summary(); got != "[cards] One, Two" {
+		t.Errorf("summary = %q", got)
+	}
+	if got := productBlocks(products); got != "One - 5.00\n\nTwo" {
+		t.Errorf("productBlocks = %q", got)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ============================================
+// SEND MODES (live / dry_run / paused)
+// ============================================
+
+// Each account has a send_mode (SEND_MODE for the env-configured account):
+//
+//	live     messages are sent
+//	dry_run  the whole pipeline runs (triggers, templates, dedup, scheduling)
+//	         but nothing reaches Instagram; each job's would-be messages are
+//	         stored in dm_logs with status simulated
+//	paused   new comments and flow answers aren't answered; queued DMs,
+//	         replies and flow timers are held until the account is live or
+//	         dry_run again
+//
+// Comments answered in dry_run are deduplicated like real ones while the
+// account stays in dry_run. Going live clears them (clearSimulatedDMs), so
+// the people who commented during the trial are answered for real the next
+// time they comment.
+
+const (
+	modeLive   = "live"
+	modeDryRun = "dry_run"
+	modePaused = "paused"
+)
+
+func validSendMode(mode string) bool {
+	return mode == modeLive || mode == modeDryRun || mode == modePaused
+}
+
+// accountMode returns the account's send mode; "" is the env account.
+func accountMode(accountID string) string {
+	if accountID == "" {
+		return config.SendMode
+	}
+
+	mode := modeLive
+	db.QueryRow("SELECT send_mode FROM tbl_ig_accounts WHERE id = $1", accountID).Scan(&mode)
+	return mode
+}
+
+// accountModeSQL is the send mode of the account owning a row of table, for
+// use in queue queries. Rows without an account use the parameter at
+// fallbackParam (config.SendMode).
+func accountModeSQL(table string, fallbackParam int) string {
+	return fmt.Sprintf(
+		"COALESCE((SELECT send_mode FROM tbl_ig_accounts a WHERE a.id = %s.ig_account_id), $%d)",
+		table, fallbackParam,
+	)
+}
+
+// logSimulatedDM records what a dry-run job would have sent.
+func logSimulatedDM(job DMJob, messages []OutboundMessage) {
+	summaries := make([]string, len(messages))
+	for i, m := range messages {
+		summaries[i] = simulatedText(m)
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO dm_logs (user_id, post_id, comment_id, status, retry_count, ig_account_id, message)
+		VALUES ($1, $2, $3, 'simulated', $4, NULLIF($5, '')::integer, $6)
+		ON CONFLICT (user_id, post_id) DO UPDATE
+		SET status = 'simulated',
+		    retry_count = $4,
+		    error_message = NULL,
+		    ig_account_id = NULLIF($5, '')::integer,
+		    message = $6,
+		    sent_at = CURRENT_TIMESTAMP
+	`, job.UserID, job.PostID, job.CommentID, job.Attempts-1, job.AccountID, strings.Join(summaries, "\n---\n"))
+
+	if err != nil {
+		log.Println("❌ Simulated DM log error:", err)
+	}
+}
+
+// logSimulatedFollowUp appends what a dry-run flow would have sent after its
+// first step (answers, timers, lead confirmations) to the simulated dm_logs
+// row of the post that started it.
+func logSimulatedFollowUp(s *FlowSession, messages []OutboundMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	summaries := make([]string, len(messages))
+	for i, m := range messages {
+		summaries[i] = simulatedText(m)
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO dm_logs (user_id, post_id, comment_id, status, ig_account_id, message)
+		VALUES ($1, $2, '', 'simulated', NULLIF($3, '')::integer, $4)
+		ON CONFLICT (user_id, post_id) DO UPDATE
+		SET message = COALESCE(dm_logs.message || E'\n---\n', '') || $4,
+		    sent_at = CURRENT_TIMESTAMP
+		WHERE dm_logs.status = 'simulated'
+	`, s.UserID, s.PostID, s.AccountID, strings.Join(summaries, "\n---\n"))
+
+	if err != nil {
+		log.Println("❌ Simulated follow-up log error:", err)
+	}
+}
+
+// clearSimulatedDMs forgets an account's dry-run DMs (accountID as in
+// jobAccountArg): the simulated dm_logs rows, their jobs and the flows they
+// started, so none of them count as already messaged once it is live.
+func clearSimulatedDMs(accountID string) (int64, error) {
+	account := jobAccountArg(accountID)
+
+	_, err := db.Exec(`
+		UPDATE tbl_flow_sessions f
+		SET status = $2, updated_at = NOW()
+		FROM dm_logs l
+		WHERE l.status = 'simulated' AND l.ig_account_id IS NOT DISTINCT FROM $1::integer
+		  AND f.ig_account_id = l.ig_account_id AND f.user_id = l.user_id AND f.post_id = l.post_id
+		  AND f.status IN ($3, $4, $5, $6)
+	`, account, flowExpired, flowActive, flowWaitingReply, flowWaitingTimer, flowWaitingWindow)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+
+	// Jobs simulated before they were marked as such finished as sent
+	_, err = db.Exec(`
+		DELETE FROM dm_jobs j
+		WHERE j.ig_account_id IS NOT DISTINCT FROM $1::integer
+		  AND (j.status = $2 OR (j.status = $3 AND EXISTS (
+		      SELECT 1 FROM dm_logs l
+		      WHERE l.user_id = j.user_id AND l.post_id = j.post_id AND l.status = 'simulated'
+		  )))
+	`, account, jobSimulated, jobSent)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+
+	res, err := db.Exec(`
+		DELETE FROM dm_logs
+		WHERE status = 'simulated' AND ig_account_id IS NOT DISTINCT FROM $1::integer
+	`, account)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// simulatedText is a message as a reviewer would read it: the text plus the
+// choices it offers.
+func simulatedText(m OutboundMessage) string {
+	var choices []string
+	for _, q := range m.QuickReplies {
+		choices = append(choices, q.Title)
+	}
+	if m.Attachment != nil {
+		for _, b := range m.Attachment.Payload.Buttons {
+			choices = append(choices, b.Title)
+		}
+	}
+
+	text := m.summary()
+	if len(choices) > 0 {
+		text += " [" + strings.Join(choices, " | ") + "]"
+	}
+	return text
+}
+
+// Get or change an account's send mode
+func accountModeHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var mode string
+	if r.Method == http.MethodPut {
+		var req struct {
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !validSendMode(req.Mode) {
+			http.Error(w, "mode must be live, dry_run or paused", http.StatusBadRequest)
+			return
+		}
+
+		err := db.QueryRow(`
+			UPDATE tbl_ig_accounts SET send_mode = $2, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+			RETURNING send_mode
+		`, accountID, req.Mode).Scan(&mode)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Account not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to update send mode: %v", err)
+			http.Error(w, "Failed to update send mode", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("🔀 Account %s send mode set to %s", accountID, mode)
+
+		if mode == modeLive {
+			if n, err := clearSimulatedDMs(accountID); err != nil {
+				log.Printf("❌ Failed to clear simulated DMs of account %s: %v", accountID, err)
+			} else if n > 0 {
+				log.Printf("🧹 Cleared %d simulated DM(s) of account %s", n, accountID)
+			}
+		}
+	} else {
+		err := db.QueryRow("SELECT send_mode FROM tbl_ig_accounts WHERE id = $1", accountID).Scan(&mode)
+		if err != nil {
+			http.Error(w, "Account not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"account_id": accountID,
+		"mode":       mode,
+	})
+}
+
+type SimulatedDM struct {
+	UserID      string    `json:"user_id"`
+	Username    string    `json:"username"`
+	PostID      string    `json:"post_id"`
+	CommentID   string    `json:"comment_id"`
+	CommentText string    `json:"comment_text"`
+	TriggerID   int       `json:"trigger_id,omitempty"`
+	TemplateID  int       `json:"template_id,omitempty"`
+	FlowID      int       `json:"flow_id,omitempty"`
+	Message     string    `json:"message"`
+	SimulatedAt time.Time `json:"simulated_at"`
+}
+
+// List the DMs a dry-run account would have sent, newest first
+// Filters: post_id, limit (default 50, max 500), offset
+func listSimulatedDMsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	limit, offset := 50, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	rows, err := db.Query(`
+		SELECT l.user_id, COALESCE(j.username, ''), l.post_id, l.comment_id, COALESCE(j.comment_text, ''),
+		       COALESCE(j.trigger_id, 0), COALESCE(j.template_id, 0), COALESCE(j.flow_id, 0),
+		       COALESCE(l.message, ''), l.sent_at
+		FROM dm_logs l
+		LEFT JOIN dm_jobs j ON j.user_id = l.user_id AND j.post_id = l.post_id
+		WHERE l.ig_account_id = $1 AND l.status = 'simulated'
+		  AND ($2 = '' OR l.post_id = $2)
+		ORDER BY l.sent_at DESC, l.id DESC
+		LIMIT $3 OFFSET $4
+	`, accountID, q.Get("post_id"), limit, offset)
+	if err != nil {
+		log.Printf("Failed to list simulated DMs: %v", err)
+		http.Error(w, "Failed to list simulated DMs", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	dms := []SimulatedDM{}
+	for rows.Next() {
+		var d SimulatedDM
+		if err := rows.Scan(&d.UserID, &d.Username, &d.PostID, &d.CommentID, &d.CommentText,
+			&d.TriggerID, &d.TemplateID, &d.FlowID, &d.Message, &d.SimulatedAt); err != nil {
+			log.Printf("Failed to scan simulated DM: %v", err)
+			http.Error(w, "Failed to list simulated DMs", http.StatusInternalServerError)
+			return
+		}
+		dms = append(dms, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"simulated": dms,
+		"count":     len(dms),
+		"limit":     limit,
+		"offset":    offset,
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"instagram-autodm/graph/graphtest"
+)
+
+func TestValidSendMode(t *testing.T) {
+	for mode, want := range map[string]bool{
+		modeLive: true, modeDryRun: true, modePaused: true,
+		"": false, "Live": false, "off": false,
+	} {
+		if got := validSendMode(mode); got != want {
+			t.Errorf("validSendMode(%q) = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestSimulatedText(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  OutboundMessage
+		want string
+	}{
+		{"text", OutboundMessage{Text: "Here you go!"}, "Here you go!"},
+		{"quick replies", OutboundMessage{Text: "Want it?", QuickReplies: []QuickReply{{Title: "Yes"}, {Title: "No"}}}, "Want it? [Yes | No]"},
+		{"buttons", OutboundMessage{Attachment: &Attachment{Type: "template", Payload: TemplatePayload{
+			TemplateType: "button", Text: "Pick one", Buttons: []Button{{Title: "Call me"}, {Title: "Shop"}},
+		}}}, "Pick one [Call me | Shop]"},
+		{"cards", productCards([]*Product{{Name: "One"}, {Name: "Two"}}), "[cards] One, Two"},
+	}
+
+	for _, tt := range tests {
+		if got := simulatedText(tt.msg); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func insertTestAccount(t *testing.T, mode string) string {
+	t.Helper()
+
+	var accountID string
+	err := db.QueryRow(`
+		INSERT INTO tbl_ig_accounts (platform_ig_account_id, username, access_token, send_mode)
+		VALUES ('17841400000000002', 'creator', 'account_token', $1)
+		RETURNING id
+	`, mode).Scan(&accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accountID
+}
+
+func setAccountMode(t *testing.T, accountID, mode string) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE tbl_ig_accounts SET send_mode = $2 WHERE id = $1", accountID, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPausedAccountHoldsJobs(t *testing.T) {
+	setupQueueTest(t)
+	accountID := insertTestAccount(t, modeLive)
+
+	// Queued while live, then paused: the job waits
+	queued, err := enqueueDMJob(DMJob{AccountID: accountID, UserID: "u1", PostID: "17900000000000001", CommentID: "c1"}, 0)
+	if err != nil || !queued {
+		t.Fatalf("enqueue: %v, queued=%v", err, queued)
+	}
+	setAccountMode(t, accountID, modePaused)
+	if job, _ := claimDMJob(); job != nil {
+		t.Fatalf("claimed job %d of a paused account", job.ID)
+	}
+
+	// New comments aren't answered at all
+	if _, queued := queueTriggeredDM(accountID, testComment("c2", "u2"), 0); queued {
+		t.Error("paused account queued a DM")
+	}
+
+	setAccountMode(t, accountID, modeDryRun)
+	job, err := claimDMJob()
+	if err != nil || job == nil {
+		t.Fatalf("claim after unpausing: %v, %v", job, err)
+	}
+	if !job.DryRun || job.CommentID != "c1" {
+		t.Errorf("claimed %+v, want the dry-run job for c1", job)
+	}
+}
+
+func TestDryRunSimulatesDM(t *testing.T) {
+	srv := setupQueueTest(t)
+	config.SendMode = modeDryRun
+
+	c := testComment("c1", "u1")
+	processAccountComment("", c)
+	job := runDueJob(t)
+
+	if reqs := srv.RequestsTo(graphtest.Messages); len(reqs) != 0 {
+		t.Errorf("dry run sent %d messages to the Graph API", len(reqs))
+	}
+	if got := dmLogStatus("u1", c.MediaID); got != "simulated" {
+		t.Errorf("dm_logs status = %q, want simulated", got)
+	}
+	var message string
+	db.QueryRow("SELECT message FROM dm_logs WHERE user_id = 'u1'").Scan(&message)
+	if message != config.DMMessage {
+		t.Errorf("simulated message = %q, want %q", message, config.DMMessage)
+	}
+	if got, _ := jobStatus(t, job.ID); got != jobSimulated {
+		t.Errorf("job status = %s, want %s", got, jobSimulated)
+	}
+
+	// Answered in dry run counts for dedup
+	processAccountComment("", testComment("c2", "u1"))
+	if job, _ := claimDMJob(); job != nil {
+		t.Errorf("duplicate comment queued job %d", job.ID)
+	}
+}
+
+func TestGoingLiveClearsSimulatedDMs(t *testing.T) {
+	setupQueueTest(t)
+	config.SendMode = modeDryRun
+
+	processAccountComment("", testComment("c1", "u1"))
+	runDueJob(t)
+
+	config.SendMode = modeLive
+	if n, err := clearSimulatedDMs(envAccountID); err != nil || n != 1 {
+		t.Fatalf("cleared %d simulated DM(s), err %v; want 1", n, err)
+	}
+	if got := dmLogStatus("u1", testComment("c1", "u1").MediaID); got != "" {
+		t.Errorf("dm_logs status = %q after going live, want no row", got)
+	}
+
+	// The dry-run commenter is answered for real next time
+	processAccountComment("", testComment("c2", "u1"))
+	if job, _ := claimDMJob(); job == nil {
+		t.Error("comment after going live wasn't queued")
+	}
+}
+
+// startTestFlowSession saves a session of a two-node flow waiting for the
+// user's answer.
+func startTestFlowSession(t *testing.T, accountID string) *FlowSession {
+	t.Helper()
+
+	def := FlowDefinition{Start: "ask", Nodes: map[string]FlowNode{
+		"ask":    {Type: FlowNodeQuickReplies, Text: "Want it?", Options: []FlowOption{{Title: "Yes", Next: "thanks"}}},
+		"thanks": {Type: FlowNodeText, Text: "Here it is"},
+	}}
+	flowID, err := createFlow(accountID, Flow{Name: "ask", Definition: def, IsActive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &FlowSession{AccountID: accountID, FlowID: flowID, UserID: "u1", PostID: "17900000000000001", NodeID: "ask", Status: flowWaitingReply}
+	saveFlowSession(s)
+	return s
+}
+
+func TestPausedAccountHoldsFlows(t *testing.T) {
+	srv := setupQueueTest(t)
+	accountID := insertTestAccount(t, modePaused)
+	s := startTestFlowSession(t, accountID)
+
+	handleFlowReply(accountID, "u1", "Yes", "Yes")
+	if status, node := flowSessionStatus(t, accountID, "u1"); status != flowWaitingReply || node != "ask" {
+		t.Errorf("paused: session %s at %q, want still waiting at ask", status, node)
+	}
+
+	s.Status, s.ResumeAt = flowWaitingTimer, time.Now().Add(-time.Minute)
+	saveFlowSession(s)
+	if sessions, err := claimDueFlowSessions(); err != nil || len(sessions) != 0 {
+		t.Errorf("paused: claimed %d due session(s), err %v", len(sessions), err)
+	}
+	if n := len(srv.RequestsTo(graphtest.Messages)); n != 0 {
+		t.Errorf("paused account sent %d messages", n)
+	}
+
+	// Back live, the timer fires
+	setAccountMode(t, accountID, modeLive)
+	if sessions, err := claimDueFlowSessions(); err != nil || len(sessions) != 1 {
+		t.Errorf("live: claimed %d due session(s), err %v", len(sessions), err)
+	}
+}
+
+func TestDryRunFlowFollowUpIsLogged(t *testing.T) {
+	srv := setupQueueTest(t)
+	accountID := insertTestAccount(t, modeDryRun)
+	s := startTestFlowSession(t, accountID)
+	logSimulatedDM(DMJob{AccountID: accountID, UserID: "u1", PostID: s.PostID}, []OutboundMessage{{Text: "Want it?"}})
+
+	recordConversationMessage("17841400000000002", "u1", directionInbound, "m1", "Yes", time.Now())
+	handleFlowReply(accountID, "u1", "Yes", "Yes")
+
+	if n := len(srv.RequestsTo(graphtest.Messages)); n != 0 {
+		t.Errorf("dry run sent %d messages", n)
+	}
+	if status, _ := flowSessionStatus(t, accountID, "u1"); status != flowCompleted {
+		t.Errorf("session %s, want %s", status, flowCompleted)
+	}
+	var message string
+	db.QueryRow("SELECT message FROM dm_logs WHERE user_id = 'u1'").Scan(&message)
+	if message != "Want it?\n---\nHere it is" {
+		t.Errorf("simulated messages = %q", message)
+	}
+}
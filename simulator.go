@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ============================================
+// WEBHOOK SIMULATOR
+// ============================================
+
+// Builds webhook deliveries shaped (and signed) like Meta's and posts them
+// to a running server, so triggers can be tested without commenting on a
+// real post:
+//
+//	go run . simulate -media 1790 -user 123 -username jane -text "info please"
+//	go run . simulate -text info -count 200 -duplicates 1 -concurrency 20
+//
+// The same runs are available to logged-in creators through
+// POST /api/accounts/:account_id/webhook/simulate.
+
+const (
+	// Most deliveries one simulation may send
+	maxSimulatedDeliveries = 5000
+	// Most deliveries in flight at once
+	maxSimulationConcurrency = 100
+)
+
+type SimulationRequest struct {
+	Field    string `json:"field"` // comments (default), live_comments or messages
+	MediaID  string `json:"media_id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	// Burst size. Each comment gets its own ID and, unless SameUser, its own
+	// commenter (user_id-1, user_id-2, …) so they aren't deduplicated.
+	Count    int  `json:"count"`
+	SameUser bool `json:"same_user"`
+	// Extra deliveries of every payload, as when Meta retries a webhook
+	Duplicates  int `json:"duplicates"`
+	Concurrency int `json:"concurrency"`
+
+	igID   string // entry id: the receiving IG account
+	url    string
+	secret string // "" sends unsigned
+}
+
+type SimulationResult struct {
+	Deliveries int            `json:"deliveries"`
+	Failed     int            `json:"failed"`
+	Statuses   map[string]int `json:"statuses"`
+	Errors     []string       `json:"errors,omitempty"`
+	Duration   string         `json:"duration"`
+	PerSecond  float64        `json:"per_second"`
+}
+
+func (req *SimulationRequest) validate() error {
+	if req.Field == "" {
+		req.Field = "comments"
+	}
+	if req.Field != "comments" && req.Field != "live_comments" && req.Field != "messages" {
+		return fmt.Errorf("field must be comments, live_comments or messages")
+	}
+	if req.Text == "" {
+		return fmt.Errorf("text is required")
+	}
+	if req.MediaID == "" && req.Field != "messages" {
+		return fmt.Errorf("media_id is required for %s", req.Field)
+	}
+	if req.UserID == "" {
+		req.UserID = "sim_user"
+	}
+	if req.Username == "" {
+		req.Username = req.UserID
+	}
+	if req.Count < 1 {
+		req.Count = 1
+	}
+	if req.Duplicates < 0 {
+		return fmt.Errorf("duplicates can't be negative")
+	}
+	if req.Count > maxSimulatedDeliveries || req.Duplicates >= maxSimulatedDeliveries ||
+		req.Count*(req.Duplicates+1) > maxSimulatedDeliveries {
+		return fmt.Errorf("at most %d deliveries per simulation", maxSimulatedDeliveries)
+	}
+
+	// No more workers than deliveries, and never an unbounded fan-out
+	deliveries := req.Count * (req.Duplicates + 1)
+	if req.Concurrency > deliveries {
+		req.Concurrency = deliveries
+	}
+	if req.Concurrency > maxSimulationConcurrency {
+		req.Concurrency = maxSimulationConcurrency
+	}
+	if req.Concurrency < 1 {
+		req.Concurrency = 1
+	}
+	return nil
+}
+
+// simulationPayloads builds one payload per simulated event.
+func simulationPayloads(req SimulationRequest) [][]byte {
+	now := time.Now()
+	run := now.UnixNano()
+
+	payloads := make([][]byte, 0, req.Count)
+	for i := 1; i <= req.Count; i++ {
+		userID, username := req.UserID, req.Username
+		if req.Count > 1 && !req.SameUser {
+			userID = fmt.Sprintf("%s-%d", req.UserID, i)
+			username = fmt.Sprintf("%s_%d", req.Username, i)
+		}
+
+		entry := map[string]interface{}{
+			"id":   req.igID,
+			"time": now.Unix(),
+		}
+		if req.Field == "messages" {
+			entry["messaging"] = []interface{}{map[string]interface{}{
+				"sender":    map[string]string{"id": userID},
+				"recipient": map[string]string{"id": req.igID},
+				"timestamp": now.UnixMilli(),
+				"message": map[string]string{
+					"mid":  fmt.Sprintf("sim_mid_%d_%d", run, i),
+					"text": req.Text,
+				},
+			}}
+		} else {
+			productType := "FEED"
+			if req.Field == "live_comments" {
+				productType = "LIVE"
+			}
+			entry["changes"] = []interface{}{map[string]interface{}{
+				"field": req.Field,
+				"value": map[string]interface{}{
+					"id":   fmt.Sprintf("sim_%d_%d", run, i),
+					"text": req.Text,
+					"from": map[string]string{"id": userID, "username": username},
+					"media": map[string]string{
+						"id":                 req.MediaID,
+						"media_product_type": productType,
+					},
+				},
+			}}
+		}
+
+		b, _ := json.Marshal(map[string]interface{}{
+			"object": "instagram",
+			"entry":  []interface{}{entry},
+		})
+		payloads = append(payloads, b)
+	}
+
+	return payloads
+}
+
+// simulateWebhook posts the simulated deliveries to req.url, each payload
+// 1 + Duplicates times, with up to Concurrency in flight.
+func simulateWebhook(req SimulationRequest) SimulationResult {
+	var deliveries [][]byte
+	for _, p := range simulationPayloads(req) {
+		for d := 0; d <= req.Duplicates; d++ {
+			deliveries = append(deliveries, p)
+		}
+	}
+
+	result := SimulationResult{Deliveries: len(deliveries), Statuses: map[string]int{}}
+	var mu sync.Mutex
+	record := func(status string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.Statuses[status]++
+		if err != nil {
+			result.Failed++
+			if len(result.Errors) < 10 {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	work := make(chan []byte)
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for w := 0; w < req.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for body := range work {
+				httpReq, _ := http.NewRequest("POST", req.url, bytes.NewReader(body))
+				httpReq.Header.Set("Content-Type", "application/json")
+				if req.secret != "" {
+					httpReq.Header.Set(signatureHeader, "sha256="+hex.EncodeToString(hmacSHA256([]byte(req.secret), body)))
+				}
+
+				resp, err := client.Do(httpReq)
+				if err != nil {
+					record("error", err)
+					continue
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != http.StatusOK {
+					record(fmt.Sprint(resp.StatusCode), fmt.Errorf("webhook returned %s", resp.Status))
+					continue
+				}
+				record(fmt.Sprint(resp.StatusCode), nil)
+			}
+		}()
+	}
+
+	for _, body := range deliveries {
+		work <- body
+	}
+	close(work)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	result.Duration = elapsed.Round(time.Millisecond).String()
+	if elapsed > 0 {
+		result.PerSecond = float64(len(deliveries)) / elapsed.Seconds()
+	}
+	return result
+}
+
+// CLI: go run . simulate [flags]
+func runSimulateCommand(args []string) int {
+	secret := ""
+	if len(config.AppSecrets) > 0 {
+		secret = config.AppSecrets[0]
+	}
+
+	var req SimulationRequest
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	fs.StringVar(&req.url, "url", "http://localhost:"+config.Port+"/webhook", "webhook URL of the running server")
+	fs.StringVar(&req.secret, "secret", secret, "app secret to sign with (default: first APP_SECRET)")
+	fs.StringVar(&req.igID, "ig-id", config.IGBusinessID, "receiving Instagram account ID (default: IG_BUSINESS_ID)")
+	fs.StringVar(&req.Field, "field", "comments", "comments, live_comments or messages")
+	fs.StringVar(&req.MediaID, "media", "", "media ID the comment is on")
+	fs.StringVar(&req.UserID, "user", "sim_user", "commenter/sender user ID")
+	fs.StringVar(&req.Username, "username", "", "commenter username (default: user ID)")
+	fs.StringVar(&req.Text, "text", "", "comment or message text")
+	fs.IntVar(&req.Count, "count", 1, "number of events in the burst")
+	fs.BoolVar(&req.SameUser, "same-user", false, "send the whole burst from one user")
+	fs.IntVar(&req.Duplicates, "duplicates", 0, "extra deliveries of each event")
+	fs.IntVar(&req.Concurrency, "concurrency", 1, "deliveries in flight at once")
+	fs.Parse(args)
+
+	if req.igID == "" {
+		log.Println("❌ -ig-id (or IG_BUSINESS_ID) is required")
+		return 2
+	}
+	if err := req.validate(); err != nil {
+		log.Println("❌", err)
+		return 2
+	}
+	if req.secret == "" {
+		log.Println("⚠️  No app secret, sending unsigned deliveries")
+	}
+
+	log.Printf("🧪 Simulating %d %s event(s) x%d to %s", req.Count, req.Field, req.Duplicates+1, req.url)
+	result := simulateWebhook(req)
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Simulate webhook deliveries to this server for one of the creator's accounts
+func simulateWebhookHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req SimulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var mode string
+	err := db.QueryRow(
+		"SELECT platform_ig_account_id, send_mode FROM tbl_ig_accounts WHERE id = $1",
+		accountID,
+	).Scan(&req.igID, &mode)
+	if err != nil {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	// Simulated commenters would otherwise get real DMs
+	if mode != modeDryRun {
+		http.Error(w, "Simulations only run against accounts in dry_run mode", http.StatusConflict)
+		return
+	}
+
+	req.url = "http://127.0.0.1:" + config.Port + "/webhook"
+	if len(config.AppSecrets) > 0 {
+		req.secret = config.AppSecrets[0]
+	}
+
+	log.Printf("🧪 Simulating %d %s event(s) x%d for account %s", req.Count, req.Field, req.Duplicates+1, accountID)
+	result := simulateWebhook(req)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"account_id": accountID,
+		"ig_id":      req.igID,
+		"result":     result,
+	})
+}
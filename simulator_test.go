@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestSimulationRequestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		req  SimulationRequest
+		ok   bool
+	}{
+		{"comment", SimulationRequest{MediaID: "1790", Text: "info"}, true},
+		{"live comment", SimulationRequest{Field: "live_comments", MediaID: "1790", Text: "info"}, true},
+		{"message without media", SimulationRequest{Field: "messages", Text: "yes"}, true},
+		{"unknown field", SimulationRequest{Field: "mentions", MediaID: "1790", Text: "info"}, false},
+		{"no text", SimulationRequest{MediaID: "1790"}, false},
+		{"comment without media", SimulationRequest{Text: "info"}, false},
+		{"negative duplicates", SimulationRequest{MediaID: "1790", Text: "info", Duplicates: -1}, false},
+		{"at the cap", SimulationRequest{MediaID: "1790", Text: "info", Count: 2500, Duplicates: 1}, true},
+		{"over the cap", SimulationRequest{MediaID: "1790", Text: "info", Count: 2501, Duplicates: 1}, false},
+		{"overflowing duplicates", SimulationRequest{MediaID: "1790", Text: "info", Count: 2, Duplicates: math.MaxInt / 2}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.req.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+
+	req := SimulationRequest{MediaID: "1790", Text: "info"}
+	req.validate()
+	if req.Field != "comments" || req.UserID != "sim_user" || req.Username != "sim_user" || req.Count != 1 || req.Concurrency != 1 {
+		t.Errorf("defaults not filled in: %+v", req)
+	}
+
+	concurrency := []struct {
+		count, concurrency, want int
+	}{
+		{3, 50, 3},
+		{5000, 1000, maxSimulationConcurrency},
+		{10, 4, 4},
+	}
+	for _, tt := range concurrency {
+		req := SimulationRequest{MediaID: "1790", Text: "info", Count: tt.count, Concurrency: tt.concurrency}
+		if err := req.validate(); err != nil || req.Concurrency != tt.want {
+			t.Errorf("count %d, concurrency %d: got %d (%v), want %d", tt.count, tt.concurrency, req.Concurrency, err, tt.want)
+		}
+	}
+}
+
+func TestSimulationPayloads(t *testing.T) {
+	req := SimulationRequest{Field: "live_comments", MediaID: "1790", UserID: "42", Username: "jane", Text: "info", Count: 3, igID: "1784"}
+	payloads := simulationPayloads(req)
+	if len(payloads) != 3 {
+		t.Fatalf("got %d payloads, want 3", len(payloads))
+	}
+
+	ids := map[string]bool{}
+	for i, p := range payloads {
+		var payload WebhookPayload
+		if err := json.Unmarshal(p, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Object != "instagram" || len(payload.Entry) != 1 || payload.Entry[0].ID != "1784" || len(payload.Entry[0].Changes) != 1 {
+			t.Fatalf("payload %d: %s", i, p)
+		}
+		change := payload.Entry[0].Changes[0]
+		var c CommentData
+		json.Unmarshal(change.Value, &c)
+		c = c.normalized()
+
+		if change.Field != "live_comments" || c.MediaID != "1790" || c.Media.MediaProductType != "LIVE" || c.Text != "info" {
+			t.Errorf("payload %d: %s", i, p)
+		}
+		// Each comment of a burst is a new comment from a new user
+		if ids[c.ID] || ids[c.From.ID] {
+			t.Errorf("payload %d repeats comment %s or user %s", i, c.ID, c.From.ID)
+		}
+		ids[c.ID], ids[c.From.ID] = true, true
+	}
+
+	req = SimulationRequest{Field: "messages", UserID: "42", Text: "yes", Count: 2, SameUser: true, igID: "1784"}
+	for i, p := range simulationPayloads(req) {
+		var payload WebhookPayload
+		json.Unmarshal(p, &payload)
+		if len(payload.Entry) != 1 || len(payload.Entry[0].Messaging) != 1 {
+			t.Fatalf("message payload %d: %s", i, p)
+		}
+		event := payload.Entry[0].Messaging[0]
+		if event.Sender.ID != "42" || event.Recipient.ID != "1784" || event.Message == nil || event.Message.Text != "yes" || event.Message.Mid == "" {
+			t.Errorf("message payload %d: %s", i, p)
+		}
+	}
+}
+
+func TestSimulateWebhookIsSigned(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config.AppSecrets = []string{"s3cret"}
+
+	var mu sync.Mutex
+	bodies := map[string]int{}
+	router := httprouter.New()
+	router.POST("/webhook", verifyWebhookSignature(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies[string(body)]++
+		mu.Unlock()
+	}))
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	req := SimulationRequest{MediaID: "1790", Text: "info", Count: 5, Duplicates: 1, Concurrency: 3, igID: "1784", url: srv.URL + "/webhook", secret: "s3cret"}
+	req.validate()
+
+	result := simulateWebhook(req)
+	if result.Deliveries != 10 || result.Failed != 0 || result.Statuses["200"] != 10 {
+		t.Errorf("result = %+v, want 10 accepted deliveries", result)
+	}
+	if len(bodies) != 5 {
+		t.Errorf("server saw %d distinct payloads, want 5", len(bodies))
+	}
+	for body, n := range bodies {
+		if n != 2 {
+			t.Errorf("payload delivered %d times, want 2: %s", n, body)
+		}
+	}
+
+	req.secret = "wrong"
+	if result := simulateWebhook(req); result.Failed != 10 || result.Statuses["401"] != 10 {
+		t.Errorf("wrongly signed: result = %+v, want 10 rejected", result)
+	}
+}
+
+func TestSimulateWebhookHandlerNeedsDryRun(t *testing.T) {
+	setupTestDB(t)
+	token, _ := generateJWT(1, "owner@example.com")
+
+	router := httprouter.New()
+	router.POST("/api/accounts/:account_id/webhook/simulate", simulateWebhookHandler)
+
+	for _, mode := range []string{modeLive, modePaused} {
+		accountID := insertTestAccount(t, mode)
+		req := httptest.NewRequest("POST", "/api/accounts/"+accountID+"/webhook/simulate",
+			strings.NewReader(`{"media_id": "1790", "text": "info"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusConflict {
+			t.Errorf("%s account: got %d, want 409", mode, rec.Code)
+		}
+		db.Exec("DELETE FROM tbl_ig_accounts WHERE id = $1", accountID)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ============================================
+// FILE STORAGE (digital product downloads)
+// ============================================
+
+// Files are uploaded out of band (copied into STORAGE_DIR, or put in the S3
+// bucket) under the account's id and referenced from a template by the rest
+// of the key: "guides/summer.pdf" on account 3 is stored as
+// "3/guides/summer.pdf", so a template can only hand out its own account's
+// files.
+
+type FileStorage interface {
+	// Serve sends the file to the client, directly or by redirect
+	Serve(w http.ResponseWriter, r *http.Request, key string) error
+	Exists(key string) (bool, error)
+}
+
+// fileStorage is set up in main from STORAGE_BACKEND
+var fileStorage FileStorage
+
+func newFileStorage(cfg Config) (FileStorage, error) {
+	switch cfg.StorageBackend {
+	case "", "local":
+		return localStorage{dir: cfg.StorageDir}, nil
+	case "s3":
+		if cfg.S3Bucket == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+			return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required for STORAGE_BACKEND=s3")
+		}
+		return s3Storage{
+			endpoint:  strings.TrimRight(cfg.S3Endpoint, "/"),
+			bucket:    cfg.S3Bucket,
+			region:    cfg.S3Region,
+			accessKey: cfg.S3AccessKey,
+			secretKey: cfg.S3SecretKey,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", cfg.StorageBackend)
+	}
+}
+
+// cleanStorageKey rejects keys that would escape the storage root.
+func cleanStorageKey(key string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if clean == "" || clean != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("invalid file key %q", key)
+	}
+	return clean, nil
+}
+
+// accountFileKey is the storage key of an account's file.
+func accountFileKey(accountID int, key string) (string, error) {
+	clean, err := cleanStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%s", accountID, clean), nil
+}
+
+// attachmentDisposition is the Content-Disposition for downloading key.
+func attachmentDisposition(key string) string {
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)}); v != "" {
+		return v
+	}
+	return "attachment"
+}
+
+// LOCAL DIRECTORY
+type localStorage struct {
+	dir string
+}
+
+func (s localStorage) path(key string) (string, error) {
+	clean, err := cleanStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+func (s localStorage) Serve(w http.ResponseWriter, r *http.Request, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Disposition", attachmentDisposition(key))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+func (s localStorage) Exists(key string) (bool, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+// S3-COMPATIBLE BUCKET
+// Downloads redirect to a short-lived presigned URL (SigV4, path-style, so
+// MinIO, R2 and friends work with S3_ENDPOINT).
+type s3Storage struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+const s3PresignExpiry = 5 * time.Minute
+
+func (s s3Storage) Serve(w http.ResponseWriter, r *http.Request, key string) error {
+	u, err := s.presign(http.MethodGet, key, s3PresignExpiry, time.Now())
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, u, http.StatusFound)
+	return nil
+}
+
+func (s s3Storage) Exists(key string) (bool, error) {
+	u, err := s.presign(http.MethodHead, key, s3PresignExpiry, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Head(u)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("s3 HEAD %s: %s", key, resp.Status)
+	}
+}
+
+// presign builds a SigV4 query-signed URL for key.
+func (s s3Storage) presign(method, key string, expiry time.Duration, now time.Time) (string, error) {
+	clean, err := cleanStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint, err := url.Parse(s.endpoint)
+	if err != nil || endpoint.Host == "" {
+		return "", fmt.Errorf("invalid S3_ENDPOINT %q", s.endpoint)
+	}
+
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	objectPath := "/" + clean
+	if s.bucket != "" {
+		objectPath = "/" + s.bucket + objectPath
+	}
+	uri := awsURIEncode(objectPath, false)
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.accessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       fmt.Sprintf("%d", int(expiry.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = awsURIEncode(name, true) + "=" + awsURIEncode(query[name], true)
+	}
+	canonicalQuery := strings.Join(pairs, "&")
+
+	canonicalRequest := strings.Join([]string{
+		method, uri, canonicalQuery, "host:" + endpoint.Host + "\n", "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key4 := hmacSHA256([]byte("AWS4"+s.secretKey), []byte(date))
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key4 = hmacSHA256(key4, []byte(part))
+	}
+	signature := hex.EncodeToString(hmacSHA256(key4, []byte(stringToSign)))
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", endpoint.Scheme, endpoint.Host, uri, canonicalQuery, signature), nil
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters (and
+// "/" unless encodeSlash), as SigV4 canonical requests require.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ============================================
+// DM TEMPLATE RENDERING
+// ============================================
+
+// Templates are plain text with {{variable}} placeholders. The include_*
+// flags control whether the download link / product block is part of the
+// message: if a flag is on and the text doesn't place the value itself, it
+// is appended; if a flag is off, its variables render empty.
+
+type DMTemplate struct {
+	ID                  int
+	AccountID           int
+	ProductID           int
+	Name                string
+	MessageText         string
+	IncludeDownloadLink bool
+	DownloadLink        string
+	DownloadFile        string // storage key; delivered through a signed per-recipient link
+	IncludeProductInfo  bool
+}
+
+type Product struct {
+	ID          int
+	Name        string
+	Description string
+	Price       float64
+	ImageURL    string
+	ProductLink string
+}
+
+// TemplateData is what a template is rendered against.
+type TemplateData struct {
+	Username    string
+	CommentText string
+	Product     *Product
+	// The product goes out as a card, so don't append the product block
+	ProductAsCard bool
+}
+
+type TemplatePreviewRequest struct {
+	Username    string `json:"username"`
+	CommentText string `json:"comment_text"`
+	ProductID   int    `json:"product_id"`
+}
+
+var templateVarPattern = regexp.MustCompile(`\{\{\s*([A-Za-z_.]+)\s*\}\}`)
+
+// Supported template variables
+var templateVariables = map[string]bool{
+	"username":            true,
+	"comment.text":        true,
+	"product.name":        true,
+	"product.description": true,
+	"product.price":       true,
+	"product.link":        true,
+	"product.image_url":   true,
+	"download_link":       true,
+}
+
+// validateTemplateText rejects unknown variables so typos surface when the
+// template is saved instead of in a follower's inbox.
+func validateTemplateText(text string) error {
+	var unknown []string
+	for _, m := range templateVarPattern.FindAllStringSubmatch(text, -1) {
+		if !templateVariables[m[1]] {
+			unknown = append(unknown, m[0])
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown template variables: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func validateDMTemplate(req CreateDMTemplateRequest) error {
+	if strings.TrimSpace(req.MessageText) == "" {
+		return fmt.Errorf("message_text is required")
+	}
+	if len(req.ProductIDs) > maxCarouselCards {
+		return fmt.Errorf("at most %d product_ids are allowed", maxCarouselCards)
+	}
+	if req.IncludeDownloadLink && req.DownloadLink == "" && req.DownloadFile == "" {
+		return fmt.Errorf("download_link or download_file is required when include_download_link is set")
+	}
+	return validateTemplateText(req.MessageText)
+}
+
+// renderTemplate builds the final message text.
+func renderTemplate(t DMTemplate, data TemplateData) (string, error) {
+	if err := validateTemplateText(t.MessageText); err != nil {
+		return "", err
+	}
+
+	product := data.Product
+	if !t.IncludeProductInfo || product == nil {
+		product = &Product{}
+	}
+	downloadLink := ""
+	if t.IncludeDownloadLink {
+		downloadLink = t.DownloadLink
+	}
+
+	values := map[string]string{
+		"username":            data.Username,
+		"comment.text":        data.CommentText,
+		"product.name":        product.Name,
+		"product.description": product.Description,
+		"product.price":       "",
+		"product.link":        product.ProductLink,
+		"product.image_url":   product.ImageURL,
+		"download_link":       downloadLink,
+	}
+	if product.Price > 0 {
+		values["product.price"] = fmt.Sprintf("%.2f", product.Price)
+	}
+
+	used := map[string]bool{}
+	out := templateVarPattern.ReplaceAllStringFunc(t.MessageText, func(m string) string {
+		name := templateVarPattern.FindStringSubmatch(m)[1]
+		used[name] = true
+		return values[name]
+	})
+
+	var extra []string
+	if t.IncludeProductInfo && data.Product != nil && !data.ProductAsCard && !usesProductVars(used) {
+		extra = append(extra, productBlock(data.Product))
+	}
+	if downloadLink != "" && !used["download_link"] {
+		extra = append(extra, downloadLink)
+	}
+	if len(extra) > 0 {
+		out = strings.TrimRight(out, "\n ") + "\n\n" + strings.Join(extra, "\n\n")
+	}
+
+	return out, nil
+}
+
+func usesProductVars(used map[string]bool) bool {
+	for name := range used {
+		if strings.HasPrefix(name, "product.") {
+			return true
+		}
+	}
+	return false
+}
+
+func productBlock(p *Product) string {
+	lines := []string{p.Name}
+	if p.Price > 0 {
+		lines[0] = fmt.Sprintf("%s - %.2f", p.Name, p.Price)
+	}
+	if p.Description != "" {
+		lines = append(lines, p.Description)
+	}
+	if p.ProductLink != "" {
+		lines = append(lines, p.ProductLink)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderMessageForJob renders the job's template, falling back to
+// DM_MESSAGE when the job has no template or it can't be rendered.
+func renderMessageForJob(job DMJob) string {
+	msg, _ := renderJob(job, false)
+	return msg
+}
+
+// renderJob is renderMessageForJob that also returns the job's template, or
+// nil when DM_MESSAGE was used. With asCard the product block is left out.
+func renderJob(job DMJob, asCard bool) (string, *DMTemplate) {
+	if job.TemplateID == 0 {
+		return config.DMMessage, nil
+	}
+
+	t, err := loadDMTemplate(job.TemplateID)
+	if err != nil {
+		log.Printf("⚠️ Failed to load DM template %d, using DM_MESSAGE: %v", job.TemplateID, err)
+		return config.DMMessage, nil
+	}
+
+	if t.IncludeDownloadLink && t.DownloadFile != "" {
+		// Falls back to the static download_link if the grant can't be issued
+		if link, err := signedDownloadURL(t, job); err != nil {
+			log.Printf("⚠️ Failed to sign download of %s: %v", t.DownloadFile, err)
+		} else {
+			t.DownloadLink = link
+		}
+	}
+
+	var product *Product
+	if productID := jobProductID(job, t); productID != 0 {
+		if product, err = loadProduct(productID); err != nil {
+			log.Printf("⚠️ Failed to load product %d: %v", productID, err)
+		}
+	}
+
+	msg, err := renderTemplate(*t, TemplateData{
+		Username:      job.Username,
+		CommentText:   job.Text,
+		Product:       product,
+		ProductAsCard: asCard,
+	})
+	if err != nil || (!asCard && strings.TrimSpace(msg) == "") {
+		log.Printf("⚠️ Failed to render DM template %d, using DM_MESSAGE: %v", job.TemplateID, err)
+		return config.DMMessage, nil
+	}
+
+	return msg, t
+}
+
+// jobProductID is the product picked for the job's post, else the template's.
+func jobProductID(job DMJob, t *DMTemplate) int {
+	if job.ProductID != 0 {
+		return job.ProductID
+	}
+	return t.ProductID
+}
+
+// Preview Template
+func previewDMTemplateHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req TemplatePreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" {
+		req.Username = "sample_user"
+	}
+
+	templateID, _ := strconv.Atoi(p.ByName("template_id"))
+	t, err := loadDMTemplate(templateID)
+	if err != nil || strconv.Itoa(t.AccountID) != accountID {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	productID := req.ProductID
+	if productID == 0 {
+		productID = t.ProductID
+	}
+	var product *Product
+	if productID != 0 {
+		product, _ = loadProduct(productID)
+	}
+	if t.DownloadFile != "" {
+		t.DownloadLink = config.PublicBaseURL + "/d/<per-recipient signed link>"
+	}
+
+	msg, err := renderTemplate(*t, TemplateData{
+		Username:    req.Username,
+		CommentText: req.CommentText,
+		Product:     product,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Cards that follow the text when the user's messaging window is open
+	cards := []GenericElement{}
+	if t.IncludeProductInfo {
+		for _, p := range templateProducts(t, productID) {
+			cards = append(cards, productCard(p))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"template_id": t.ID,
+		"message":     msg,
+		"cards":       cards,
+	})
+}
+
+func loadDMTemplate(templateID int) (*DMTemplate, error) {
+	var t DMTemplate
+	err := db.QueryRow(`
+		SELECT id, COALESCE(ig_account_id, 0), COALESCE(product_id, 0), COALESCE(template_name, ''),
+		       COALESCE(message_text, ''), COALESCE(include_download_link, false),
+		       COALESCE(download_link, ''), COALESCE(download_file, ''), COALESCE(include_product_info, false)
+		FROM tbl_dm_templates
+		WHERE id = $1
+	`, templateID).Scan(&t.ID, &t.AccountID, &t.ProductID, &t.Name, &t.MessageText,
+		&t.IncludeDownloadLink, &t.DownloadLink, &t.DownloadFile, &t.IncludeProductInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func loadProduct(productID int) (*Product, error) {
+	var p Product
+	var price sql.NullFloat64
+	err := db.QueryRow(`
+		SELECT id, name, COALESCE(description, ''), price,
+		       COALESCE(image_url, ''), COALESCE(product_link, '')
+		FROM tbl_products
+		WHERE id = $1
+	`, productID).Scan(&p.ID, &p.Name, &p.Description, &price, &p.ImageURL, &p.ProductLink)
+	if err != nil {
+		return nil, err
+	}
+	p.Price = price.Float64
+
+	return &p, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestRenderTemplate(t *testing.T) {
+	product := &Product{Name: "Preset Pack", Description: "20 presets", Price: 19, ProductLink: "https://shop.example/p"}
+
+	tests := []struct {
+		name     string
+		template DMTemplate
+		data     TemplateData
+		want     string
+	}{
+		{
+			name:     "variables",
+			template: DMTemplate{MessageText: "Hi @{{username}}, you said: {{ comment.text }}"},
+			data:     TemplateData{Username: "jane", CommentText: "info"},
+			want:     "Hi @jane, you said: info",
+		},
+		{
+			name:     "product variables",
+			template: DMTemplate{MessageText: "{{product.name}} is {{product.price}}: {{product.link}}", IncludeProductInfo: true},
+			data:     TemplateData{Product: product},
+			want:     "Preset Pack is 19.00: https://shop.example/p",
+		},
+		{
+			name:     "product block appended",
+			template: DMTemplate{MessageText: "Here you go!", IncludeProductInfo: true},
+			data:     TemplateData{Product: product},
+			want:     "Here you go!\n\nPreset Pack - 19.00\n20 presets\nhttps://shop.example/p",
+		},
+		{
+			name:     "product sent as card",
+			template: DMTemplate{MessageText: "Here you go!", IncludeProductInfo: true},
+			data:     TemplateData{Product: product, ProductAsCard: true},
+			want:     "Here you go!",
+		},
+		{
+			name:     "product info off",
+			template: DMTemplate{MessageText: "Get {{product.name}}"},
+			data:     TemplateData{Product: product},
+			want:     "Get ",
+		},
+		{
+			name:     "download link appended",
+			template: DMTemplate{MessageText: "Thanks!\n", IncludeDownloadLink: true, DownloadLink: "https://dl.example/f"},
+			want:     "Thanks!\n\nhttps://dl.example/f",
+		},
+		{
+			name:     "download link placed",
+			template: DMTemplate{MessageText: "Grab it: {{download_link}}", IncludeDownloadLink: true, DownloadLink: "https://dl.example/f"},
+			want:     "Grab it: https://dl.example/f",
+		},
+		{
+			name:     "download link off",
+			template: DMTemplate{MessageText: "Grab it: {{download_link}}", DownloadLink: "https://dl.example/f"},
+			want:     "Grab it: ",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := renderTemplate(tt.template, tt.data)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTemplateUnknownVariable(t *testing.T) {
+	if _, err := renderTemplate(DMTemplate{MessageText: "Hi {{user_name}}"}, TemplateData{}); err == nil {
+		t.Error("expected an error for an unknown variable")
+	}
+}
+
+func TestValidateDMTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		req  CreateDMTemplateRequest
+		ok   bool
+	}{
+		{"valid", CreateDMTemplateRequest{MessageText: "Hi {{username}}"}, true},
+		{"empty text", CreateDMTemplateRequest{MessageText: " "}, false},
+		{"unknown variable", CreateDMTemplateRequest{MessageText: "Hi {{name}}"}, false},
+		{"download link missing", CreateDMTemplateRequest{MessageText: "Hi", IncludeDownloadLink: true}, false},
+		{"download file given", CreateDMTemplateRequest{MessageText: "Hi", IncludeDownloadLink: true, DownloadFile: "guide.pdf"}, true},
+		{"download link given", CreateDMTemplateRequest{MessageText: "Hi", IncludeDownloadLink: true, DownloadLink: "https://dl.example/f"}, true},
+		{"too many products", CreateDMTemplateRequest{MessageText: "Hi", ProductIDs: make([]int, maxCarouselCards+1)}, false},
+	}
+
+	for _, tt := range tests {
+		if err := validateDMTemplate(tt.req); (err == nil) != tt.ok {
+			t.Errorf("%s: validateDMTemplate() = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"instagram-autodm/graph"
+)
+
+// ============================================
+// ACCESS TOKEN REFRESH
+// ============================================
+
+// Long-lived Instagram tokens expire 60 days after they were issued or last
+// refreshed, after which every send fails with code 190. tokenRefreshScheduler
+// refreshes each connected account's token (and ACCESS_TOKEN) once it is
+// within TOKEN_REFRESH_BEFORE of expiring. A token that can't be refreshed
+// any more puts its account in needs_reauth and fires an alert.
+//
+// The env token is refreshed in memory and kept in tbl_env_tokens so a
+// restart picks up the refreshed token rather than the stale ACCESS_TOKEN.
+// Changing ACCESS_TOKEN replaces the stored one.
+
+const (
+	longLivedTokenTTL    = 60 * 24 * time.Hour
+	tokenRefreshMinAge   = 24 * time.Hour // Instagram won't refresh a younger token
+	tokenRefreshInterval = 1 * time.Hour
+)
+
+// envToken is the current token of the env-configured account.
+var envToken struct {
+	sync.RWMutex
+	token      string
+	expiresAt  time.Time // zero if unknown
+	refreshed  time.Time // zero if unknown
+	sourceHash string    // hash of the ACCESS_TOKEN it descends from
+}
+
+// Set once the env account has been reported as needing reauth, so every
+// failing send doesn't alert again. Only de-duplicates the alert: refreshes
+// keep being tried, and a successful one clears it.
+var envTokenAlerted int32
+
+// Set while the env account's refreshes keep failing, so the failure is
+// alerted once per streak rather than on every pass
+var envTokenRefreshFailing int32
+
+func envAccessToken() string {
+	envToken.RLock()
+	defer envToken.RUnlock()
+	return envToken.token
+}
+
+// appAccessToken is the "app_id|app_secret" token debug_token needs, "" if
+// META_APP_ID or APP_SECRET isn't set.
+func appAccessToken() string {
+	if config.MetaAppID == "" || len(config.AppSecrets) == 0 {
+		return ""
+	}
+	return config.MetaAppID + "|" + config.AppSecrets[0]
+}
+
+// tokenExpiry works out when a token expires: from expires_in when the
+// caller has it (the token exchange returns it), else from debug_token. ok is
+// false when neither says.
+func tokenExpiry(creds IGCredentials, expiresIn int64) (time.Time, bool) {
+	if expiresIn > 0 {
+		return time.Now().Add(time.Duration(expiresIn) * time.Second), true
+	}
+
+	appToken := appAccessToken()
+	if appToken == "" {
+		return time.Time{}, false
+	}
+	info, err := graphAPI(creds).DebugToken(appToken)
+	if err != nil {
+		log.Printf("⚠️  debug_token for IG account %s failed: %v", creds.IGUserID, err)
+		return time.Time{}, false
+	}
+	if info.ExpiresAt == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(info.ExpiresAt, 0), true
+}
+
+// initEnvToken loads the env account's token, preferring one refreshed on an
+// earlier run from the same ACCESS_TOKEN.
+func initEnvToken() {
+	if config.AccessToken == "" {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(config.AccessToken))
+	hash := hex.EncodeToString(sum[:])
+
+	envToken.Lock()
+	defer envToken.Unlock()
+	envToken.token = config.AccessToken
+	envToken.sourceHash = hash
+
+	var token string
+	var expiresAt, refreshedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT access_token, expires_at, refreshed_at FROM tbl_env_tokens
+		WHERE ig_user_id = $1 AND source_token_hash = $2
+	`, config.IGBusinessID, hash).Scan(&token, &expiresAt, &refreshedAt)
+	if err == nil {
+		envToken.token = token
+		envToken.expiresAt = expiresAt.Time
+		envToken.refreshed = refreshedAt.Time
+		log.Println("🔑 Using the refreshed ACCESS_TOKEN from a previous run")
+		return
+	}
+	if err != sql.ErrNoRows {
+		log.Println("❌ Env token load error:", err)
+	}
+
+	creds := IGCredentials{IGUserID: config.IGBusinessID, AccessToken: config.AccessToken}
+	if t, ok := tokenExpiry(creds, 0); ok {
+		envToken.expiresAt = t
+	}
+	saveEnvToken(envToken.token, envToken.expiresAt, time.Time{})
+}
+
+// saveEnvToken stores the env account's current token. Callers hold envToken.
+func saveEnvToken(token string, expiresAt, refreshedAt time.Time) {
+	_, err := db.Exec(`
+		INSERT INTO tbl_env_tokens (ig_user_id, source_token_hash, access_token, expires_at, refreshed_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT (ig_user_id) DO UPDATE
+		SET source_token_hash = $2, access_token = $3, expires_at = $4, refreshed_at = $5, updated_at = NOW()
+	`, config.IGBusinessID, envToken.sourceHash, token, nullTime(expiresAt), nullTime(refreshedAt))
+
+	if err != nil {
+		log.Println("❌ Env token save error:", err)
+	}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// tokenDue reports whether a token should be refreshed now: it's close to
+// (or past, or has an unknown) expiry, and old enough to be refreshable.
+func tokenDue(expiresAt, refreshedAt time.Time) bool {
+	if !refreshedAt.IsZero() && time.Since(refreshedAt) < tokenRefreshMinAge {
+		return false
+	}
+	return expiresAt.IsZero() || time.Until(expiresAt) < config.RefreshBefore
+}
+
+// countNeedsReauth is the number of connected accounts waiting to be
+// reconnected.
+func countNeedsReauth() int {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM tbl_ig_accounts WHERE status = 'needs_reauth'").Scan(&count)
+	return count
+}
+
+func tokenRefreshScheduler() {
+	for {
+		refreshEnvToken()
+		refreshAccountTokens()
+		time.Sleep(tokenRefreshInterval)
+	}
+}
+
+func refreshEnvToken() {
+	if config.AccessToken == "" {
+		return
+	}
+
+	envToken.RLock()
+	token, expiresAt, refreshedAt := envToken.token, envToken.expiresAt, envToken.refreshed
+	envToken.RUnlock()
+	if !tokenDue(expiresAt, refreshedAt) {
+		return
+	}
+
+	tok, err := graphAPI(IGCredentials{IGUserID: config.IGBusinessID, AccessToken: token}).RefreshToken()
+	if err != nil {
+		tokenRefreshFailed(config.IGBusinessID, "", expiresAt, err)
+		return
+	}
+
+	envToken.Lock()
+	envToken.token = tok.AccessToken
+	envToken.expiresAt = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	envToken.refreshed = time.Now()
+	saveEnvToken(envToken.token, envToken.expiresAt, envToken.refreshed)
+	envToken.Unlock()
+	atomic.StoreInt32(&envTokenAlerted, 0)
+	atomic.StoreInt32(&envTokenRefreshFailing, 0)
+
+	log.Printf("🔑 ACCESS_TOKEN refreshed, expires in %v", (time.Duration(tok.ExpiresIn) * time.Second).Round(time.Hour))
+}
+
+func refreshAccountTokens() {
+	rows, err := db.Query(`
+		SELECT id, platform_ig_account_id, access_token, token_expires_at
+		FROM tbl_ig_accounts
+		WHERE status IS DISTINCT FROM 'needs_reauth' AND COALESCE(access_token, '') <> ''
+		  AND (token_expires_at IS NULL OR token_expires_at < NOW() + make_interval(secs => $1))
+		  AND (token_refreshed_at IS NULL OR token_refreshed_at < NOW() - make_interval(secs => $2))
+	`, config.RefreshBefore.Seconds(), tokenRefreshMinAge.Seconds())
+	if err != nil {
+		log.Println("❌ Token refresh query error:", err)
+		return
+	}
+
+	type dueAccount struct {
+		id, igUserID, token string
+		expiresAt           sql.NullTime
+	}
+	var due []dueAccount
+	for rows.Next() {
+		var a dueAccount
+		if err := rows.Scan(&a.id, &a.igUserID, &a.token, &a.expiresAt); err != nil {
+			log.Println("❌ Token refresh scan error:", err)
+			continue
+		}
+		due = append(due, a)
+	}
+	rows.Close()
+
+	for _, a := range due {
+		tok, err := graphAPI(IGCredentials{IGUserID: a.igUserID, AccessToken: a.token}).RefreshToken()
+		if err != nil {
+			tokenRefreshFailed(a.igUserID, a.id, a.expiresAt.Time, err)
+			continue
+		}
+
+		_, err = db.Exec(`
+			UPDATE tbl_ig_accounts
+			SET access_token = $2, token_expires_at = NOW() + make_interval(secs => $3),
+			    token_refreshed_at = NOW(), token_refresh_error = NULL, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, a.id, tok.AccessToken, tok.ExpiresIn)
+		if err != nil {
+			log.Printf("❌ Failed to store refreshed token for IG account %s: %v", a.igUserID, err)
+			continue
+		}
+		log.Printf("🔑 Token for IG account %s refreshed", a.igUserID)
+	}
+}
+
+// tokenRefreshFailed handles a failed refresh. A rejected or already expired
+// token needs the creator to reconnect; anything else is retried on the next
+// pass, with an alert on the first failure of a streak so someone can look
+// before the token lapses.
+func tokenRefreshFailed(igUserID, accountID string, expiresAt time.Time, err error) {
+	firstFailure := true
+	if accountID != "" {
+		dbErr := db.QueryRow(`
+			UPDATE tbl_ig_accounts a
+			SET token_refresh_error = $2
+			FROM (SELECT id, token_refresh_error IS NULL AS first FROM tbl_ig_accounts WHERE id = $1 FOR UPDATE) prev
+			WHERE a.id = prev.id
+			RETURNING prev.first
+		`, accountID, err.Error()).Scan(&firstFailure)
+		if dbErr != nil {
+			log.Println("❌ Token refresh error update failed:", dbErr)
+		}
+	}
+
+	var ge *graph.Error
+	expired := !expiresAt.IsZero() && time.Now().After(expiresAt)
+	if (errors.As(err, &ge) && ge.Kind == graph.ErrAuth) || expired {
+		markAccountNeedsReauth(igUserID, err)
+		return
+	}
+
+	log.Printf("⚠️  Token refresh for IG account %s failed, retrying in %v: %v", igUserID, tokenRefreshInterval, err)
+	if accountID == "" {
+		firstFailure = atomic.CompareAndSwapInt32(&envTokenRefreshFailing, 0, 1)
+	}
+	if !firstFailure {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"ig_account_id": igUserID,
+		"error":         err.Error(),
+	}
+	if !expiresAt.IsZero() {
+		fields["token_expires_at"] = expiresAt
+	}
+	sendAlert("token_refresh_failed", fields)
+}
+
+// sendAlert posts an operational event to ALERT_WEBHOOK_URL (a Slack-style
+// incoming webhook or any JSON endpoint). It doesn't block the caller.
+func sendAlert(event string, fields map[string]interface{}) {
+	log.Printf("🚨 Alert %s: %v", event, fields)
+	if config.AlertWebhookURL == "" {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"event": event,
+		"text":  alertText(event, fields),
+		"time":  time.Now().UTC(),
+	}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	body, _ := json.Marshal(payload)
+
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(config.AlertWebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("❌ Alert webhook error:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("❌ Alert webhook returned %s", resp.Status)
+		}
+	}()
+}
+
+func alertText(event string, fields map[string]interface{}) string {
+	account := fmt.Sprint(fields["ig_account_id"])
+	if u, ok := fields["username"].(string); ok && u != "" {
+		account = "@" + u
+	}
+
+	switch event {
+	case "account_needs_reauth":
+		return fmt.Sprintf("Instagram account %s needs to be reconnected: its access token was rejected", account)
+	case "token_refresh_failed":
+		return fmt.Sprintf("Refreshing the access token of Instagram account %s failed, will retry", account)
+	}
+	return event
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"instagram-autodm/graph/graphtest"
+)
+
+func TestTokenDue(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+	config.RefreshBefore = 10 * 24 * time.Hour
+
+	now := time.Now()
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name        string
+		expiresAt   time.Time
+		refreshedAt time.Time
+		want        bool
+	}{
+		{"far from expiry", now.Add(30 * day), time.Time{}, false},
+		{"within refresh window", now.Add(5 * day), time.Time{}, true},
+		{"already expired", now.Add(-day), time.Time{}, true},
+		{"unknown expiry", time.Time{}, time.Time{}, true},
+		{"refreshed too recently", now.Add(5 * day), now.Add(-time.Hour), false},
+		{"refreshed over a day ago", now.Add(5 * day), now.Add(-25 * time.Hour), true},
+		{"unknown expiry, just refreshed", time.Time{}, now.Add(-time.Minute), false},
+	}
+
+	for _, tt := range tests {
+		if got := tokenDue(tt.expiresAt, tt.refreshedAt); got != tt.want {
+			t.Errorf("%s: tokenDue = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlertText(t *testing.T) {
+	tests := []struct {
+		event  string
+		fields map[string]interface{}
+		want   string
+	}{
+		{"account_needs_reauth", map[string]interface{}{"ig_account_id": "1784", "username": "creator"},
+			"Instagram account @creator needs to be reconnected: its access token was rejected"},
+		{"token_refresh_failed", map[string]interface{}{"ig_account_id": "1784"},
+			"Refreshing the access token of Instagram account 1784 failed, will retry"},
+		{"something_else", map[string]interface{}{}, "something_else"},
+	}
+
+	for _, tt := range tests {
+		if got := alertText(tt.event, tt.fields); got != tt.want {
+			t.Errorf("alertText(%s) = %q, want %q", tt.event, got, tt.want)
+		}
+	}
+}
+
+// alertRecorder points ALERT_WEBHOOK_URL at a local server and collects the
+// events posted to it.
+type alertRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func recordAlerts(t *testing.T) *alertRecorder {
+	rec := &alertRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Event string `json:"event"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		rec.mu.Lock()
+		rec.events = append(rec.events, payload.Event)
+		rec.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	config.AlertWebhookURL = srv.URL
+	return rec
+}
+
+// wait gives sendAlert's background posts time to arrive.
+func (rec *alertRecorder) wait(n int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec.mu.Lock()
+		events := append([]string(nil), rec.events...)
+		rec.mu.Unlock()
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func insertTokenAccount(t *testing.T, igUserID, token string, expiresIn time.Duration) string {
+	t.Helper()
+
+	var accountID string
+	err := db.QueryRow(`
+		INSERT INTO tbl_ig_accounts (platform_ig_account_id, username, access_token, token_expires_at)
+		VALUES ($1, 'creator', $2, NOW() + make_interval(secs => $3))
+		RETURNING id
+	`, igUserID, token, expiresIn.Seconds()).Scan(&accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accountID
+}
+
+func TestRefreshAccountTokens(t *testing.T) {
+	srv := setupQueueTest(t)
+	config.RefreshBefore = 10 * 24 * time.Hour
+
+	due := insertTokenAccount(t, "17841400000000002", "due_token", 5*24*time.Hour)
+	fresh := insertTokenAccount(t, "17841400000000003", "fresh_token", 50*24*time.Hour)
+
+	refreshAccountTokens()
+
+	reqs := srv.RequestsTo(graphtest.RefreshToken)
+	if len(reqs) != 1 || reqs[0].Token != "due_token" {
+		t.Fatalf("want one refresh with due_token, got %+v", reqs)
+	}
+
+	var token string
+	var days float64
+	db.QueryRow(`
+		SELECT access_token, EXTRACT(EPOCH FROM token_expires_at - NOW()) / 86400 FROM tbl_ig_accounts WHERE id = $1
+	`, due).Scan(&token, &days)
+	if token == "due_token" || days < 59 || days > 60 {
+		t.Errorf("due account has %q expiring in %.1f days, want a new 60-day token", token, days)
+	}
+	db.QueryRow("SELECT access_token FROM tbl_ig_accounts WHERE id = $1", fresh).Scan(&token)
+	if token != "fresh_token" {
+		t.Errorf("fresh account token changed to %q", token)
+	}
+
+	// Just refreshed: not due again
+	refreshAccountTokens()
+	if n := len(srv.RequestsTo(graphtest.RefreshToken)); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+}
+
+func TestRefreshFailures(t *testing.T) {
+	srv := setupQueueTest(t)
+	config.RefreshBefore = 10 * 24 * time.Hour
+	alerts := recordAlerts(t)
+
+	// A transient failure is retried on the next pass, alerting once
+	srv.On(graphtest.RefreshToken, graphtest.ServerError(503)).Times(2)
+	flaky := insertTokenAccount(t, "17841400000000002", "flaky_token", 5*24*time.Hour)
+	refreshAccountTokens()
+	refreshAccountTokens()
+
+	var status, refreshErr string
+	db.QueryRow(`
+		SELECT COALESCE(status, ''), COALESCE(token_refresh_error, '') FROM tbl_ig_accounts WHERE id = $1
+	`, flaky).Scan(&status, &refreshErr)
+	if status == "needs_reauth" || refreshErr == "" {
+		t.Errorf("after a 503: status %q, refresh error %q", status, refreshErr)
+	}
+	if n := len(srv.RequestsTo(graphtest.RefreshToken)); n != 2 {
+		t.Errorf("tried %d refreshes, want 2", n)
+	}
+
+	refreshAccountTokens()
+	db.QueryRow("SELECT COALESCE(token_refresh_error, '') FROM tbl_ig_accounts WHERE id = $1", flaky).Scan(&refreshErr)
+	if refreshErr != "" {
+		t.Errorf("refresh error %q kept after a successful refresh", refreshErr)
+	}
+
+	// A new streak after the success alerts again
+	srv.On(graphtest.RefreshToken, graphtest.ServerError(503)).Times(1)
+	db.Exec("UPDATE tbl_ig_accounts SET token_refreshed_at = NULL WHERE id = $1", flaky)
+	refreshAccountTokens()
+	if events := alerts.wait(2); len(events) != 2 || events[0] != "token_refresh_failed" || events[1] != "token_refresh_failed" {
+		t.Errorf("alerts = %v, want token_refresh_failed once per streak", events)
+	}
+
+	// A rejected token needs the creator to reconnect
+	srv.On(graphtest.RefreshToken, graphtest.TokenExpired())
+	rejected := insertTokenAccount(t, "17841400000000003", "bad_token", 5*24*time.Hour)
+	refreshAccountTokens()
+
+	db.QueryRow("SELECT COALESCE(status, '') FROM tbl_ig_accounts WHERE id = $1", rejected).Scan(&status)
+	if status != "needs_reauth" {
+		t.Errorf("rejected token: status %q, want needs_reauth", status)
+	}
+	if events := alerts.wait(3); len(events) != 3 || events[2] != "account_needs_reauth" {
+		t.Errorf("alerts = %v, want account_needs_reauth last", events)
+	}
+}
+
+func TestRefreshEnvToken(t *testing.T) {
+	srv := setupQueueTest(t)
+	config.RefreshBefore = 10 * 24 * time.Hour
+
+	envToken.Lock()
+	envToken.expiresAt = time.Now().Add(5 * 24 * time.Hour)
+	envToken.refreshed = time.Time{}
+	envToken.Unlock()
+	// Alerted earlier: refreshing still goes ahead and re-arms the alert
+	atomic.StoreInt32(&envTokenAlerted, 1)
+
+	// Failing passes alert once
+	alerts := recordAlerts(t)
+	srv.On(graphtest.RefreshToken, graphtest.ServerError(503)).Times(2)
+	refreshEnvToken()
+	refreshEnvToken()
+	if events := alerts.wait(1); len(events) != 1 || events[0] != "token_refresh_failed" {
+		t.Errorf("alerts = %v, want one token_refresh_failed", events)
+	}
+	srv.Reset()
+
+	refreshEnvToken()
+
+	if reqs := srv.RequestsTo(graphtest.RefreshToken); len(reqs) != 1 || reqs[0].Token != "env_token" {
+		t.Fatalf("want one refresh with env_token, got %+v", reqs)
+	}
+	token := envAccessToken()
+	if token == "env_token" {
+		t.Fatal("env token not replaced")
+	}
+	if atomic.LoadInt32(&envTokenAlerted) != 0 || atomic.LoadInt32(&envTokenRefreshFailing) != 0 {
+		t.Error("alerts not re-armed after a successful refresh")
+	}
+
+	var stored string
+	db.QueryRow("SELECT access_token FROM tbl_env_tokens WHERE ig_user_id = $1", testIGBusinessID).Scan(&stored)
+	if stored != token {
+		t.Errorf("stored env token %q, want %q", stored, token)
+	}
+
+	// The next comment is sent with the refreshed token
+	processAccountComment("", testComment("c1", "u1"))
+	runDueJob(t)
+	if reqs := srv.RequestsTo(graphtest.Messages); len(reqs) != 1 || reqs[0].Token != token {
+		t.Errorf("want one send with the refreshed token, got %+v", reqs)
+	}
+}
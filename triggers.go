@@ -0,0 +1,542 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ============================================
+// COMMENT TRIGGER RULE ENGINE
+// ============================================
+
+// Match modes
+const (
+	MatchWholeWord = "whole_word" // pattern appears as whole word(s): "info" doesn't match "information"
+	MatchExact     = "exact"      // the whole comment is the pattern (ignoring surrounding punctuation)
+	MatchContains  = "contains"   // plain substring
+	MatchRegex     = "regex"      // Go regexp syntax
+	MatchEmoji     = "emoji"      // comment contains any of the space-separated emoji in pattern
+)
+
+type Trigger struct {
+	ID               int    `json:"id"`
+	AccountID        int    `json:"account_id"`
+	Name             string `json:"name"`
+	MatchMode        string `json:"match_mode"`
+	Pattern          string `json:"pattern"`
+	CaseSensitive    bool   `json:"case_sensitive"`
+	IgnoreDiacritics bool   `json:"ignore_diacritics"`
+	Priority         int    `json:"priority"`
+	MediaID          string `json:"media_id,omitempty"`
+	DMTemplateID     int    `json:"dm_template_id,omitempty"`
+	FlowID           int    `json:"flow_id,omitempty"`
+	IsActive         bool   `json:"is_active"`
+	// Public replies to the triggering comment, used in rotation
+	ReplyVariants     []string `json:"reply_variants"`
+	ReplyDelaySeconds int      `json:"reply_delay_seconds"`
+
+	// Compiled pattern of regex and whole_word triggers, set by compile when
+	// the trigger is loaded so every comment doesn't recompile it
+	re *regexp.Regexp
+}
+
+type TriggerRequest struct {
+	Name             string `json:"name"`
+	MatchMode        string `json:"match_mode"`
+	Pattern          string `json:"pattern"`
+	CaseSensitive    bool   `json:"case_sensitive"`
+	IgnoreDiacritics *bool  `json:"ignore_diacritics"`
+	Priority         int    `json:"priority"`
+	MediaID          string `json:"media_id"`
+	DMTemplateID     int    `json:"dm_template_id"`
+	FlowID           int    `json:"flow_id"`
+	IsActive         *bool  `json:"is_active"`
+
+	ReplyVariants     []string `json:"reply_variants"`
+	ReplyDelaySeconds int      `json:"reply_delay_seconds"`
+}
+
+// Matches reports whether the comment text fires this trigger.
+func (t Trigger) Matches(text string) bool {
+	switch t.MatchMode {
+	case MatchEmoji:
+		text = stripEmojiVariants(text)
+		for _, e := range strings.Fields(stripEmojiVariants(t.Pattern)) {
+			if strings.Contains(text, e) {
+				return true
+			}
+		}
+		return false
+	case MatchRegex:
+		re := t.re
+		if re == nil {
+			var err error
+			if re, err = t.compileRegex(); err != nil {
+				log.Printf("⚠️ Trigger %d has invalid regex: %v", t.ID, err)
+				return false
+			}
+		}
+		return re.MatchString(t.normalize(text))
+	}
+
+	text, pattern := t.normalize(text), t.normalize(t.Pattern)
+
+	switch t.MatchMode {
+	case MatchExact:
+		return strings.TrimFunc(text, isPunctOrSpace) == strings.TrimFunc(pattern, isPunctOrSpace)
+	case MatchContains:
+		return strings.Contains(text, pattern)
+	default:
+		if t.re != nil {
+			return t.re.MatchString(text)
+		}
+		return wholeWordRegex(pattern).MatchString(text)
+	}
+}
+
+// compile caches the trigger's compiled pattern for Matches. An invalid
+// regex is left uncached and reported when it is matched.
+func (t *Trigger) compile() {
+	switch t.MatchMode {
+	case MatchExact, MatchContains, MatchEmoji:
+	case MatchRegex:
+		t.re, _ = t.compileRegex()
+	default:
+		t.re = wholeWordRegex(t.normalize(t.Pattern))
+	}
+}
+
+func (t Trigger) normalize(s string) string {
+	if t.IgnoreDiacritics {
+		s = foldDiacritics(s)
+	}
+	if !t.CaseSensitive {
+		s = strings.ToLower(s)
+	}
+	return s
+}
+
+func (t Trigger) compileRegex() (*regexp.Regexp, error) {
+	pattern := t.Pattern
+	if t.IgnoreDiacritics {
+		pattern = foldDiacritics(pattern)
+	}
+	if !t.CaseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	return cachedRegexp(pattern)
+}
+
+// validate checks a trigger before it is saved.
+func (t Trigger) validate() error {
+	if strings.TrimSpace(t.Pattern) == "" {
+		return fmt.Errorf("pattern is required")
+	}
+
+	switch t.MatchMode {
+	case MatchWholeWord, MatchExact, MatchContains, MatchEmoji:
+	case MatchRegex:
+		if _, err := t.compileRegex(); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown match_mode %q", t.MatchMode)
+	}
+
+	if t.ReplyDelaySeconds < 0 {
+		return fmt.Errorf("reply_delay_seconds can't be negative")
+	}
+	for _, v := range t.ReplyVariants {
+		if strings.TrimSpace(v) == "" {
+			return fmt.Errorf("reply_variants can't contain empty replies")
+		}
+		if utf8.RuneCountInString(v) > maxCommentLength {
+			return fmt.Errorf("reply variant is longer than %d characters", maxCommentLength)
+		}
+		if err := validateTemplateText(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wholeWordRegex matches pattern only when it is bounded by non-letters
+// (works for any script, unlike \b which is ASCII-only).
+func wholeWordRegex(pattern string) *regexp.Regexp {
+	re, _ := cachedRegexp(`(^|[^\p{L}\p{N}_])` + regexp.QuoteMeta(pattern) + `($|[^\p{L}\p{N}_])`)
+	return re
+}
+
+// Compiled trigger patterns by source. Triggers are loaded for every
+// comment, so compile reuses these; they only change when a creator edits
+// a trigger, which keeps the map small.
+var triggerRegexps sync.Map
+
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := triggerRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	triggerRegexps.Store(pattern, re)
+	return re, nil
+}
+
+func foldDiacritics(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	out, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return out
+}
+
+// stripEmojiVariants drops variation selectors and skin tone modifiers so
+// "❤" matches "❤️" and "👍" matches "👍🏽".
+func stripEmojiVariants(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\uFE0F' || r == '\uFE0E' || (r >= 0x1F3FB && r <= 0x1F3FF) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func isPunctOrSpace(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSpace(r)
+}
+
+// matchTrigger returns the winning trigger for a comment, or nil. triggers
+// must already be in evaluation order (see loadTriggers).
+func matchTrigger(triggers []Trigger, c CommentData) *Trigger {
+	for i := range triggers {
+		t := &triggers[i]
+		if t.MediaID != "" && t.MediaID != c.MediaID {
+			continue
+		}
+		if t.Matches(c.Text) {
+			return t
+		}
+	}
+	return nil
+}
+
+// keywordTriggers turns the global KEYWORDS list into whole-word triggers,
+// used for accounts that haven't defined any of their own.
+func keywordTriggers(keywords []string) []Trigger {
+	var triggers []Trigger
+	for _, kw := range keywords {
+		if kw == "" {
+			continue
+		}
+		t := Trigger{
+			Name:             kw,
+			MatchMode:        MatchWholeWord,
+			Pattern:          kw,
+			IgnoreDiacritics: true,
+			IsActive:         true,
+		}
+		t.compile()
+		triggers = append(triggers, t)
+	}
+	return triggers
+}
+
+// ============================================
+// TRIGGER CRUD ENDPOINTS
+// ============================================
+
+func listTriggersHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	triggers, err := loadTriggers(accountID, false)
+	if err != nil {
+		log.Printf("Failed to list triggers: %v", err)
+		http.Error(w, "Failed to list triggers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"triggers": triggers,
+	})
+}
+
+func getTriggerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	t, err := getTrigger(p.ByName("account_id"), p.ByName("trigger_id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trigger not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get trigger", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+func createTriggerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	t, ok := decodeTriggerRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := validateTriggerRefs(accountID, t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	triggerID, err := createTrigger(accountID, t)
+	if err != nil {
+		log.Printf("Failed to create trigger: %v", err)
+		http.Error(w, "Failed to create trigger", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"trigger_id": triggerID,
+		"message":    "Trigger created successfully",
+	})
+}
+
+func updateTriggerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	accountID := p.ByName("account_id")
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	t, ok := decodeTriggerRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := validateTriggerRefs(accountID, t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	found, err := updateTrigger(accountID, p.ByName("trigger_id"), t)
+	if err != nil {
+		log.Printf("Failed to update trigger: %v", err)
+		http.Error(w, "Failed to update trigger", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Trigger not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Trigger updated successfully",
+	})
+}
+
+func deleteTriggerHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if _, err := verifyJWT(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	res, err := db.Exec(
+		"DELETE FROM triggers WHERE id = $1 AND ig_account_id = $2",
+		p.ByName("trigger_id"), p.ByName("account_id"),
+	)
+	if err != nil {
+		http.Error(w, "Failed to delete trigger", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Trigger not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Trigger deleted successfully",
+	})
+}
+
+// decodeTriggerRequest parses and validates the body, writing the error
+// response itself when it returns false.
+func decodeTriggerRequest(w http.ResponseWriter, r *http.Request) (Trigger, bool) {
+	var req TriggerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return Trigger{}, false
+	}
+
+	t := Trigger{
+		Name:             req.Name,
+		MatchMode:        req.MatchMode,
+		Pattern:          req.Pattern,
+		CaseSensitive:    req.CaseSensitive,
+		IgnoreDiacritics: req.IgnoreDiacritics == nil || *req.IgnoreDiacritics,
+		Priority:         req.Priority,
+		MediaID:          req.MediaID,
+		DMTemplateID:     req.DMTemplateID,
+		FlowID:           req.FlowID,
+		IsActive:         req.IsActive == nil || *req.IsActive,
+
+		ReplyVariants:     req.ReplyVariants,
+		ReplyDelaySeconds: req.ReplyDelaySeconds,
+	}
+	if t.MatchMode == "" {
+		t.MatchMode = MatchWholeWord
+	}
+
+	if err := t.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Trigger{}, false
+	}
+
+	return t, true
+}
+
+// validateTriggerRefs makes sure the DM template and flow a trigger sends
+// belong to the account.
+func validateTriggerRefs(accountID string, t Trigger) error {
+	if err := validatePublishRefs(accountID, 0, t.DMTemplateID); err != nil {
+		return err
+	}
+
+	if t.FlowID != 0 {
+		var exists bool
+		db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM tbl_dm_flows WHERE id = $1 AND ig_account_id = $2)",
+			t.FlowID, accountID,
+		).Scan(&exists)
+		if !exists {
+			return fmt.Errorf("flow %d not found for this account", t.FlowID)
+		}
+	}
+
+	return nil
+}
+
+// ============================================
+// TRIGGER DATABASE OPERATIONS
+// ============================================
+
+const triggerColumns = `
+	id, ig_account_id, COALESCE(name, ''), match_mode, pattern, case_sensitive,
+	ignore_diacritics, priority, COALESCE(media_id, ''), COALESCE(dm_template_id, 0),
+	COALESCE(flow_id, 0), is_active, COALESCE(reply_variants, '{}'), reply_delay_seconds
+`
+
+func scanTrigger(row interface{ Scan(...interface{}) error }) (Trigger, error) {
+	var t Trigger
+	err := row.Scan(&t.ID, &t.AccountID, &t.Name, &t.MatchMode, &t.Pattern, &t.CaseSensitive,
+		&t.IgnoreDiacritics, &t.Priority, &t.MediaID, &t.DMTemplateID, &t.FlowID, &t.IsActive,
+		pq.Array(&t.ReplyVariants), &t.ReplyDelaySeconds)
+	t.compile()
+	return t, err
+}
+
+// loadTriggers returns an account's triggers in evaluation order: highest
+// priority first, media-scoped before account-wide, then oldest first.
+func loadTriggers(accountID string, activeOnly bool) ([]Trigger, error) {
+	rows, err := db.Query(`
+		SELECT `+triggerColumns+`
+		FROM triggers
+		WHERE ig_account_id = $1 AND (is_active OR NOT $2)
+		ORDER BY priority DESC, (media_id IS NOT NULL) DESC, id ASC
+	`, accountID, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	triggers := []Trigger{}
+	for rows.Next() {
+		t, err := scanTrigger(rows)
+		if err != nil {
+			return nil, err
+		}
+		triggers = append(triggers, t)
+	}
+
+	return triggers, rows.Err()
+}
+
+func getTrigger(accountID, triggerID string) (Trigger, error) {
+	return scanTrigger(db.QueryRow(`
+		SELECT `+triggerColumns+`
+		FROM triggers
+		WHERE id = $1 AND ig_account_id = $2
+	`, triggerID, accountID))
+}
+
+func createTrigger(accountID string, t Trigger) (int, error) {
+	var triggerID int
+	err := db.QueryRow(`
+		INSERT INTO triggers (
+			ig_account_id, name, match_mode, pattern, case_sensitive,
+			ignore_diacritics, priority, media_id, dm_template_id, is_active, flow_id,
+			reply_variants, reply_delay_seconds
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, 0), $10, NULLIF($11, 0), $12, $13)
+		RETURNING id
+	`, accountID, t.Name, t.MatchMode, t.Pattern, t.CaseSensitive,
+		t.IgnoreDiacritics, t.Priority, t.MediaID, t.DMTemplateID, t.IsActive, t.FlowID,
+		pq.Array(t.ReplyVariants), t.ReplyDelaySeconds).Scan(&triggerID)
+
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+
+	log.Printf("Trigger created successfully with ID: %d", triggerID)
+	return triggerID, nil
+}
+
+func updateTrigger(accountID, triggerID string, t Trigger) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE triggers SET
+			name = $3, match_mode = $4, pattern = $5, case_sensitive = $6,
+			ignore_diacritics = $7, priority = $8, media_id = NULLIF($9, ''),
+			dm_template_id = NULLIF($10, 0), is_active = $11, flow_id = NULLIF($12, 0),
+			reply_variants = $13, reply_delay_seconds = $14, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND ig_account_id = $2
+	`, triggerID, accountID, t.Name, t.MatchMode, t.Pattern, t.CaseSensitive,
+		t.IgnoreDiacritics, t.Priority, t.MediaID, t.DMTemplateID, t.IsActive, t.FlowID,
+		pq.Array(t.ReplyVariants), t.ReplyDelaySeconds)
+	if err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestTriggerMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger Trigger
+		text    string
+		want    bool
+	}{
+		{"whole word", Trigger{MatchMode: MatchWholeWord, Pattern: "info"}, "Info please!", true},
+		{"whole word inside another word", Trigger{MatchMode: MatchWholeWord, Pattern: "info"}, "more information", false},
+		{"whole word phrase", Trigger{MatchMode: MatchWholeWord, Pattern: "send it"}, "pls send it now", true},
+		{"whole word non-latin", Trigger{MatchMode: MatchWholeWord, Pattern: "цена"}, "Цена?", true},
+		{"case sensitive", Trigger{MatchMode: MatchWholeWord, Pattern: "INFO", CaseSensitive: true}, "info", false},
+		{"diacritics ignored", Trigger{MatchMode: MatchWholeWord, Pattern: "cafe", IgnoreDiacritics: true}, "Café?", true},
+		{"diacritics kept", Trigger{MatchMode: MatchWholeWord, Pattern: "cafe"}, "café", false},
+		{"exact", Trigger{MatchMode: MatchExact, Pattern: "link"}, "  Link!! ", true},
+		{"exact with more text", Trigger{MatchMode: MatchExact, Pattern: "link"}, "link please", false},
+		{"contains", Trigger{MatchMode: MatchContains, Pattern: "info"}, "information", true},
+		{"regex", Trigger{MatchMode: MatchRegex, Pattern: `^(price|cost)\b`}, "Price?", true},
+		{"regex no match", Trigger{MatchMode: MatchRegex, Pattern: `^(price|cost)\b`}, "what price", false},
+		{"regex case sensitive", Trigger{MatchMode: MatchRegex, Pattern: `^price`, CaseSensitive: true}, "Price", false},
+		{"invalid regex", Trigger{MatchMode: MatchRegex, Pattern: `(`}, "(", false},
+		{"emoji", Trigger{MatchMode: MatchEmoji, Pattern: "🔥 ❤️"}, "love it ❤", true},
+		{"emoji absent", Trigger{MatchMode: MatchEmoji, Pattern: "🔥"}, "love it", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.trigger.Matches(tt.text); got != tt.want {
+			t.Errorf("%s: Matches(%q) = %v, want %v", tt.name, tt.text, got, tt.want)
+		}
+		// Loaded triggers match with their cached pattern
+		tt.trigger.compile()
+		if got := tt.trigger.Matches(tt.text); got != tt.want {
+			t.Errorf("%s: compiled Matches(%q) = %v, want %v", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTriggerValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger Trigger
+		ok      bool
+	}{
+		{"whole word", Trigger{MatchMode: MatchWholeWord, Pattern: "info"}, true},
+		{"regex", Trigger{MatchMode: MatchRegex, Pattern: `^info\b`}, true},
+		{"blank pattern", Trigger{MatchMode: MatchWholeWord, Pattern: "  "}, false},
+		{"invalid regex", Trigger{MatchMode: MatchRegex, Pattern: `(`}, false},
+		{"unknown mode", Trigger{MatchMode: "fuzzy", Pattern: "info"}, false},
+		{"reply variants", Trigger{MatchMode: MatchWholeWord, Pattern: "info", ReplyVariants: []string{"Sent you a DM, @{{username}}!"}}, true},
+		{"blank reply variant", Trigger{MatchMode: MatchWholeWord, Pattern: "info", ReplyVariants: []string{"Check your DMs", " "}}, false},
+		{"long reply variant", Trigger{MatchMode: MatchWholeWord, Pattern: "info", ReplyVariants: []string{strings.Repeat("a", maxCommentLength+1)}}, false},
+		{"unknown reply variable", Trigger{MatchMode: MatchWholeWord, Pattern: "info", ReplyVariants: []string{"Hi {{name}}"}}, false},
+		{"negative reply delay", Trigger{MatchMode: MatchWholeWord, Pattern: "info", ReplyDelaySeconds: -1}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.trigger.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestMatchTrigger(t *testing.T) {
+	triggers := []Trigger{
+		{ID: 1, MatchMode: MatchWholeWord, Pattern: "info", MediaID: "post_2"},
+		{ID: 2, MatchMode: MatchWholeWord, Pattern: "info"},
+		{ID: 3, MatchMode: MatchContains, Pattern: "in"},
+	}
+
+	tests := []struct {
+		comment CommentData
+		want    int
+	}{
+		{CommentData{MediaID: "post_2", Text: "info"}, 1},
+		{CommentData{MediaID: "post_1", Text: "info"}, 2},
+		{CommentData{MediaID: "post_1", Text: "pin"}, 3},
+		{CommentData{MediaID: "post_1", Text: "nope"}, 0},
+	}
+
+	for _, tt := range tests {
+		got := 0
+		if trigger := matchTrigger(triggers, tt.comment); trigger != nil {
+			got = trigger.ID
+		}
+		if got != tt.want {
+			t.Errorf("matchTrigger(%q on %s) = trigger %d, want %d", tt.comment.Text, tt.comment.MediaID, got, tt.want)
+		}
+	}
+}
+
+func TestKeywordTriggers(t *testing.T) {
+	triggers := keywordTriggers([]string{"", "info"})
+	if len(triggers) != 1 {
+		t.Fatalf("got %d triggers, want 1", len(triggers))
+	}
+	if !triggers[0].Matches("INFO pls") || triggers[0].Matches("infos") {
+		t.Errorf("keyword trigger should match whole words, case-insensitively")
+	}
+}
+
+func TestTriggerHandlersCheckOwnership(t *testing.T) {
+	setupTestDB(t)
+	accountID := insertTestAccount(t, modeLive)
+	var otherID, templateID, otherTemplateID int
+	db.QueryRow("INSERT INTO tbl_ig_accounts (platform_ig_account_id, access_token) VALUES ('17841400000000003', 'tok') RETURNING id").Scan(&otherID)
+	db.QueryRow("INSERT INTO tbl_dm_templates (ig_account_id, message_text) VALUES ($1, 'Hi') RETURNING id", accountID).Scan(&templateID)
+	db.QueryRow("INSERT INTO tbl_dm_templates (ig_account_id, message_text) VALUES ($1, 'Hi') RETURNING id", otherID).Scan(&otherTemplateID)
+
+	def := FlowDefinition{Start: "hi", Nodes: map[string]FlowNode{"hi": {Type: FlowNodeText, Text: "Hi"}}}
+	flowID, err := createFlow(accountID, Flow{Name: "mine", Definition: def, IsActive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherFlowID, err := createFlow(strconv.Itoa(otherID), Flow{Name: "theirs", Definition: def, IsActive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	triggerID, err := createTrigger(accountID, Trigger{Name: "info", MatchMode: MatchWholeWord, Pattern: "info", IsActive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := httprouter.New()
+	router.POST("/api/accounts/:account_id/triggers", createTriggerHandler)
+	router.PUT("/api/accounts/:account_id/triggers/:trigger_id", updateTriggerHandler)
+	token, _ := generateJWT(1, "owner@example.com")
+
+	tests := []struct {
+		name       string
+		templateID int
+		flowID     int
+		want       int
+	}{
+		{"own template", templateID, 0, http.StatusOK},
+		{"own flow", 0, flowID, http.StatusOK},
+		{"other account's template", otherTemplateID, 0, http.StatusBadRequest},
+		{"other account's flow", 0, otherFlowID, http.StatusBadRequest},
+		{"missing flow", 0, 999, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		body := fmt.Sprintf(`{"pattern": "info", "dm_template_id": %d, "flow_id": %d}`, tt.templateID, tt.flowID)
+		for _, route := range []struct{ method, path string }{
+			{"POST", "/api/accounts/" + accountID + "/triggers"},
+			{"PUT", fmt.Sprintf("/api/accounts/%s/triggers/%d", accountID, triggerID)},
+		} {
+			req := httptest.NewRequest(route.method, route.path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("%s (%s): got %d, want %d", tt.name, route.method, rec.Code, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+)
+
+// ============================================
+// WEBHOOK ROUTING
+// ============================================
+
+// Meta delivers every event for the app to one callback URL. Each entry's id
+// is the Instagram account the event belongs to, which we resolve against
+// tbl_ig_accounts.platform_ig_account_id.
+
+// Number of webhook entries for accounts we don't know
+var webhookUnknownAccountEvents int64
+
+func dispatchWebhook(payload WebhookPayload) {
+	for _, entry := range payload.Entry {
+		igID := entry.ID
+		if igID == "" {
+			igID = config.IGBusinessID
+		}
+
+		accountID, ok := resolveWebhookAccount(igID)
+		if !ok {
+			atomic.AddInt64(&webhookUnknownAccountEvents, 1)
+			log.Printf("⚠️ Webhook entry for unknown IG account %s (%d changes, %d messages) ignored",
+				igID, len(entry.Changes), len(entry.Messaging))
+			continue
+		}
+
+		for _, event := range entry.Messaging {
+			processInboundMessage(igID, accountID, event)
+		}
+
+		for _, change := range entry.Changes {
+			processChange(igID, accountID, change)
+		}
+	}
+}
+
+// processChange decodes one entry change by field and hands it on.
+func processChange(igID, accountID string, change Change) {
+	switch change.Field {
+	case "comments", "live_comments":
+		var c CommentData
+		if err := json.Unmarshal(change.Value, &c); err != nil {
+			log.Printf("Error decoding %s change: %v", change.Field, err)
+			return
+		}
+		if change.Field == "comments" {
+			processAccountComment(accountID, c.normalized())
+		} else {
+			processLiveComment(accountID, c.normalized())
+		}
+	case "messages", "messaging_postbacks":
+		var event MessagingEvent
+		if err := json.Unmarshal(change.Value, &event); err != nil {
+			log.Printf("Error decoding %s change: %v", change.Field, err)
+			return
+		}
+		processInboundMessage(igID, accountID, event)
+	default:
+		log.Printf("Ignoring webhook field %q for IG account %s", change.Field, igID)
+	}
+}
+
+// resolveWebhookAccount maps an entry id to a tbl_ig_accounts id. The
+// env-configured account (IG_BUSINESS_ID) is accepted even when it isn't
+// connected through the API, in which case accountID is "".
+func resolveWebhookAccount(igID string) (accountID string, ok bool) {
+	if accountID = accountIDForIGUser(igID); accountID != "" {
+		return accountID, true
+	}
+
+	return "", igID == config.IGBusinessID
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func testSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"object":"instagram","entry":[]}`)
+
+	tests := []struct {
+		name    string
+		header  string
+		secrets []string
+		want    bool
+	}{
+		{"valid", testSignature("s3cret", body), []string{"s3cret"}, true},
+		{"rotated secret", testSignature("old", body), []string{"new", "old"}, true},
+		{"wrong secret", testSignature("other", body), []string{"s3cret"}, false},
+		{"no secrets", testSignature("s3cret", body), nil, false},
+		{"missing header", "", []string{"s3cret"}, false},
+		{"sha1 header", "sha1=" + strings.TrimPrefix(testSignature("s3cret", body), "sha256="), []string{"s3cret"}, false},
+		{"not hex", "sha256=zz", []string{"s3cret"}, false},
+		{"other body", testSignature("s3cret", []byte(`{}`)), []string{"s3cret"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := validSignature(body, tt.header, tt.secrets); got != tt.want {
+			t.Errorf("%s: validSignature = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	old := config
+	t.Cleanup(func() { config = old })
+
+	body := `{"object":"instagram","entry":[]}`
+	var got string
+	handler := verifyWebhookSignature(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		b, _ := io.ReadAll(r.Body)
+		got = string(b)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	secrets := []string{"s3cret"}
+	tests := []struct {
+		name          string
+		secrets       []string
+		allowUnsigned bool
+		header        string
+		status        int
+	}{
+		{"signed", secrets, false, testSignature("s3cret", []byte(body)), http.StatusOK},
+		{"bad signature", secrets, false, testSignature("other", []byte(body)), http.StatusUnauthorized},
+		{"unsigned", secrets, false, "", http.StatusUnauthorized},
+		{"unsigned, optional but secret set", secrets, true, "", http.StatusUnauthorized},
+		{"no secret configured", nil, false, testSignature("s3cret", []byte(body)), http.StatusUnauthorized},
+		{"no secret, signatures optional", nil, true, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		config.AppSecrets = tt.secrets
+		config.AllowUnsigned = tt.allowUnsigned
+		got = ""
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		if tt.header != "" {
+			req.Header.Set(signatureHeader, tt.header)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req, nil)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		if tt.status == http.StatusOK && got != body {
+			t.Errorf("%s: handler read body %q, want the original", tt.name, got)
+		}
+		if tt.status != http.StatusOK && got != "" {
+			t.Errorf("%s: handler ran for a rejected delivery", tt.name)
+		}
+	}
+}